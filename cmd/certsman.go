@@ -1,9 +1,23 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/devnulled/certsman/internal/config"
 	"github.com/devnulled/certsman/internal/server"
 )
 
 func main() {
-	server.RunServer()
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	server.RunServer(cfg)
 }
@@ -0,0 +1,389 @@
+/*
+The config package loads the settings for the certsman server.
+
+config.go - the settings, their defaults, and validation
+load.go - loads settings from a YAML/JSON file, environment variables and command-line flags
+
+*/
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the issuers that can be selected with the issuer setting
+const (
+	IssuerString = "string"
+	IssuerToken  = "token"
+	IssuerX509   = "x509"
+	IssuerACME   = "acme"
+)
+
+// Names of the persistence providers that can be selected with the persistence setting
+const (
+	PersistenceMemory = "memory"
+	PersistenceFile   = "file"
+)
+
+// Default log level
+const DefaultLogLevel = "info"
+
+// Default key length for the TokenCerts that get generated
+const DefaultTokenCertKeyLength = 1024
+
+// Default expiration for certificates
+const DefaultCertDurationMinutes = 10
+
+// Maximum amount of certificates that get stored using the in-memory persistence
+const DefaultInMemoryCertStorageLimit = 20000
+
+// How long the server waits for connections to drain before doing a graceful shutdown
+const DefaultServerGracefulTimeoutSeconds = 15
+
+// Default address for the HTTP server to listen on
+const DefaultServerAddress = "0.0.0.0:8080"
+
+// Default address for the HTTPS server to listen on
+const DefaultTLSServerAddress = "0.0.0.0:8443"
+
+// Default name for the cert to self-generate
+const DefaultCertServerName = "secure.certsman-server.com"
+
+// Default amount of time to sleep as specified by the requirements
+const DefaultArtificalSleepSeconds = 10
+
+// Default string to use for the string cert issuer
+const DefaultStringCertPrefix = "foo-"
+
+// Default fraction of a certificate's lifetime remaining when the renewal scheduler renews it
+const DefaultRenewBeforeFraction = 1.0 / 3.0
+
+// Default fraction of the renewal lead time which is randomly taken off each renewal, to spread renewals out
+const DefaultJitterFraction = 0.1
+
+// Default port http-01 ACME challenge responses are fetched from
+const DefaultHTTP01Port = 80
+
+// Default port tls-alpn-01 ACME challenge handshakes are made to
+const DefaultTLSALPN01Port = 443
+
+// Default algorithm of the keys generated for certificates, when a request doesn't choose one
+const DefaultKeyAlgorithm = certsman.KeyAlgorithmECDSAP256
+
+// Default most names a single certificate can be requested for
+const DefaultMaxNames = 100
+
+// Shortest token allowed to fetch private keys, so that they can't be guessed
+const MinKeyAccessTokenLength = 16
+
+// Config provides every setting for the certsman server
+type Config struct {
+	// One of trace, debug, info, warn, error
+	LogLevel string `yaml:"logLevel" json:"logLevel"`
+
+	HTTP  ListenerConfig `yaml:"http" json:"http"`
+	HTTPS ListenerConfig `yaml:"https" json:"https"`
+
+	// How long the server waits for connections to drain before doing a graceful shutdown
+	GracefulTimeoutSeconds int `yaml:"gracefulTimeoutSeconds" json:"gracefulTimeoutSeconds"`
+
+	// Name of the cert the server issues for itself and serves over HTTPS
+	CertServerName string `yaml:"certServerName" json:"certServerName"`
+	// How long issued certificates are valid for
+	CertDurationMinutes int `yaml:"certDurationMinutes" json:"certDurationMinutes"`
+
+	Issuer      IssuerConfig      `yaml:"issuer" json:"issuer"`
+	Persistence PersistenceConfig `yaml:"persistence" json:"persistence"`
+	CA          CAConfig          `yaml:"ca" json:"ca"`
+	Renewal     RenewalConfig     `yaml:"renewal" json:"renewal"`
+	Policy      PolicyConfig      `yaml:"policy" json:"policy"`
+	KeyAccess   KeyAccessConfig   `yaml:"keyAccess" json:"keyAccess"`
+	ACME        ACMEConfig        `yaml:"acme" json:"acme"`
+}
+
+// ListenerConfig provides the settings for one of the server's listeners
+type ListenerConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Address string `yaml:"address" json:"address"`
+}
+
+// IssuerConfig selects and configures the issuer for GET /cert/{hostname}
+type IssuerConfig struct {
+	// One of string, token, x509 or acme
+	Name string `yaml:"name" json:"name"`
+
+	StringPrefix string `yaml:"stringPrefix" json:"stringPrefix"`
+	SleepEnabled bool   `yaml:"sleepEnabled" json:"sleepEnabled"`
+	SleepSeconds int    `yaml:"sleepSeconds" json:"sleepSeconds"`
+
+	TokenKeyLength int `yaml:"tokenKeyLength" json:"tokenKeyLength"`
+
+	// Algorithm of the keys the x509 and acme issuers generate, when a request doesn't choose one
+	KeyAlgorithm string `yaml:"keyAlgorithm" json:"keyAlgorithm"`
+	// Key algorithms requests may choose.  Empty allows any.
+	AllowedKeyAlgorithms []string `yaml:"allowedKeyAlgorithms" json:"allowedKeyAlgorithms"`
+
+	// Directory URL of the upstream CA the acme issuer gets certificates from
+	ACMEDirectoryURL string `yaml:"acmeDirectoryURL" json:"acmeDirectoryURL"`
+	// Email address registered with the upstream CA's account.  Empty registers no contact.
+	ACMEEmail string `yaml:"acmeEmail" json:"acmeEmail"`
+	// Whether the upstream CA's terms of service are agreed to
+	ACMEAgreeToTerms bool `yaml:"acmeAgreeToTerms" json:"acmeAgreeToTerms"`
+	// File the upstream account's key is kept in, which is created if it doesn't exist.  Required by the acme issuer, so
+	// a new account isn't registered on every restart.
+	ACMEAccountKeyFile string `yaml:"acmeAccountKeyFile" json:"acmeAccountKeyFile"`
+}
+
+// PersistenceConfig selects and configures where certificates are stored
+type PersistenceConfig struct {
+	// One of memory or file
+	Name string `yaml:"name" json:"name"`
+
+	MemoryLimit int `yaml:"memoryLimit" json:"memoryLimit"`
+
+	// Directory certificates are kept in by the file persistence
+	Dir string `yaml:"dir" json:"dir"`
+}
+
+// CAConfig configures the local certificate authority
+type CAConfig struct {
+	// Directory the CA is kept in.  Empty keeps it in memory, so it changes on every restart.
+	Dir string `yaml:"dir" json:"dir"`
+}
+
+// RenewalConfig configures the background renewal scheduler
+type RenewalConfig struct {
+	// Fraction of a certificate's lifetime left when it is renewed.  Stored certificates requested with less than this
+	// left are issued again too.
+	RenewBeforeFraction float64 `yaml:"renewBeforeFraction" json:"renewBeforeFraction"`
+	// Up to this fraction of the renewal lead time is taken off at random, so certificates issued together don't all
+	// renew together.  Zero turns jitter off.
+	JitterFraction float64 `yaml:"jitterFraction" json:"jitterFraction"`
+}
+
+// PolicyConfig restricts the names certificates can be requested for with a CSR, or alongside a hostname
+type PolicyConfig struct {
+	// Domains requested names must be, or be a subdomain of.  Empty allows any domain.
+	AllowedDomains []string `yaml:"allowedDomains" json:"allowedDomains"`
+	// Whether certificates can be requested for IP addresses
+	AllowIPAddresses bool `yaml:"allowIPAddresses" json:"allowIPAddresses"`
+	// Whether certificates can be requested for wildcard names such as *.example.com
+	AllowWildcards bool `yaml:"allowWildcards" json:"allowWildcards"`
+	// Most names a single certificate can be requested for
+	MaxNames int `yaml:"maxNames" json:"maxNames"`
+}
+
+// KeyAccessConfig controls who can fetch the private keys of the certificates certsman generates
+type KeyAccessConfig struct {
+	// Bearer tokens which may fetch private keys.  Empty turns fetching private keys off.
+	Tokens []string `yaml:"tokens" json:"tokens"`
+}
+
+// ACMEConfig configures the ACME server
+type ACMEConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// URL clients reach the server at, e.g. https://certsman.example.com.  Empty uses the host of each request.
+	BaseURL string `yaml:"baseURL" json:"baseURL"`
+	// URL of the terms of service clients must agree to when registering.  Empty doesn't require agreement.
+	TermsOfService string `yaml:"termsOfService" json:"termsOfService"`
+	// Port http-01 challenge responses are fetched from.  Only change this for testing or staging.
+	HTTP01Port int `yaml:"http01Port" json:"http01Port"`
+	// Port tls-alpn-01 challenge handshakes are made to.  Only change this for testing or staging.
+	TLSALPN01Port int `yaml:"tlsALPN01Port" json:"tlsALPN01Port"`
+	// host:port of the DNS server dns-01 challenge records are looked up with.  Empty uses the system's resolver.
+	DNSServer string `yaml:"dnsServer" json:"dnsServer"`
+}
+
+// Default returns the settings used when nothing else is configured
+func Default() Config {
+	return Config{
+		LogLevel: DefaultLogLevel,
+		HTTP: ListenerConfig{
+			Enabled: true,
+			Address: DefaultServerAddress,
+		},
+		HTTPS: ListenerConfig{
+			Enabled: true,
+			Address: DefaultTLSServerAddress,
+		},
+		GracefulTimeoutSeconds: DefaultServerGracefulTimeoutSeconds,
+		CertServerName:         DefaultCertServerName,
+		CertDurationMinutes:    DefaultCertDurationMinutes,
+		Issuer: IssuerConfig{
+			Name:           IssuerString,
+			StringPrefix:   DefaultStringCertPrefix,
+			SleepEnabled:   true,
+			SleepSeconds:   DefaultArtificalSleepSeconds,
+			TokenKeyLength: DefaultTokenCertKeyLength,
+			KeyAlgorithm:   DefaultKeyAlgorithm,
+		},
+		Persistence: PersistenceConfig{
+			Name:        PersistenceMemory,
+			MemoryLimit: DefaultInMemoryCertStorageLimit,
+		},
+		Renewal: RenewalConfig{
+			RenewBeforeFraction: DefaultRenewBeforeFraction,
+			JitterFraction:      DefaultJitterFraction,
+		},
+		Policy: PolicyConfig{
+			MaxNames: DefaultMaxNames,
+		},
+		ACME: ACMEConfig{
+			HTTP01Port:    DefaultHTTP01Port,
+			TLSALPN01Port: DefaultTLSALPN01Port,
+		},
+	}
+}
+
+// Validate checks every setting, returning an error which describes all of the problems found
+func (c Config) Validate() error {
+	var problems []string
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("logLevel %q is not a valid log level", c.LogLevel))
+	}
+
+	if !c.HTTP.Enabled && !c.HTTPS.Enabled {
+		problems = append(problems, "at least one of http or https must be enabled")
+	}
+	if c.HTTP.Enabled {
+		problems = appendAddressProblem(problems, "http.address", c.HTTP.Address)
+	}
+	if c.HTTPS.Enabled {
+		problems = appendAddressProblem(problems, "https.address", c.HTTPS.Address)
+	}
+
+	if c.GracefulTimeoutSeconds < 0 {
+		problems = append(problems, "gracefulTimeoutSeconds can't be negative")
+	}
+	if strings.TrimSpace(c.CertServerName) == "" {
+		problems = append(problems, "certServerName must be set")
+	}
+	if c.CertDurationMinutes <= 0 {
+		problems = append(problems, "certDurationMinutes must be greater than zero")
+	}
+
+	switch c.Issuer.Name {
+	case IssuerString:
+		if c.Issuer.SleepSeconds < 0 {
+			problems = append(problems, "issuer.sleepSeconds can't be negative")
+		}
+	case IssuerToken:
+		if c.Issuer.TokenKeyLength <= 0 {
+			problems = append(problems, "issuer.tokenKeyLength must be greater than zero")
+		}
+	case IssuerX509:
+	case IssuerACME:
+		if u, err := url.Parse(c.Issuer.ACMEDirectoryURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("issuer.acmeDirectoryURL %q is not an absolute http or https URL", c.Issuer.ACMEDirectoryURL))
+		}
+		if c.Issuer.ACMEAccountKeyFile == "" {
+			problems = append(problems, "issuer.acmeAccountKeyFile is required by the acme issuer")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("issuer.name %q is not one of %s, %s, %s or %s", c.Issuer.Name, IssuerString, IssuerToken, IssuerX509, IssuerACME))
+	}
+
+	if !certsman.ValidKeyAlgorithm(c.Issuer.KeyAlgorithm) {
+		problems = append(problems, fmt.Sprintf("issuer.keyAlgorithm %q is not one of %s", c.Issuer.KeyAlgorithm, strings.Join(certsman.KeyAlgorithms, ", ")))
+	}
+	for _, alg := range c.Issuer.AllowedKeyAlgorithms {
+		if !certsman.ValidKeyAlgorithm(alg) {
+			problems = append(problems, fmt.Sprintf("issuer.allowedKeyAlgorithms %q is not one of %s", alg, strings.Join(certsman.KeyAlgorithms, ", ")))
+		}
+	}
+	if len(c.Issuer.AllowedKeyAlgorithms) > 0 && !c.KeyAlgorithmAllowed(c.Issuer.KeyAlgorithm) {
+		problems = append(problems, "issuer.keyAlgorithm must be one of issuer.allowedKeyAlgorithms")
+	}
+
+	switch c.Persistence.Name {
+	case PersistenceMemory:
+		if c.Persistence.MemoryLimit <= 0 {
+			problems = append(problems, "persistence.memoryLimit must be greater than zero")
+		}
+	case PersistenceFile:
+		if strings.TrimSpace(c.Persistence.Dir) == "" {
+			problems = append(problems, "persistence.dir must be set for file persistence")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("persistence.name %q is not one of %s or %s", c.Persistence.Name, PersistenceMemory, PersistenceFile))
+	}
+
+	if c.Renewal.RenewBeforeFraction <= 0 || c.Renewal.RenewBeforeFraction >= 1 {
+		problems = append(problems, "renewal.renewBeforeFraction must be between 0 and 1")
+	}
+	if c.Renewal.JitterFraction < 0 || c.Renewal.JitterFraction >= 1 {
+		problems = append(problems, "renewal.jitterFraction must be at least 0 and less than 1")
+	}
+
+	if c.Policy.MaxNames <= 0 {
+		problems = append(problems, "policy.maxNames must be greater than zero")
+	}
+	for _, domain := range c.Policy.AllowedDomains {
+		if strings.TrimSpace(domain) == "" || strings.ContainsAny(domain, " /:*") {
+			problems = append(problems, fmt.Sprintf("policy.allowedDomains %q is not a domain", domain))
+		}
+	}
+
+	for _, token := range c.KeyAccess.Tokens {
+		if len(token) < MinKeyAccessTokenLength {
+			problems = append(problems, fmt.Sprintf("keyAccess.tokens must each be at least %d characters", MinKeyAccessTokenLength))
+			break
+		}
+	}
+
+	// The ACME server issues for its clients' CSRs, signed by certsman's own CA
+	if c.ACME.Enabled && c.Issuer.Name != IssuerX509 {
+		problems = append(problems, fmt.Sprintf("acme.enabled needs issuer.name %s, which can issue for a CSR, not %q", IssuerX509, c.Issuer.Name))
+	}
+
+	if c.ACME.Enabled && c.ACME.BaseURL != "" {
+		if u, err := url.Parse(c.ACME.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("acme.baseURL %q is not an absolute http or https URL", c.ACME.BaseURL))
+		}
+	}
+
+	if c.ACME.Enabled && (c.ACME.HTTP01Port <= 0 || c.ACME.HTTP01Port > 65535) {
+		problems = append(problems, "acme.http01Port must be between 1 and 65535")
+	}
+	if c.ACME.Enabled && (c.ACME.TLSALPN01Port <= 0 || c.ACME.TLSALPN01Port > 65535) {
+		problems = append(problems, "acme.tlsALPN01Port must be between 1 and 65535")
+	}
+	if c.ACME.Enabled && c.ACME.DNSServer != "" {
+		problems = appendAddressProblem(problems, "acme.dnsServer", c.ACME.DNSServer)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// KeyAlgorithmAllowed reports whether requests may choose the key algorithm
+func (c Config) KeyAlgorithmAllowed(alg string) bool {
+	if len(c.Issuer.AllowedKeyAlgorithms) == 0 {
+		return certsman.ValidKeyAlgorithm(alg)
+	}
+	for _, allowed := range c.Issuer.AllowedKeyAlgorithms {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// appendAddressProblem adds a problem if the address isn't a valid host:port
+func appendAddressProblem(problems []string, name string, address string) []string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return append(problems, fmt.Sprintf("%s %q is not a valid host:port", name, address))
+	}
+	return problems
+}
@@ -0,0 +1,257 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Environment variable naming the config file, when -config isn't passed
+const ConfigFileEnv = "CERTSMAN_CONFIG"
+
+// Prefix for the environment variable of every setting, e.g. http-address is CERTSMAN_HTTP_ADDRESS
+const EnvPrefix = "CERTSMAN_"
+
+// setting is a single value which can be set from an environment variable or command-line flag
+type setting struct {
+	name   string
+	usage  string
+	isBool bool
+	// Returns the current value formatted as a string, and parses a new value into the config
+	get func(c *Config) string
+	set func(c *Config, value string) error
+}
+
+// flagValue holds the raw value of a setting's command-line flag until it is applied over the environment
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be passed as just -name
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// settings lists everything that can be set from the environment or the command line
+var settings = []setting{
+	stringSetting("log-level", "one of trace, debug, info, warn, error", func(c *Config) *string { return &c.LogLevel }),
+	boolSetting("http-enabled", "serve plain HTTP", func(c *Config) *bool { return &c.HTTP.Enabled }),
+	stringSetting("http-address", "address to serve plain HTTP on", func(c *Config) *string { return &c.HTTP.Address }),
+	boolSetting("https-enabled", "serve HTTPS with the server's own cert", func(c *Config) *bool { return &c.HTTPS.Enabled }),
+	stringSetting("https-address", "address to serve HTTPS on", func(c *Config) *string { return &c.HTTPS.Address }),
+	intSetting("graceful-timeout-seconds", "how long to let connections drain on shutdown", func(c *Config) *int { return &c.GracefulTimeoutSeconds }),
+	stringSetting("cert-server-name", "name of the cert the server issues for itself", func(c *Config) *string { return &c.CertServerName }),
+	intSetting("cert-duration-minutes", "how long issued certificates are valid for", func(c *Config) *int { return &c.CertDurationMinutes }),
+	stringSetting("issuer", "issuer for GET /cert/{hostname}: string, token, x509 or acme", func(c *Config) *string { return &c.Issuer.Name }),
+	stringSetting("issuer-string-prefix", "prefix for string certificates", func(c *Config) *string { return &c.Issuer.StringPrefix }),
+	boolSetting("issuer-sleep-enabled", "sleep when issuing string certificates", func(c *Config) *bool { return &c.Issuer.SleepEnabled }),
+	intSetting("issuer-sleep-seconds", "how long to sleep when issuing string certificates", func(c *Config) *int { return &c.Issuer.SleepSeconds }),
+	intSetting("issuer-token-key-length", "length of token certificates", func(c *Config) *int { return &c.Issuer.TokenKeyLength }),
+	stringSetting("issuer-key-algorithm", "algorithm of generated keys when a request doesn't choose one: "+strings.Join(certsman.KeyAlgorithms, ", "), func(c *Config) *string { return &c.Issuer.KeyAlgorithm }),
+	stringListSetting("issuer-allowed-key-algorithms", "comma-separated key algorithms requests may choose, empty allows any", func(c *Config) *[]string { return &c.Issuer.AllowedKeyAlgorithms }),
+	stringSetting("issuer-acme-directory-url", "directory URL of the upstream CA for the acme issuer", func(c *Config) *string { return &c.Issuer.ACMEDirectoryURL }),
+	stringSetting("issuer-acme-email", "email address registered with the upstream CA", func(c *Config) *string { return &c.Issuer.ACMEEmail }),
+	boolSetting("issuer-acme-agree-to-terms", "agree to the upstream CA's terms of service", func(c *Config) *bool { return &c.Issuer.ACMEAgreeToTerms }),
+	stringSetting("issuer-acme-account-key-file", "file the upstream account key is kept in, created if it doesn't exist, required by the acme issuer", func(c *Config) *string { return &c.Issuer.ACMEAccountKeyFile }),
+	stringSetting("persistence", "where certificates are stored: memory or file", func(c *Config) *string { return &c.Persistence.Name }),
+	intSetting("persistence-memory-limit", "maximum certificates kept in memory", func(c *Config) *int { return &c.Persistence.MemoryLimit }),
+	stringSetting("persistence-dir", "directory certificates are kept in by file persistence", func(c *Config) *string { return &c.Persistence.Dir }),
+	stringSetting("ca-dir", "directory the local CA is kept in, empty keeps it in memory", func(c *Config) *string { return &c.CA.Dir }),
+	stringListSetting("policy-allowed-domains", "comma-separated domains requested names must be within, empty allows any", func(c *Config) *[]string { return &c.Policy.AllowedDomains }),
+	boolSetting("policy-allow-ip-addresses", "allow certificates to be requested for IP addresses", func(c *Config) *bool { return &c.Policy.AllowIPAddresses }),
+	boolSetting("policy-allow-wildcards", "allow certificates to be requested for wildcard names", func(c *Config) *bool { return &c.Policy.AllowWildcards }),
+	intSetting("policy-max-names", "most names a single certificate can be requested for", func(c *Config) *int { return &c.Policy.MaxNames }),
+	stringListSetting("key-access-tokens", "comma-separated bearer tokens which may fetch private keys, empty turns it off", func(c *Config) *[]string { return &c.KeyAccess.Tokens }),
+	floatSetting("renewal-renew-before-fraction", "fraction of a cert's lifetime remaining when it is renewed", func(c *Config) *float64 { return &c.Renewal.RenewBeforeFraction }),
+	floatSetting("renewal-jitter-fraction", "fraction of the renewal lead time taken off at random to spread renewals out, 0 turns it off", func(c *Config) *float64 { return &c.Renewal.JitterFraction }),
+	boolSetting("acme-enabled", "serve the ACME API under /acme, which needs the x509 issuer", func(c *Config) *bool { return &c.ACME.Enabled }),
+	stringSetting("acme-base-url", "URL ACME clients reach the server at, empty uses the host of each request", func(c *Config) *string { return &c.ACME.BaseURL }),
+	stringSetting("acme-terms-of-service", "URL of the terms of service ACME clients must agree to", func(c *Config) *string { return &c.ACME.TermsOfService }),
+	stringSetting("acme-dns-server", "host:port of the DNS server dns-01 challenges are checked with, empty uses the system's", func(c *Config) *string { return &c.ACME.DNSServer }),
+	intSetting("acme-http01-port", "port http-01 challenge responses are fetched from", func(c *Config) *int { return &c.ACME.HTTP01Port }),
+	intSetting("acme-tlsalpn01-port", "port tls-alpn-01 challenge handshakes are made to", func(c *Config) *int { return &c.ACME.TLSALPN01Port }),
+}
+
+// Load builds the config from, in increasing order of precedence: the defaults, the config file, environment
+// variables, and command-line flags.  The config file is named by -config or CERTSMAN_CONFIG, and is parsed as
+// JSON if it ends in .json and YAML otherwise.  The result is validated before it is returned.
+func Load(args []string, getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("certsman", flag.ContinueOnError)
+	configFile := fs.String("config", getenv(ConfigFileEnv), "YAML or JSON config file (env "+ConfigFileEnv+")")
+
+	flagValues := make(map[string]*flagValue)
+	for _, s := range settings {
+		flagValues[s.name] = &flagValue{value: s.get(&cfg), isBool: s.isBool}
+		fs.Var(flagValues[s.name], s.name, s.usage+" (env "+envName(s.name)+")")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(*configFile, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(getenv, envName(s.name)); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return Config{}, fmt.Errorf("%s: %v", envName(s.name), err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && flagErr == nil {
+				if err := s.set(&cfg, flagValues[s.name].value); err != nil {
+					flagErr = fmt.Errorf("-%s: %v", s.name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// loadFile reads the config file over the top of cfg.  Unknown keys are rejected so typos don't go unnoticed.
+func loadFile(path string, cfg *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return nil
+	}
+
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// envName returns the environment variable for a setting
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// lookupEnv treats an empty environment variable the same as an unset one
+func lookupEnv(getenv func(string) string, name string) (string, bool) {
+	value := getenv(name)
+	return value, value != ""
+}
+
+func stringSetting(name string, usage string, field func(c *Config) *string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return *field(c) },
+		set: func(c *Config, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func stringListSetting(name string, usage string, field func(c *Config) *[]string) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strings.Join(*field(c), ",") },
+		set: func(c *Config, value string) error {
+			var list []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			*field(c) = list
+			return nil
+		},
+	}
+}
+
+func intSetting(name string, usage string, field func(c *Config) *int) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.Itoa(*field(c)) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a whole number", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+func boolSetting(name string, usage string, field func(c *Config) *bool) setting {
+	return setting{
+		name:   name,
+		usage:  usage,
+		isBool: true,
+		get:    func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%q is not true or false", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
+
+func floatSetting(name string, usage string, field func(c *Config) *float64) setting {
+	return setting{
+		name:  name,
+		usage: usage,
+		get:   func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+		set: func(c *Config, value string) error {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", value)
+			}
+			*field(c) = parsed
+			return nil
+		},
+	}
+}
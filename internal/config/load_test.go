@@ -0,0 +1,252 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// envFrom returns a getenv func backed by a map
+func envFrom(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
+
+// writeConfigFile writes a config file into a temp dir, returning its path and a func to clean it up
+func writeConfigFile(t *testing.T, name string, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "certsman-config")
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(nil, envFrom(nil))
+
+	assert.Nil(t, err, "The defaults should be valid")
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "certsman.yaml", `
+logLevel: debug
+http:
+  address: 127.0.0.1:9000
+issuer:
+  name: token
+  tokenKeyLength: 64
+certDurationMinutes: 30
+`)
+	defer cleanup()
+
+	env := map[string]string{
+		"CERTSMAN_CONFIG":                  path,
+		"CERTSMAN_HTTP_ADDRESS":            "127.0.0.1:9001",
+		"CERTSMAN_ISSUER_TOKEN_KEY_LENGTH": "128",
+	}
+
+	cfg, err := Load([]string{"-issuer-token-key-length", "256", "-https-enabled=false"}, envFrom(env))
+	assert.Nil(t, err, "The config should load")
+
+	assert.Equal(t, "debug", cfg.LogLevel, "The file should override the defaults")
+	assert.Equal(t, 30, cfg.CertDurationMinutes, "The file should override the defaults")
+	assert.Equal(t, IssuerToken, cfg.Issuer.Name, "The file should override the defaults")
+	assert.Equal(t, "127.0.0.1:9001", cfg.HTTP.Address, "The environment should override the file")
+	assert.Equal(t, 256, cfg.Issuer.TokenKeyLength, "Flags should override the environment")
+	assert.False(t, cfg.HTTPS.Enabled, "Flags should override the defaults")
+	assert.Equal(t, DefaultStringCertPrefix, cfg.Issuer.StringPrefix, "Anything not set should keep its default")
+}
+
+func TestLoadJSONFile(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "certsman.json", `{"issuer": {"name": "x509"}, "ca": {"dir": "/var/lib/certsman"}}`)
+	defer cleanup()
+
+	cfg, err := Load([]string{"-config", path}, envFrom(nil))
+	assert.Nil(t, err, "The config should load")
+	assert.Equal(t, IssuerX509, cfg.Issuer.Name)
+	assert.Equal(t, "/var/lib/certsman", cfg.CA.Dir)
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "certsman.yaml", "issuerr:\n  name: token\n")
+	defer cleanup()
+
+	_, err := Load([]string{"-config", path}, envFrom(nil))
+	assert.NotNil(t, err, "A typo in the config file should be an error")
+}
+
+func TestLoadRejectsBadValues(t *testing.T) {
+	_, err := Load([]string{"-cert-duration-minutes", "ten"}, envFrom(nil))
+	assert.NotNil(t, err, "A non-numeric flag should be an error")
+
+	_, err = Load(nil, envFrom(map[string]string{"CERTSMAN_HTTP_ENABLED": "sometimes"}))
+	assert.NotNil(t, err, "A non-boolean environment variable should be an error")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Issuer.Name = "magic"
+	cfg.Persistence.Name = "cloud"
+	cfg.HTTP.Address = "nope"
+	cfg.LogLevel = "loud"
+
+	err := cfg.Validate()
+	assert.NotNil(t, err, "An invalid config should fail validation")
+	assert.Contains(t, err.Error(), "issuer.name")
+	assert.Contains(t, err.Error(), "persistence.name")
+	assert.Contains(t, err.Error(), "http.address")
+	assert.Contains(t, err.Error(), "logLevel")
+
+	cfg = Default()
+	cfg.HTTP.Enabled = false
+	cfg.HTTPS.Enabled = false
+	assert.NotNil(t, cfg.Validate(), "Disabling every listener should fail validation")
+}
+
+func TestValidateFilePersistenceNeedsDir(t *testing.T) {
+	cfg := Default()
+	cfg.Persistence.Name = PersistenceFile
+	assert.NotNil(t, cfg.Validate(), "File persistence without a dir should fail validation")
+
+	cfg.Persistence.Dir = "/var/lib/certsman/certs"
+	assert.Nil(t, cfg.Validate())
+}
+
+// acmeEnabled returns the default config with the ACME server turned on
+func acmeEnabled() Config {
+	cfg := Default()
+	cfg.Issuer.Name = IssuerX509
+	cfg.ACME.Enabled = true
+	return cfg
+}
+
+func TestValidateACMEEnabled(t *testing.T) {
+	assert.False(t, Default().ACME.Enabled, "The ACME server shouldn't be served by default")
+
+	cfg := Default()
+	cfg.ACME.Enabled = true
+	assert.NotNil(t, cfg.Validate(), "The ACME server should need an issuer which can issue for a CSR")
+
+	cfg.Issuer.Name = IssuerX509
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestValidateACMEBaseURL(t *testing.T) {
+	cfg := acmeEnabled()
+	cfg.ACME.BaseURL = "certsman.fooyork.com"
+	assert.NotNil(t, cfg.Validate(), "An ACME base URL without a scheme should fail validation")
+
+	cfg.ACME.BaseURL = "https://certsman.fooyork.com"
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestValidatePolicy(t *testing.T) {
+	cfg, err := Load([]string{"-policy-allowed-domains", "fooyork.com, barlondon.com", "-policy-allow-ip-addresses", "-policy-allow-wildcards"}, envFrom(nil))
+	assert.Nil(t, err)
+	assert.True(t, cfg.Policy.AllowWildcards)
+	assert.Equal(t, []string{"fooyork.com", "barlondon.com"}, cfg.Policy.AllowedDomains, "The domains should be split on commas")
+	assert.True(t, cfg.Policy.AllowIPAddresses)
+	assert.Equal(t, DefaultMaxNames, cfg.Policy.MaxNames)
+
+	cfg.Policy.AllowedDomains = []string{"*.fooyork.com"}
+	assert.NotNil(t, cfg.Validate(), "An allowed domain can't be a pattern")
+
+	cfg = Default()
+	cfg.Policy.MaxNames = 0
+	assert.NotNil(t, cfg.Validate(), "A max of 0 names should fail validation")
+}
+
+func TestValidateACMEIssuer(t *testing.T) {
+	cfg := Default()
+	cfg.Issuer.Name = IssuerACME
+	assert.NotNil(t, cfg.Validate(), "The acme issuer without a directory URL should fail validation")
+
+	cfg.Issuer.ACMEDirectoryURL = "acme.fooyork.com/directory"
+	cfg.Issuer.ACMEAccountKeyFile = "/var/lib/certsman/acme-account.key"
+	assert.NotNil(t, cfg.Validate(), "A directory URL without a scheme should fail validation")
+
+	cfg.Issuer.ACMEDirectoryURL = "https://acme.fooyork.com/directory"
+	cfg.Issuer.ACMEAccountKeyFile = ""
+	assert.NotNil(t, cfg.Validate(), "The acme issuer without an account key file should fail validation")
+
+	cfg, err := Load([]string{"-issuer", "acme", "-issuer-acme-directory-url", "https://acme.fooyork.com/directory", "-issuer-acme-agree-to-terms", "-issuer-acme-account-key-file", "/var/lib/certsman/acme-account.key"}, envFrom(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "https://acme.fooyork.com/directory", cfg.Issuer.ACMEDirectoryURL)
+	assert.True(t, cfg.Issuer.ACMEAgreeToTerms)
+}
+
+func TestValidateKeyAlgorithms(t *testing.T) {
+	cfg, err := Load([]string{"-issuer-key-algorithm", "rsa2048", "-issuer-allowed-key-algorithms", "rsa2048, ecdsa-p384"}, envFrom(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "rsa2048", cfg.Issuer.KeyAlgorithm)
+	assert.Equal(t, []string{"rsa2048", "ecdsa-p384"}, cfg.Issuer.AllowedKeyAlgorithms)
+	assert.True(t, cfg.KeyAlgorithmAllowed("ecdsa-p384"))
+	assert.False(t, cfg.KeyAlgorithmAllowed("ed25519"), "Algorithms left out of the allow-list shouldn't be allowed")
+
+	cfg.Issuer.KeyAlgorithm = "ed25519"
+	assert.NotNil(t, cfg.Validate(), "The default algorithm has to be allowed")
+
+	cfg = Default()
+	assert.Equal(t, DefaultKeyAlgorithm, cfg.Issuer.KeyAlgorithm)
+	assert.True(t, cfg.KeyAlgorithmAllowed("ed25519"), "Every algorithm should be allowed by default")
+
+	cfg.Issuer.KeyAlgorithm = "dsa1024"
+	assert.NotNil(t, cfg.Validate(), "An unknown default algorithm should fail validation")
+
+	cfg = Default()
+	cfg.Issuer.AllowedKeyAlgorithms = []string{"ecdsa-p256", "rsa1024"}
+	assert.NotNil(t, cfg.Validate(), "An unknown allowed algorithm should fail validation")
+}
+
+func TestValidateRenewalJitterFraction(t *testing.T) {
+	cfg, err := Load([]string{"-renewal-jitter-fraction", "0.25"}, envFrom(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 0.25, cfg.Renewal.JitterFraction)
+	assert.Equal(t, DefaultJitterFraction, Default().Renewal.JitterFraction, "Renewals should be jittered by default")
+
+	cfg.Renewal.JitterFraction = 0
+	assert.Nil(t, cfg.Validate(), "Jitter can be turned off")
+
+	cfg.Renewal.JitterFraction = -0.1
+	assert.NotNil(t, cfg.Validate(), "A negative jitter fraction should fail validation")
+}
+
+func TestValidateKeyAccess(t *testing.T) {
+	cfg, err := Load(nil, envFrom(map[string]string{"CERTSMAN_KEY_ACCESS_TOKENS": "0123456789abcdef,fedcba9876543210"}))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0123456789abcdef", "fedcba9876543210"}, cfg.KeyAccess.Tokens)
+
+	cfg.KeyAccess.Tokens = append(cfg.KeyAccess.Tokens, "hunter2")
+	assert.NotNil(t, cfg.Validate(), "A short token should fail validation")
+
+	assert.Empty(t, Default().KeyAccess.Tokens, "Private keys shouldn't be fetchable by default")
+}
+
+func TestValidateACMEHTTP01Port(t *testing.T) {
+	cfg := acmeEnabled()
+	cfg.ACME.HTTP01Port = 0
+	assert.NotNil(t, cfg.Validate(), "An http-01 port of 0 should fail validation")
+
+	cfg.ACME.HTTP01Port = DefaultHTTP01Port
+	cfg.ACME.TLSALPN01Port = 70000
+	assert.NotNil(t, cfg.Validate(), "A tls-alpn-01 port above 65535 should fail validation")
+
+	cfg.ACME.Enabled = false
+	assert.Nil(t, cfg.Validate(), "The port doesn't matter when ACME is off")
+}
+
+func TestValidateACMEDNSServer(t *testing.T) {
+	cfg := acmeEnabled()
+	cfg.ACME.DNSServer = "10.0.0.2"
+	assert.NotNil(t, cfg.Validate(), "A DNS server without a port should fail validation")
+
+	cfg.ACME.DNSServer = "10.0.0.2:53"
+	assert.Nil(t, cfg.Validate())
+}
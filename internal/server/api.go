@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	log "github.com/sirupsen/logrus"
+)
+
+// Header every response carries the ID of its request in.  A client can send its own ID in it to trace a request
+// across services.
+const requestIDHeader = "X-Request-ID"
+
+// A request ID sent by a client is only used if it matches this, so it can't inject anything into logs or headers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDKey is the context key the request's ID is kept under
+type requestIDKey struct{}
+
+// Machine-readable codes of the errors the API responds with
+const (
+	codeInvalidRequest         = "invalid_request"
+	codeInvalidHostname        = "invalid_hostname"
+	codeInvalidRequestBody     = "invalid_request_body"
+	codeInvalidName            = "invalid_name"
+	codeNameNotAllowed         = "name_not_allowed"
+	codeInvalidCSR             = "invalid_csr"
+	codeUnknownKeyAlgorithm    = "unknown_key_algorithm"
+	codeKeyAlgorithmNotAllowed = "key_algorithm_not_allowed"
+	codeUnknownFormat          = "unknown_format"
+	codeNotAcceptable          = "not_acceptable"
+	codeUnauthorized           = "unauthorized"
+	codeNotFound               = "not_found"
+	codeNotSupported           = "not_supported"
+	codeTimeout                = "timeout"
+	codeUnavailable            = "unavailable"
+	codeInternal               = "internal_error"
+)
+
+// apiError is an error along with the status and code it is responded to with
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// ID of the request which failed
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Message internal errors are responded to with, in place of what went wrong
+const internalErrorMessage = "Internal server error"
+
+// newAPIError wraps the error a request failed with, picking its code from what went wrong.  Internal errors are only
+// logged, as what went wrong can give away details of the server.
+func newAPIError(reqID string, status int, err error) *apiError {
+	code := errorCode(status, err)
+	if code == codeInternal {
+		log.WithFields(log.Fields{
+			"RequestID": reqID,
+			"Status":    status,
+		}).Error("Request failed: ", err)
+		return &apiError{Status: status, Code: code, Message: internalErrorMessage, RequestID: reqID}
+	}
+
+	return &apiError{Status: status, Code: code, Message: err.Error(), RequestID: reqID}
+}
+
+// errorCode is the machine-readable code for an error, falling back to one for the status when the error itself
+// isn't recognised
+func errorCode(status int, err error) string {
+	switch {
+	case errors.Is(err, certsman.ErrInvalidName):
+		return codeInvalidName
+	case errors.Is(err, certsman.ErrNameNotAllowed):
+		return codeNameNotAllowed
+	case errors.Is(err, certsman.ErrInvalidCSR):
+		return codeInvalidCSR
+	case errors.Is(err, certsman.ErrUnknownKeyAlgorithm):
+		return codeUnknownKeyAlgorithm
+	case errors.Is(err, errKeyAlgorithmNotAllowed):
+		return codeKeyAlgorithmNotAllowed
+	case errors.Is(err, errUnknownFormat):
+		return codeUnknownFormat
+	case errors.Is(err, certsman.ErrCSRNotSupported), errors.Is(err, certsman.ErrKeyAlgorithmNotSupported):
+		return codeNotSupported
+	case errors.Is(err, context.DeadlineExceeded):
+		return codeTimeout
+	case errors.Is(err, context.Canceled):
+		return codeUnavailable
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusNotAcceptable:
+		return codeNotAcceptable
+	case http.StatusNotImplemented:
+		return codeNotSupported
+	}
+	return codeInternal
+}
+
+// requestIDMiddleware gives every request an ID, taken from its X-Request-ID header if it has a usable one, and echoes
+// it in the response's X-Request-ID
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(reqID) {
+			reqID = requestIDGenerator()
+		}
+
+		w.Header().Set(requestIDHeader, reqID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, reqID)))
+	})
+}
+
+// requestID returns the ID requestIDMiddleware gave the request, or a new one if it didn't go through it
+func requestID(r *http.Request) string {
+	if reqID, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return reqID
+	}
+	return requestIDGenerator()
+}
+
+// v1CertificateGetHandler is GET /v1/certificates/{hostname}, which gets or creates the certificate the same as
+// GET /cert/{hostname}, and responds with it as JSON along with what is known about it.  Errors are JSON too.
+func v1CertificateGetHandler(w http.ResponseWriter, r *http.Request) {
+	serveV1Certificate(w, r, requestedNames(r), r.URL.Query().Get("alg"))
+}
+
+// v1CertificatePostHandler is POST /v1/certificates/{hostname}, which takes the certificate's further names and key
+// algorithm in a JSON body as well as the query, the same as POST /cert/{hostname}
+func v1CertificatePostHandler(w http.ResponseWriter, r *http.Request) {
+	var body certificateBody
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&body)
+	if err != nil && err != io.EOF {
+		writeJSONError(w, r, &apiError{Status: http.StatusBadRequest, Code: codeInvalidRequestBody, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+
+	if body.KeyAlgorithm == "" {
+		body.KeyAlgorithm = r.URL.Query().Get("alg")
+	}
+
+	serveV1Certificate(w, r, append(requestedNames(r), body.Names...), body.KeyAlgorithm)
+}
+
+// serveV1Certificate gets or creates the certificate for the hostname in the path, along with any further names, and
+// writes it out as JSON
+func serveV1Certificate(w http.ResponseWriter, r *http.Request, names []string, keyAlgorithm string) {
+	resp, apiErr := getOrCreateCertificate(r, names, keyAlgorithm)
+	if apiErr != nil {
+		writeJSONError(w, r, apiErr)
+		return
+	}
+
+	writeJSON(w, resp.StatusCode, newCertificateDocument(resp))
+}
+
+// writeJSONError writes an error out as JSON, in the form {"error": {"code": ..., "message": ..., "requestId": ...}}
+func writeJSONError(w http.ResponseWriter, r *http.Request, apiErr *apiError) {
+	if apiErr.RequestID == "" {
+		apiErr.RequestID = requestID(r)
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": apiErr.RequestID,
+		"Status":    apiErr.Status,
+		"Code":      apiErr.Code,
+	}).Debug("Request failed: ", apiErr.Message)
+
+	writeJSON(w, apiErr.Status, struct {
+		Error *apiError `json:"error"`
+	}{apiErr})
+}
+
+// writeJSON writes a value out as JSON with the status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		// requestIDMiddleware has already given the response its request's ID
+		apiErr := newAPIError(w.Header().Get(requestIDHeader), http.StatusInternalServerError, err)
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
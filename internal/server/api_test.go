@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestV1Certificate(t *testing.T) {
+	setUpTestServer(t)
+	namePolicy = certsman.NamePolicy{AllowedDomains: []string{"fooyork.com"}}
+
+	w := serveTestRequest(http.MethodGet, "/v1/certificates/fooyork.com", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	doc := decodeJSON(t, w)
+	assert.NotEmpty(t, w.Header().Get(requestIDHeader), "Every response should carry its request's ID")
+	assert.Equal(t, w.Header().Get(requestIDHeader), doc["requestId"])
+	assert.Equal(t, "fooyork.com", doc["hostname"])
+	assert.Equal(t, true, doc["wasCreated"], "The first request should create the certificate")
+	assert.Equal(t, false, doc["wasCached"])
+	assert.NotEmpty(t, doc["certificate"])
+	assert.NotEmpty(t, doc["serialNumber"])
+
+	w = serveTestRequest(http.MethodGet, "/v1/certificates/fooyork.com", "", map[string]string{requestIDHeader: "trace-1234"})
+	assert.Equal(t, "trace-1234", w.Header().Get(requestIDHeader), "A client's request ID should be used")
+	again := decodeJSON(t, w)
+	assert.Equal(t, "trace-1234", again["requestId"])
+	assert.Equal(t, false, again["wasCreated"])
+	assert.Equal(t, true, again["wasCached"], "The second request should be served the stored certificate")
+	assert.Equal(t, doc["serialNumber"], again["serialNumber"])
+
+	w = serveTestRequest(http.MethodPost, "/v1/certificates/fooyork.com", `{"names": ["www.fooyork.com"], "keyAlgorithm": "rsa2048"}`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	doc = decodeJSON(t, w)
+	assert.Equal(t, []interface{}{"fooyork.com", "www.fooyork.com"}, doc["names"])
+	assert.Equal(t, "rsa2048", doc["keyAlgorithm"])
+
+	w = serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", map[string]string{requestIDHeader: "not a usable id"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, "not a usable id", w.Header().Get(requestIDHeader), "An unusable request ID should be replaced")
+	assert.NotEmpty(t, w.Header().Get(requestIDHeader), "The original API should carry request IDs too")
+}
+
+func TestV1CertificateErrors(t *testing.T) {
+	setUpTestServer(t)
+	namePolicy = certsman.NamePolicy{AllowedDomains: []string{"fooyork.com"}}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/v1/certificates/f", "", http.StatusNotAcceptable, codeInvalidHostname},
+		{http.MethodGet, "/v1/certificates/fooyork.com?alg=dsa1024", "", http.StatusBadRequest, codeUnknownKeyAlgorithm},
+		{http.MethodGet, "/v1/certificates/fooyork.com?san=barlondon.com", "", http.StatusForbidden, codeNameNotAllowed},
+		{http.MethodGet, "/v1/certificates/fooyork.com?san=foo/york", "", http.StatusBadRequest, codeInvalidName},
+		{http.MethodPost, "/v1/certificates/fooyork.com", "{", http.StatusBadRequest, codeInvalidRequestBody},
+	}
+
+	for _, test := range tests {
+		w := serveTestRequest(test.method, test.target, test.body, nil)
+		assert.Equal(t, test.status, w.Code, test.target)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"), test.target)
+
+		apiErr := decodeJSON(t, w)["error"].(map[string]interface{})
+		assert.Equal(t, test.code, apiErr["code"], test.target)
+		assert.NotEmpty(t, apiErr["message"], test.target)
+		assert.Equal(t, w.Header().Get(requestIDHeader), apiErr["requestId"], "The error should say which request failed")
+	}
+
+	certService.Issuer = certs.StringCertIssuer{}
+	w := serveTestRequest(http.MethodGet, "/v1/certificates/fooyork.com?alg=rsa2048", "", nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	assert.Equal(t, codeNotSupported, decodeJSON(t, w)["error"].(map[string]interface{})["code"])
+}
+
+func TestV1CertificatePostKeyAlgorithmFromQuery(t *testing.T) {
+	setUpTestServer(t)
+
+	w := serveTestRequest(http.MethodPost, "/v1/certificates/fooyork.com?alg=rsa2048", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "rsa2048", decodeJSON(t, w)["keyAlgorithm"], "An empty body should fall back to the query")
+
+	w = serveTestRequest(http.MethodPost, "/v1/certificates/fooyork.com?alg=rsa2048", `{"keyAlgorithm": "ed25519"}`, nil)
+	assert.Equal(t, "ed25519", decodeJSON(t, w)["keyAlgorithm"], "The body should take precedence over the query")
+}
+
+func TestV1CertificatePostNamesFromQuery(t *testing.T) {
+	setUpTestServer(t)
+
+	w := serveTestRequest(http.MethodPost, "/v1/certificates/fooyork.com?san=api.fooyork.com", `{"names": ["www.fooyork.com"]}`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.ElementsMatch(t, []interface{}{"fooyork.com", "api.fooyork.com", "www.fooyork.com"}, decodeJSON(t, w)["names"], "?san= should be added to the names in the body")
+
+	w = serveTestRequest(http.MethodPost, "/v1/certificates/fooyork.com?san=api.fooyork.com", "", nil)
+	assert.ElementsMatch(t, []interface{}{"fooyork.com", "api.fooyork.com"}, decodeJSON(t, w)["names"], "?san= should be used without a body")
+}
+
+func TestNewAPIErrorHidesInternalErrors(t *testing.T) {
+	apiErr := newAPIError("trace-1234", http.StatusInternalServerError, errors.New("open /var/lib/certsman/fooyork.com.json: disk on fire"))
+	assert.Equal(t, codeInternal, apiErr.Code)
+	assert.Equal(t, internalErrorMessage, apiErr.Message, "What went wrong inside the server shouldn't be handed back")
+	assert.Equal(t, "trace-1234", apiErr.RequestID)
+
+	apiErr = newAPIError("trace-1234", http.StatusForbidden, certsman.ErrNameNotAllowed)
+	assert.Equal(t, certsman.ErrNameNotAllowed.Error(), apiErr.Message, "Errors the client can fix should say what is wrong")
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, codeTimeout, errorCode(http.StatusGatewayTimeout, context.DeadlineExceeded))
+	assert.Equal(t, codeUnavailable, errorCode(http.StatusServiceUnavailable, context.Canceled))
+	assert.Equal(t, codeNameNotAllowed, errorCode(http.StatusForbidden, certsman.ErrNameNotAllowed))
+	assert.Equal(t, codeNotFound, errorCode(http.StatusNotFound, errors.New("gone")))
+	assert.Equal(t, codeInternal, errorCode(http.StatusInternalServerError, errors.New("disk on fire")))
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// Formats certificates can be served in, chosen with ?format= or the Accept header
+const (
+	// The certificate and its chain as text/plain, which is what clients which don't choose get
+	formatText = "text"
+	// The PEM encoded certificate on its own
+	formatPEM = "pem"
+	// The PEM encoded certificate followed by its chain
+	formatChain = "chain"
+	// The DER encoded certificate on its own
+	formatDER = "der"
+	// The certificate, its chain and its private key in a password-protected PKCS#12 bundle
+	formatPKCS12 = "pkcs12"
+	// The certificate and its chain along with what is known about it, as JSON
+	formatJSON = "json"
+)
+
+// Content type of each format, which is also what it is chosen by in the Accept header
+var formatContentTypes = map[string]string{
+	formatText:   "text/plain",
+	formatPEM:    "application/x-pem-file",
+	formatChain:  "application/pem-certificate-chain",
+	formatDER:    "application/pkix-cert",
+	formatPKCS12: "application/x-pkcs12",
+	formatJSON:   "application/json",
+}
+
+// Header the password PKCS#12 bundles are encrypted with is sent in
+const pkcs12PasswordHeader = "X-PKCS12-Password"
+
+// errUnknownFormat is returned when ?format= isn't one of the formats
+var errUnknownFormat = errors.New("unknown format")
+
+// errFormatNotAcceptable is returned when the Accept header doesn't allow any of the formats
+var errFormatNotAcceptable = errors.New("none of the accepted content types can be served")
+
+// certificateDocument is the JSON format of a certificate
+type certificateDocument struct {
+	RequestID string `json:"requestId"`
+	Hostname  string `json:"hostname"`
+	certs.CertificateInfo
+	Certificate string `json:"certificate"`
+	Chain       string `json:"chain,omitempty"`
+	WasCreated  bool   `json:"wasCreated"`
+	WasCached   bool   `json:"wasCached"`
+}
+
+// requestedFormat returns the format a certificate is requested in.  ?format= takes precedence over the Accept header,
+// whose content types are tried from the most to the least preferred.  Clients which accept anything, or don't say,
+// get formatText.
+func requestedFormat(r *http.Request) (string, error) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if format == "p12" || format == "pfx" {
+			format = formatPKCS12
+		}
+		if _, ok := formatContentTypes[format]; !ok {
+			return "", fmt.Errorf("%w %q, expected one of %s", errUnknownFormat, format, strings.Join(formatNames(), ", "))
+		}
+		return format, nil
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formatText, nil
+	}
+
+	for _, contentType := range acceptedContentTypes(accept) {
+		switch contentType {
+		case "*/*", "text/*":
+			return formatText, nil
+		}
+		for format, formatType := range formatContentTypes {
+			if contentType == formatType {
+				return format, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("%w, expected one of %s", errFormatNotAcceptable, strings.Join(formatTypes(), ", "))
+}
+
+// acceptedContentTypes returns the content types in an Accept header, from the most to the least preferred.  Those
+// with a quality of 0 aren't accepted, so they are left out.
+func acceptedContentTypes(accept string) []string {
+	type accepted struct {
+		contentType string
+		quality     float64
+	}
+
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		contentType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			types = append(types, accepted{contentType, quality})
+		}
+	}
+
+	sort.SliceStable(types, func(i, j int) bool {
+		return types[i].quality > types[j].quality
+	})
+
+	contentTypes := make([]string, len(types))
+	for i, t := range types {
+		contentTypes[i] = t.contentType
+	}
+	return contentTypes
+}
+
+// formatErrorStatus is the status for a format which couldn't be used: a 406 if the Accept header rules every format
+// out, otherwise a 400
+func formatErrorStatus(err error) int {
+	if errors.Is(err, errFormatNotAcceptable) {
+		return http.StatusNotAcceptable
+	}
+	return http.StatusBadRequest
+}
+
+// checkFormatAccess checks the request can have the certificate in the format, writing the error to the client and
+// returning false if it can't.  PKCS#12 bundles include the private key, so they need HTTPS and a key access token the
+// same as certificateKeyGetHandler, and a password to encrypt them with.
+func checkFormatAccess(w http.ResponseWriter, r *http.Request, format string) bool {
+	if format != formatPKCS12 {
+		return true
+	}
+
+	if !checkKeyAccess(w, r) {
+		return false
+	}
+	if r.Header.Get(pkcs12PasswordHeader) == "" {
+		http.Error(w, "A password to encrypt the PKCS#12 bundle with is required in the "+pkcs12PasswordHeader+" header", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// writeCertificate writes the certificate out in the format
+func writeCertificate(w http.ResponseWriter, r *http.Request, format string, resp certsman.CertificateResponse) {
+	cert := resp.Certificate
+
+	var body []byte
+	var err error
+
+	switch format {
+	case formatPEM:
+		body = []byte(cert.CertificateBody)
+	case formatDER:
+		body, err = certs.EncodeDER(cert)
+	case formatPKCS12:
+		body, err = certs.EncodePKCS12(cert, r.Header.Get(pkcs12PasswordHeader))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": cert.Hostname + ".p12"}))
+	case formatJSON:
+		body, err = json.Marshal(newCertificateDocument(resp))
+	default:
+		// Serve the chain alongside the certificate so clients can build a path to the root.  The private key is
+		// left out, as it is only served to authenticated clients.
+		body = []byte(cert.CertificateBody + cert.CertificateChain)
+	}
+
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		switch {
+		case errors.Is(err, certs.ErrNotX509Certificate):
+			http.Error(w, "The certificate can't be served as "+format+": "+err.Error(), http.StatusNotAcceptable)
+		case errors.Is(err, certs.ErrNoPrivateKey):
+			http.Error(w, "The certificate's private key isn't held by certsman", http.StatusNotFound)
+		default:
+			apiErr := newAPIError(requestID(r), http.StatusInternalServerError, err)
+			http.Error(w, apiErr.Message, apiErr.Status)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
+
+// newCertificateDocument describes the certificate in a response, for the JSON format
+func newCertificateDocument(resp certsman.CertificateResponse) certificateDocument {
+	return certificateDocument{
+		RequestID:       resp.RequestID,
+		Hostname:        resp.Certificate.Hostname,
+		CertificateInfo: certs.DescribeCertificate(resp.Certificate),
+		Certificate:     resp.Certificate.CertificateBody,
+		Chain:           resp.Certificate.CertificateChain,
+		WasCreated:      resp.WasCreated,
+		WasCached:       resp.WasCached,
+	}
+}
+
+// formatNames lists every format, sorted
+func formatNames() []string {
+	var names []string
+	for format := range formatContentTypes {
+		names = append(names, format)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatTypes lists the content type of every format, sorted
+func formatTypes() []string {
+	var types []string
+	for _, contentType := range formatContentTypes {
+		types = append(types, contentType)
+	}
+	sort.Strings(types)
+	return types
+}
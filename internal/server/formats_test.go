@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/stretchr/testify/assert"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestRequestedFormat(t *testing.T) {
+	tests := []struct {
+		query  string
+		accept string
+		format string
+		status int
+	}{
+		{"", "", formatText, 0},
+		{"?format=DER", "application/json", formatDER, 0},
+		{"?format=p12", "", formatPKCS12, 0},
+		{"?format=yaml", "", "", http.StatusBadRequest},
+		{"", "application/json", formatJSON, 0},
+		{"", "application/pem-certificate-chain", formatChain, 0},
+		{"", "application/x-pem-file;q=0.5, application/pkix-cert", formatDER, 0},
+		{"", "application/json;q=0, application/x-pem-file;q=0.1", formatPEM, 0},
+		{"", "text/html, application/xhtml+xml, */*;q=0.8", formatText, 0},
+		{"", "image/png", "", http.StatusNotAcceptable},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/cert/fooyork.com"+test.query, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+
+		format, err := requestedFormat(r)
+		if test.status != 0 {
+			assert.NotNil(t, err, "%s %s should be refused", test.query, test.accept)
+			assert.Equal(t, test.status, formatErrorStatus(err), "%s %s", test.query, test.accept)
+			continue
+		}
+		assert.Nil(t, err, "%s %s", test.query, test.accept)
+		assert.Equal(t, test.format, format, "%s %s", test.query, test.accept)
+	}
+}
+
+func TestCertificateGetHandlerFormats(t *testing.T) {
+	setUpTestServer(t)
+	keyAccessTokens = []string{"0123456789abcdef"}
+
+	text := serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", nil)
+	assert.Equal(t, "text/plain", text.Header().Get("Content-Type"), "Clients which don't choose should get what they always have")
+	chain := serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=chain", "", nil)
+	assert.Equal(t, "application/pem-certificate-chain", chain.Header().Get("Content-Type"))
+	assert.Equal(t, text.Body.String(), chain.Body.String())
+
+	leafPEM := serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=pem", "", nil)
+	block, rest := pem.Decode(leafPEM.Body.Bytes())
+	assert.Equal(t, "CERTIFICATE", block.Type)
+	assert.Empty(t, rest, "Only the certificate should be served")
+
+	der := serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", map[string]string{"Accept": "application/pkix-cert"})
+	assert.Equal(t, http.StatusOK, der.Code)
+	assert.Equal(t, "application/pkix-cert", der.Header().Get("Content-Type"))
+	assert.Equal(t, block.Bytes, der.Body.Bytes())
+
+	w := serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=json", "", nil)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	doc := decodeJSON(t, w)
+	assert.Equal(t, "fooyork.com", doc["hostname"])
+	assert.Equal(t, []interface{}{"fooyork.com"}, doc["names"])
+	assert.NotEmpty(t, doc["serialNumber"])
+	assert.NotEmpty(t, doc["issuer"])
+	assert.NotEmpty(t, doc["notAfter"])
+	assert.Contains(t, doc["fingerprints"], "sha256")
+	assert.Contains(t, doc, "wasCreated")
+	assert.Contains(t, doc, "wasCached")
+	assert.NotContains(t, w.Body.String(), "PRIVATE KEY", "The JSON shouldn't include the key")
+
+	assert.Equal(t, http.StatusUnauthorized, serveTestRequest(http.MethodGet, "https://certsman.test/cert/fooyork.com?format=pkcs12", "", map[string]string{pkcs12PasswordHeader: "hunter2"}).Code,
+		"A PKCS#12 bundle holds the private key, so it needs a token")
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodGet, "https://certsman.test/cert/fooyork.com?format=pkcs12", "", map[string]string{"Authorization": "Bearer 0123456789abcdef"}).Code,
+		"A PKCS#12 bundle needs a password")
+
+	w = serveTestRequest(http.MethodGet, "https://certsman.test/cert/fooyork.com?format=pkcs12", "", map[string]string{"Authorization": "Bearer 0123456789abcdef", pkcs12PasswordHeader: "hunter2"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-pkcs12", w.Header().Get("Content-Type"))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	_, leaf, _, err := pkcs12.DecodeChain(w.Body.Bytes(), "hunter2")
+	assert.Nil(t, err, "The bundle should decode with the password")
+	assert.Equal(t, block.Bytes, leaf.Raw)
+
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=pkcs12", "", map[string]string{"Authorization": "Bearer 0123456789abcdef", pkcs12PasswordHeader: "hunter2"}).Code,
+		"A PKCS#12 bundle shouldn't be served over plain HTTP")
+
+	assert.Equal(t, http.StatusNotAcceptable, serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", map[string]string{"Accept": "image/png"}).Code)
+
+	certService.Issuer = certs.StringCertIssuer{}
+	assert.Equal(t, http.StatusNotAcceptable, serveTestRequest(http.MethodGet, "/cert/barlondon.com?format=der", "", nil).Code, "Certificates which aren't X.509 have no DER encoding")
+	w = serveTestRequest(http.MethodGet, "/cert/barlondon.com?format=json", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code, "Every certificate can be described")
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// The bearer tokens which may fetch private keys.  Fetching them is turned off when there are none.
+var keyAccessTokens []string
+
+// certificateKeyGetHandler serves the private key of the certificate for the hostname, followed by the certificate and
+// its chain so that the key can't be paired with a certificate which has since been renewed.  It takes the same ?san=
+// and ?alg= as GET /cert/{hostname}, and needs one of the key access tokens as a bearer token over HTTPS.
+func certificateKeyGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkKeyAccess(w, r) {
+		return
+	}
+
+	resp, apiErr := getOrCreateCertificate(r, requestedNames(r), r.URL.Query().Get("alg"))
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	if resp.Certificate.PrivateKey == "" {
+		http.Error(w, "The certificate's private key isn't held by certsman", http.StatusNotFound)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID":  resp.RequestID,
+		"Hostname":   resp.Certificate.Hostname,
+		"RemoteAddr": r.RemoteAddr,
+	}).Info("Served certificate private key")
+
+	w.Header().Set("Content-Type", "text/plain")
+	// The key mustn't be kept by any cache between certsman and the client
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(resp.StatusCode)
+	w.Write([]byte(resp.Certificate.PrivateKey + resp.Certificate.CertificateBody + resp.Certificate.CertificateChain))
+}
+
+// checkKeyAccess checks the request may be served a private key, writing the error to the client and returning false if
+// it can't.  Keys are only served over HTTPS, so neither the token nor the key is ever sent in the clear.
+func checkKeyAccess(w http.ResponseWriter, r *http.Request) bool {
+	if r.TLS == nil {
+		log.WithFields(log.Fields{
+			"Hostname":   mux.Vars(r)["hostname"],
+			"RemoteAddr": r.RemoteAddr,
+		}).Warn("Refused private key request over plain HTTP")
+
+		http.Error(w, "Private keys are only served over HTTPS", http.StatusForbidden)
+		return false
+	}
+	if !keyAccessAuthorized(r) {
+		refuseKeyAccess(w, r)
+		return false
+	}
+	return true
+}
+
+// refuseKeyAccess turns away a request for a private key which doesn't carry a valid key access token
+func refuseKeyAccess(w http.ResponseWriter, r *http.Request) {
+	log.WithFields(log.Fields{
+		"Hostname":   mux.Vars(r)["hostname"],
+		"RemoteAddr": r.RemoteAddr,
+	}).Warn("Refused private key request without a valid token")
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="certsman"`)
+	http.Error(w, "A valid bearer token is required to fetch private keys", http.StatusUnauthorized)
+}
+
+// keyAccessAuthorized reports whether the request carries one of the key access tokens.  Every token is compared in
+// constant time, so how long the check takes doesn't give away how much of a token was right.
+func keyAccessAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+
+	authorized := false
+	for _, allowed := range keyAccessTokens {
+		if allowed != "" && subtle.ConstantTimeCompare(token, []byte(allowed)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
@@ -2,16 +2,26 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"time"
 
+	"github.com/devnulled/certsman/internal/config"
+	"github.com/devnulled/certsman/pkg/acme"
+	"github.com/devnulled/certsman/pkg/ca"
 	"github.com/devnulled/certsman/pkg/certs"
 	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/renewal"
 	"github.com/devnulled/certsman/pkg/storage"
 
 	"github.com/bluele/gcache"
@@ -20,121 +30,149 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// Default hostname.  Should be refactored to be config driven or resolve on its own
-const MyHostname = "localhost"
+// The settings the server was started with
+var serverConfig config.Config
 
-// Default key length for the TokenCerts that get generated
-const DefaultTokenCertKeyLength = 1024
+// Largest body accepted by POST /cert and POST /cert/{hostname}
+const maxRequestBytes = 64 * 1024
 
-// Default expiration for certificates
-const DefaultCertDurationMinutes = 10
+// errKeyAlgorithmNotAllowed is returned when a request chooses a key algorithm the config doesn't allow
+var errKeyAlgorithmNotAllowed = errors.New("key algorithm is not allowed")
 
-// Maximum amount of certificates that get stored using the in-memory persistence
-const InMemoryCertStorageLimit = 20000
+// The names certificates can be requested for with a CSR, or alongside a hostname
+var namePolicy certsman.NamePolicy
 
-// How long the server waits for connections to drain before doing a graceful shutdown
-const DefaultServerGracefulTimeoutSeconds = 15
-
-// Default address for the HTTP server to listen on
-const DefaultServerAddress = "0.0.0.0:8080"
+// Memory cache store
+var memoryCache gcache.Cache
 
-// Default name for the cert to self-generate
-const DefaultCertServerName = "secure.certsman-server.com"
+// The persistence selected by the config
+var certPersistence certsman.CertificatePersistenceProvider
 
-// Default amount of time to sleep as specified by the requirements
-const DefaultArtificalSleepSeconds = 10
+// The issuer selected by the config
+var certIssuer certsman.CertificateIssuer
 
-// Default string to use for the string cert issuer
-const DefaultStringCertPrefix = "foo-"
+// The cert service that that is compromised of the previous two impls
+var certService *certsman.CerfificateService
 
-// How long to wait before shutting the server down to let connections drain
-var wait = time.Second * DefaultServerGracefulTimeoutSeconds
+// The CA which signs the server's own cert, and any x509 certs
+var certAuthority *ca.Authority
 
-// Memory cache store
-var memoryCache gcache.Cache
+// The cert service which issues the X.509 cert the server uses for its own HTTPS listener
+var selfCertService *certsman.CerfificateService
 
-// InMemory persistence
-var inMemPersist storage.InMemStorage
+// Keeps the server's own cert renewed ahead of its expiry
+var renewalScheduler *renewal.Scheduler
 
-// The cert service which generates string based certificates
-var stringCertIssuer certs.StringCertIssuer
+// Serves the ACME API, when enabled
+var acmeServer *acme.Server
 
-// The cert service that that is compromised of the previous two impls
-var stringCertService certsman.CerfificateService
+// Answers the upstream CA's http-01 challenges, when the acme issuer is selected
+var acmeHTTP01Solver *certs.HTTP01Solver
 
-// RunServer starts and runs the server
-func RunServer() {
+// RunServer starts and runs the server with the given config
+func RunServer(cfg config.Config) {
+	serverConfig = cfg
 
-	log.SetLevel(log.InfoLevel)
+	level, _ := log.ParseLevel(cfg.LogLevel)
+	log.SetLevel(level)
 	log.Info("certsman starting...")
 
-	// Create a channel to communicate the expired cache items
-	// expireChannel := make(chan string)
+	var err error
+	certAuthority, err = ca.LoadOrCreate(ca.Config{Dir: cfg.CA.Dir})
+	if err != nil {
+		log.Fatal("Unable to load or create the certificate authority: ", err)
+	}
 
-	memoryCache = gcache.New(InMemoryCertStorageLimit).
-		ARC().
-		EvictedFunc(func(key, value interface{}) {
-			// The cache seems to be lazy expired
-			// IE, only gets expunged when accessed OR
-			// if the collection capacity is reached during
-			// an addition.
-			//
-			// Trying to use this to expire the cache only
-			// creates a race condition
-			log.WithFields(log.Fields{
-				"Hostname": fmt.Sprint(key),
-			}).Debug("Certificate expired from cache")
+	certPersistence, err = newPersistence(cfg)
+	if err != nil {
+		log.Fatal("Unable to set up persistence: ", err)
+	}
 
-			// expireChannel <- fmt.Sprint(key)
-		}).
-		//Expiration(time.Second * 20).
-		Expiration(time.Minute * DefaultCertDurationMinutes).
-		Build()
+	certIssuer, acmeHTTP01Solver, err = newIssuer(cfg, certAuthority)
+	if err != nil {
+		log.Fatal("Unable to set up the issuer: ", err)
+	}
 
-	// Process expired cache keys and renew our own cert if it gets evicted
-	// go cacheExpirationHandler(expireChannel)
+	certService = newCertService(cfg, certIssuer, certPersistence)
 
-	inMemPersist = storage.InMemStorage{Cache: memoryCache}
+	namePolicy = certsman.NamePolicy{
+		AllowedDomains:   cfg.Policy.AllowedDomains,
+		AllowIPAddresses: cfg.Policy.AllowIPAddresses,
+		AllowWildcards:   cfg.Policy.AllowWildcards,
+		MaxNames:         cfg.Policy.MaxNames,
+	}
 
-	stringCertIssuer = certs.StringCertIssuer{
-		StringPrefix:      DefaultStringCertPrefix,
-		SleepEnabled:      true,
-		SleepyTimeSeconds: DefaultArtificalSleepSeconds}
+	keyAccessTokens = cfg.KeyAccess.Tokens
 
-	stringCertService = certsman.CerfificateService{
-		Issuer:      stringCertIssuer,
-		Persistence: inMemPersist,
+	selfCertService = &certsman.CerfificateService{
+		Issuer: certs.X509CertIssuer{
+			Signer:   certAuthority,
+			Validity: certValidity(cfg),
+		},
+		Persistence: &storage.InMemStorage{Cache: gcache.New(1).Build()},
 	}
 
 	log.Info("Generating initial server cert")
 	// In theory, this request should block as the server needs its own cert to startup successfully
 	selfCertIssuer()
 
-	log.Info("Starting timed task to refresh server cert in background")
-	go selfCertIssueTimer()
+	// Every request's context derives from this one, so that shutting down cancels in-flight issuance
+	serverCtx, cancelRequests := context.WithCancel(context.Background())
 
-	log.Info("Starting up certsman server at ", DefaultServerAddress)
+	log.Info("Starting renewal scheduler to keep the server cert up to date in background")
+	jitterFraction := cfg.Renewal.JitterFraction
+	if jitterFraction == 0 {
+		// The scheduler takes zero to mean its default, and a negative fraction to mean no jitter
+		jitterFraction = -1
+	}
+	renewalScheduler = renewal.NewScheduler(selfCertService, renewal.Config{
+		RenewBeforeFraction: cfg.Renewal.RenewBeforeFraction,
+		JitterFraction:      jitterFraction,
+	})
+	renewalScheduler.Manage(cfg.CertServerName)
+	go renewalScheduler.Run(serverCtx)
+
+	if cfg.ACME.Enabled {
+		acmeServer = newACMEServer(cfg, certAuthority, acmeValidators(cfg))
+		log.Info("Serving the ACME API at ", acme.DefaultPathPrefix, "/directory")
+	}
 
 	// Start our HTTP router/handler
-	r := mux.NewRouter()
-	r.HandleFunc("/cert/{hostname}", certificateGetHandler).Methods("GET")
-	r.HandleFunc("/certtest/", certTestGetHandler).Methods("GET")
+	r := newRouter()
 
-	srv := &http.Server{
-		Addr: DefaultServerAddress,
-		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
-		Handler:      r, // Pass our instance of gorilla/mux in.
-	}
+	var servers []*http.Server
 
-	// Run our server in a goroutine so that it doesn't block.
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Println(err)
+	if cfg.HTTPS.Enabled {
+		tlsSrv := newHTTPServer(serverCtx, cfg.HTTPS.Address, r)
+		tlsSrv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			// Pulled on every handshake, so a renewed server cert is used without a restart
+			GetCertificate: getSelfCertificate,
 		}
-	}()
+		servers = append(servers, tlsSrv)
+
+		log.Info("Starting up certsman HTTPS server at ", cfg.HTTPS.Address)
+
+		// Run our server in a goroutine so that it doesn't block.
+		go func() {
+			if err := tlsSrv.ListenAndServeTLS("", ""); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	if cfg.HTTP.Enabled {
+		srv := newHTTPServer(serverCtx, cfg.HTTP.Address, r)
+		servers = append(servers, srv)
+
+		log.Info("Starting up certsman server at ", cfg.HTTP.Address)
+
+		go func() {
+			if err := srv.ListenAndServe(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
@@ -144,12 +182,17 @@ func RunServer() {
 	// Block until we receive our signal.
 	<-c
 	log.Info("certsman stopping...")
+	// Anything still issuing or renewing a certificate gets cancelled rather than holding up the shutdown
+	cancelRequests()
 	// Create a deadline to wait for.
+	wait := time.Second * time.Duration(cfg.GracefulTimeoutSeconds)
 	ctx, cancel := context.WithTimeout(context.Background(), wait)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
-	srv.Shutdown(ctx)
+	for _, srv := range servers {
+		srv.Shutdown(ctx)
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
@@ -157,12 +200,45 @@ func RunServer() {
 	os.Exit(0)
 }
 
-func cacheExpirationHandler(hostnames chan string) {
-	hostname := <-hostnames
+// newRouter routes every endpoint the server serves.  Every response carries the ID of its request in X-Request-ID.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
+
+	r.HandleFunc("/cert/{hostname}", certificateGetHandler).Methods("GET")
+	r.HandleFunc("/cert/{hostname}", certificateHostnamePostHandler).Methods("POST")
+	r.HandleFunc("/cert", certificatePostHandler).Methods("POST")
+	if len(keyAccessTokens) > 0 {
+		r.HandleFunc("/cert/{hostname}/key", certificateKeyGetHandler).Methods("GET")
+	}
+	r.HandleFunc("/certtest/", certTestGetHandler).Methods("GET")
+
+	r.HandleFunc("/v1/certificates/{hostname}", v1CertificateGetHandler).Methods("GET")
+	r.HandleFunc("/v1/certificates/{hostname}", v1CertificatePostHandler).Methods("POST")
+
+	if acmeHTTP01Solver != nil {
+		r.PathPrefix(certs.ACMEHTTP01Path).Handler(acmeHTTP01Solver).Methods("GET")
+	}
+
+	if acmeServer != nil {
+		acmeServer.RegisterRoutes(r)
+	}
 
-	if hostname == DefaultCertServerName {
-		log.Info("Server cert expired from cache. Refreshing.")
-		go selfCertIssuer()
+	return r
+}
+
+// newHTTPServer creates an http.Server whose requests all derive their context from serverCtx
+func newHTTPServer(serverCtx context.Context, addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr: addr,
+		BaseContext: func(net.Listener) context.Context {
+			return serverCtx
+		},
+		// Good practice to set timeouts to avoid Slowloris attacks.
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      handler, // Pass our instance of gorilla/mux in.
 	}
 }
 
@@ -184,44 +260,210 @@ func randomString(n int) string {
 	return string(b)
 }
 
-// certificateGetHandler is the main HTTP handler for certificate requests
+// certificateGetHandler is the main HTTP handler for certificate requests.  Further names can be requested with ?san=,
+// and the algorithm of the certificate's key with ?alg=.
 func certificateGetHandler(w http.ResponseWriter, r *http.Request) {
+	serveCertificate(w, r, requestedNames(r), r.URL.Query().Get("alg"))
+}
 
+// certificateBody is the optional JSON body of POST /cert/{hostname}
+type certificateBody struct {
+	// Further names the certificate is for
+	Names []string `json:"names"`
+	// Algorithm of the certificate's key, one of certsman.KeyAlgorithms
+	KeyAlgorithm string `json:"keyAlgorithm"`
+}
+
+// certificateHostnamePostHandler is GET /cert/{hostname} for clients which would rather choose the certificate's
+// names and key algorithm in a JSON body than in the query
+func certificateHostnamePostHandler(w http.ResponseWriter, r *http.Request) {
+	var body certificateBody
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&body)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.KeyAlgorithm == "" {
+		body.KeyAlgorithm = r.URL.Query().Get("alg")
+	}
+
+	serveCertificate(w, r, append(requestedNames(r), body.Names...), body.KeyAlgorithm)
+}
+
+// serveCertificate gets or creates the certificate for the hostname in the path, along with any further names, and
+// writes it out in the requested format
+func serveCertificate(w http.ResponseWriter, r *http.Request, names []string, keyAlgorithm string) {
+	format, err := requestedFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), formatErrorStatus(err))
+		return
+	}
+	if !checkFormatAccess(w, r, format) {
+		return
+	}
+
+	resp, apiErr := getOrCreateCertificate(r, names, keyAlgorithm)
+	if apiErr != nil {
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	writeCertificate(w, r, format, resp)
+}
+
+// getOrCreateCertificate gets or creates the certificate for the hostname in the path, along with any further names
+func getOrCreateCertificate(r *http.Request, names []string, keyAlgorithm string) (certsman.CertificateResponse, *apiError) {
 	vars := mux.Vars(r)
 	initHostname := vars["hostname"]
 
+	reqID := requestID(r)
+
 	if len(initHostname) <= 1 {
-		http.Error(w, "Invalid hostname provided", http.StatusNotAcceptable)
-		return
+		return certsman.CertificateResponse{}, &apiError{Status: http.StatusNotAcceptable, Code: codeInvalidHostname, Message: "Invalid hostname provided", RequestID: reqID}
 	}
 
 	hostname := strings.ToLower(initHostname)
 
-	reqID := requestIDGenerator()
+	keyAlgorithm, err := requestedKeyAlgorithm(keyAlgorithm)
+	if err != nil {
+		return certsman.CertificateResponse{}, newAPIError(reqID, keyAlgorithmErrorStatus(err), err)
+	}
 
 	req := certsman.CertificateRequest{
-		RequestID: reqID,
-		Hostname:  hostname,
+		RequestID:    reqID,
+		Hostname:     hostname,
+		Names:        names,
+		KeyAlgorithm: keyAlgorithm,
+	}
+
+	if err := namePolicy.CheckNames(req.SubjectNames()); err != nil {
+		return certsman.CertificateResponse{}, newAPIError(reqID, nameErrorStatus(err), err)
 	}
 
 	log.WithFields(log.Fields{
 		"RequestID": reqID,
 		"Hostname":  hostname,
+		"Key":       keyAlgorithm,
 	}).Trace("Certificate request recieved")
 
-	resp := stringCertService.GetOrCreateCertificate(req)
+	// The request context is cancelled if the client disconnects or the server shuts down
+	resp := certService.GetOrCreateCertificateContext(r.Context(), req)
 
 	if !resp.IsSuccess {
-		http.Error(w, resp.Error.Error(), resp.StatusCode)
+		return resp, newAPIError(reqID, resp.StatusCode, resp.Error)
+	}
+
+	return resp, nil
+}
+
+// requestedNames returns the further names a certificate is requested for with ?san=, which can be repeated or
+// hold a comma-separated list
+func requestedNames(r *http.Request) []string {
+	var names []string
+	for _, value := range r.URL.Query()["san"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// requestedKeyAlgorithm checks a requested key algorithm is allowed.  Asking for the default algorithm is the same as
+// not asking for one, so those requests share the certificates stored for requests which don't choose.
+func requestedKeyAlgorithm(alg string) (string, error) {
+	alg = strings.ToLower(strings.TrimSpace(alg))
+	if alg == "" || alg == serverConfig.Issuer.KeyAlgorithm {
+		return "", nil
+	}
+
+	if !certsman.ValidKeyAlgorithm(alg) {
+		return "", fmt.Errorf("%w %q, expected one of %s", certsman.ErrUnknownKeyAlgorithm, alg, strings.Join(certsman.KeyAlgorithms, ", "))
+	}
+	if !serverConfig.KeyAlgorithmAllowed(alg) {
+		return "", fmt.Errorf("%w: %s", errKeyAlgorithmNotAllowed, alg)
+	}
+
+	return alg, nil
+}
+
+// keyAlgorithmErrorStatus is the status for a key algorithm which couldn't be used: a 403 if the config doesn't allow
+// it, otherwise a 400
+func keyAlgorithmErrorStatus(err error) int {
+	if errors.Is(err, errKeyAlgorithmNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// nameErrorStatus is the status for a CSR or names which couldn't be used: a 403 if the policy doesn't allow them,
+// otherwise a 400
+func nameErrorStatus(err error) int {
+	if errors.Is(err, certsman.ErrNameNotAllowed) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// certificatePostHandler issues a certificate for the PKCS#10 CSR in the request body, which may be PEM or DER encoded.
+// The certificate is for the CSR's key, so it isn't stored or shared with anyone else requesting the same names.
+func certificatePostHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := requestedFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), formatErrorStatus(err))
+		return
+	}
+	if format == formatPKCS12 {
+		http.Error(w, "A PKCS#12 bundle needs the private key, which stays with the CSR's requester", http.StatusNotAcceptable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, "CSR is too large", http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	respBody := []byte(resp.Certificate.CertificateBody)
+	reqID := requestID(r)
+
+	csr, err := certsman.ParseCSR(body)
+	if err == nil {
+		err = namePolicy.CheckCSR(csr)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"RequestID": reqID,
+		}).Debug("Rejected CSR: ", err)
+
+		http.Error(w, err.Error(), nameErrorStatus(err))
+		return
+	}
+
+	// The first name requested stands in for the CSR's names wherever a single hostname is expected
+	hostname := strings.ToLower(certsman.CSRNames(csr)[0])
+
+	req := certsman.CertificateRequest{
+		RequestID: reqID,
+		Hostname:  hostname,
+		CSR:       csr,
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": reqID,
+		"Hostname":  hostname,
+	}).Trace("CSR recieved")
+
+	resp := certService.IssueCertificateContext(r.Context(), req)
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(respBody)
-	return
+	if !resp.IsSuccess {
+		apiErr := newAPIError(reqID, resp.StatusCode, resp.Error)
+		http.Error(w, apiErr.Message, apiErr.Status)
+		return
+	}
+
+	writeCertificate(w, r, format, resp)
 }
 
 // requestIDGenerator generates RequestIds.  With more time, would use something like Zipkin.
@@ -238,28 +480,12 @@ func selfCertIssuer() {
 
 	req := certsman.CertificateRequest{
 		RequestID: reqID,
-		Hostname:  DefaultCertServerName,
+		Hostname:  serverConfig.CertServerName,
 	}
 
 	log.WithFields(log.Fields{
 		"RequestID": reqID,
-		"Hostname":  DefaultCertServerName,
+		"Hostname":  serverConfig.CertServerName,
 	}).Debug("Updating self-cert for server")
-	stringCertService.GetOrCreateCertificate(req)
-}
-
-// selfCertIssueTimer runs as a go routine every 5 seconds to refresh the servers own certificate.
-// I think this is a better solution than having it wakeup every 10 minutes because of drift.
-// Because it's own cert is cached for 10 minutes before its regenerated, the overhead of this call
-// every 5 seconds is very minimal.  I think this tradeoff is much better than going up to a whole 10
-// minutes without a certificate.
-// There is opportunity to come-up with a much more complex way to do this that would ensure that
-// a current certificate is always there, but I think it's beyond the scope of this exercise.
-func selfCertIssueTimer() {
-	tick := time.Tick(5 * time.Second)
-
-	for range tick {
-		log.Trace("Cert issuer timer is now refreshing the server certificate")
-		selfCertIssuer()
-	}
+	selfCertService.GetOrCreateCertificate(req)
 }
@@ -1,11 +1,182 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/internal/config"
+	"github.com/devnulled/certsman/pkg/ca"
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestThingssssss(t *testing.T) {
 	assert.Nil(t, nil, "This should be nil")
 }
+
+// serveTestRequest sends a request through the server's router
+func serveTestRequest(method string, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, bytes.NewReader([]byte(body)))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+// decodeJSON decodes a JSON response body
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc), "The body should be JSON: %s", w.Body.String())
+	return doc
+}
+
+// setUpTestServer points the server at an x509 issuer with in-memory persistence, with the default config, no name
+// policy and no key access tokens
+func setUpTestServer(t *testing.T) {
+	authority, err := ca.LoadOrCreate(ca.Config{})
+	assert.Nil(t, err)
+
+	serverConfig = config.Default()
+	certService = &certsman.CerfificateService{
+		Issuer:      certs.X509CertIssuer{Signer: authority, Validity: time.Hour},
+		Persistence: &storage.InMemStorage{Cache: gcache.New(10).Build()},
+	}
+	namePolicy = certsman.NamePolicy{}
+	keyAccessTokens = nil
+}
+
+// failingIssuer fails every request with an error which gives away details of the server
+type failingIssuer struct{}
+
+func (failingIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return certsman.Certificate{}, errors.New("open /var/lib/certsman/ca/intermediate.key: disk on fire")
+}
+
+// postCSR sends a CSR for the names to POST /cert, returning the key it is for
+func postCSR(t *testing.T, names ...string) (*httptest.ResponseRecorder, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	assert.Nil(t, err)
+
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return serveTestRequest(http.MethodPost, "/cert", string(body), nil), key
+}
+
+func TestCertificateGetHandlerNames(t *testing.T) {
+	setUpTestServer(t)
+	namePolicy = certsman.NamePolicy{AllowedDomains: []string{"fooyork.com"}, AllowWildcards: true}
+
+	w := serveTestRequest(http.MethodGet, "/cert/fooyork.com?san=www.fooyork.com&san=*.fooyork.com,api.fooyork.com", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	block, _ := pem.Decode(w.Body.Bytes())
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com", "*.fooyork.com", "api.fooyork.com"}, leaf.DNSNames)
+
+	again := serveTestRequest(http.MethodGet, "/cert/www.fooyork.com?san=api.fooyork.com,fooyork.com,*.fooyork.com", "", nil)
+	assert.Equal(t, w.Body.String(), again.Body.String(), "The same names should get the stored certificate")
+
+	single := serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", nil)
+	assert.NotEqual(t, w.Body.String(), single.Body.String(), "The hostname on its own should get its own certificate")
+
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/fooyork.com?san=barlondon.com", "", nil).Code, "Names outside the policy should be refused")
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/barlondon.com", "", nil).Code, "A single hostname outside the policy should be refused")
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/10.0.0.1", "", nil).Code, "A single IP address should only be issued when allowed")
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodGet, "/cert/fooyork.com?san=foo/york", "", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodGet, "/cert/fooyork.com%23ecdsa-p384", "", nil).Code, "Names should only be letters, digits and hyphens")
+
+	namePolicy.AllowWildcards = false
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/*.fooyork.com", "", nil).Code, "Wildcards should only be issued when allowed")
+}
+
+// leafOf parses the certificate at the start of a response
+func leafOf(t *testing.T, w *httptest.ResponseRecorder) *x509.Certificate {
+	block, _ := pem.Decode(w.Body.Bytes())
+	if !assert.NotNil(t, block, "The response should start with a certificate") {
+		t.FailNow()
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	return leaf
+}
+
+func TestCertificateKeyAlgorithms(t *testing.T) {
+	setUpTestServer(t)
+	serverConfig.Issuer.AllowedKeyAlgorithms = []string{"ecdsa-p256", "rsa2048", "ed25519"}
+
+	def := serveTestRequest(http.MethodGet, "/cert/fooyork.com", "", nil)
+	assert.Equal(t, http.StatusOK, def.Code)
+	assert.Equal(t, x509.ECDSA, leafOf(t, def).PublicKeyAlgorithm, "The default algorithm should be used when none is chosen")
+	assert.Equal(t, def.Body.String(), serveTestRequest(http.MethodGet, "/cert/fooyork.com?alg=ecdsa-p256", "", nil).Body.String(), "Choosing the default should share its certificate")
+
+	rsaCert := serveTestRequest(http.MethodGet, "/cert/fooyork.com?alg=RSA2048", "", nil)
+	assert.Equal(t, http.StatusOK, rsaCert.Code)
+	assert.Equal(t, 2048, leafOf(t, rsaCert).PublicKey.(*rsa.PublicKey).N.BitLen())
+	assert.Equal(t, rsaCert.Body.String(), serveTestRequest(http.MethodGet, "/cert/fooyork.com?alg=rsa2048", "", nil).Body.String(), "The stored RSA certificate should be returned")
+
+	edCert := serveTestRequest(http.MethodPost, "/cert/fooyork.com", `{"keyAlgorithm": "ed25519", "names": ["www.fooyork.com"]}`, nil)
+	assert.Equal(t, http.StatusOK, edCert.Code)
+	leaf := leafOf(t, edCert)
+	assert.Equal(t, x509.Ed25519, leaf.PublicKeyAlgorithm)
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com"}, leaf.DNSNames)
+
+	assert.Equal(t, rsaCert.Body.String(), serveTestRequest(http.MethodPost, "/cert/fooyork.com?alg=rsa2048", "", nil).Body.String(), "An empty body should fall back to the query")
+	assert.Equal(t, http.StatusForbidden, serveTestRequest(http.MethodGet, "/cert/fooyork.com?alg=rsa4096", "", nil).Code, "Algorithms left out of the allow-list should be refused")
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodGet, "/cert/fooyork.com?alg=dsa1024", "", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodPost, "/cert/fooyork.com", "{", nil).Code)
+
+	certService.Issuer = certs.StringCertIssuer{}
+	assert.Equal(t, http.StatusNotImplemented, serveTestRequest(http.MethodGet, "/cert/barlondon.com?alg=rsa2048", "", nil).Code, "Issuers which don't generate keys should say so")
+}
+
+func TestCertificatePostHandler(t *testing.T) {
+	setUpTestServer(t)
+	namePolicy = certsman.NamePolicy{AllowedDomains: []string{"fooyork.com"}}
+
+	w, key := postCSR(t, "fooyork.com", "www.fooyork.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	block, _ := pem.Decode(w.Body.Bytes())
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err, "The certificate should be returned")
+	assert.Equal(t, key.Public(), leaf.PublicKey, "The certificate should be for the CSR's key")
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com"}, leaf.DNSNames)
+
+	_, err = certService.Persistence.RetrieveCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "The certificate belongs to the requester, so it shouldn't be stored")
+
+	w, _ = postCSR(t, "barlondon.com")
+	assert.Equal(t, http.StatusForbidden, w.Code, "Names outside the policy should be refused")
+
+	assert.Equal(t, http.StatusBadRequest, serveTestRequest(http.MethodPost, "/cert", "not a csr", nil).Code)
+
+	certService.Issuer = certs.StringCertIssuer{}
+	w, _ = postCSR(t, "fooyork.com")
+	assert.Equal(t, http.StatusNotImplemented, w.Code, "Issuers which can't use a CSR should say so")
+
+	certService.Issuer = failingIssuer{}
+	w, _ = postCSR(t, "fooyork.com")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, internalErrorMessage+"\n", w.Body.String(), "What went wrong inside the server shouldn't be handed back")
+	assert.NotEmpty(t, w.Header().Get(requestIDHeader), "The request ID should be handed back to quote")
+}
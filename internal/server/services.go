@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/devnulled/certsman/internal/config"
+	"github.com/devnulled/certsman/pkg/acme"
+	"github.com/devnulled/certsman/pkg/ca"
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+
+	"github.com/bluele/gcache"
+	log "github.com/sirupsen/logrus"
+)
+
+// newCertService creates the service GET /cert/{hostname} and the other endpoints get and create certificates through.
+// Stored certificates are issued again once they are within the same fraction of their lifetime as the renewal
+// scheduler renews the server's own certificate at.
+func newCertService(cfg config.Config, issuer certsman.CertificateIssuer, persistence certsman.CertificatePersistenceProvider) *certsman.CerfificateService {
+	return &certsman.CerfificateService{
+		Issuer:        issuer,
+		Persistence:   persistence,
+		RenewalWindow: renewalWindow(cfg),
+	}
+}
+
+// newIssuer creates the issuer selected by name in the config, along with the solver which answers its http-01
+// challenges if it has one.  The HTTP server has to serve the solver for the challenges to be answered.
+func newIssuer(cfg config.Config, authority *ca.Authority) (certsman.CertificateIssuer, *certs.HTTP01Solver, error) {
+	switch cfg.Issuer.Name {
+	case config.IssuerString:
+		return certs.StringCertIssuer{
+			StringPrefix:      cfg.Issuer.StringPrefix,
+			SleepEnabled:      cfg.Issuer.SleepEnabled,
+			SleepyTimeSeconds: time.Duration(cfg.Issuer.SleepSeconds),
+			Validity:          certValidity(cfg),
+		}, nil, nil
+	case config.IssuerToken:
+		return certs.TokenCertIssuer{
+			KeyLength: cfg.Issuer.TokenKeyLength,
+			Validity:  certValidity(cfg),
+		}, nil, nil
+	case config.IssuerX509:
+		return certs.X509CertIssuer{
+			Signer:       authority,
+			Validity:     certValidity(cfg),
+			KeyAlgorithm: cfg.Issuer.KeyAlgorithm,
+		}, nil, nil
+	case config.IssuerACME:
+		return newACMEIssuer(cfg)
+	}
+
+	return nil, nil, fmt.Errorf("unknown issuer %q", cfg.Issuer.Name)
+}
+
+// newACMEIssuer creates the issuer which gets certificates from the upstream ACME CA, along with the solver which
+// answers its http-01 challenges
+func newACMEIssuer(cfg config.Config) (*certs.ACMEIssuer, *certs.HTTP01Solver, error) {
+	issuer := &certs.ACMEIssuer{
+		DirectoryURL: cfg.Issuer.ACMEDirectoryURL,
+		AgreeToTerms: cfg.Issuer.ACMEAgreeToTerms,
+		KeyAlgorithm: cfg.Issuer.KeyAlgorithm,
+	}
+
+	if cfg.Issuer.ACMEEmail != "" {
+		issuer.Contact = []string{"mailto:" + cfg.Issuer.ACMEEmail}
+	}
+
+	key, err := certs.LoadOrCreateACMEAccountKey(cfg.Issuer.ACMEAccountKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	issuer.AccountKey = key
+
+	solver := &certs.HTTP01Solver{}
+	issuer.Solvers = []certs.ACMESolver{solver}
+
+	return issuer, solver, nil
+}
+
+// newACMEServer creates the ACME server, which issues certificates through the cert service.  Whenever the CA rotates
+// to a new intermediate, which it does on its own as the old one nears expiry, clients are told to renew the certificates
+// the old one signed.
+func newACMEServer(cfg config.Config, authority *ca.Authority, validators map[string]acme.Validator) *acme.Server {
+	server := acme.NewServer(certService, &storage.InMemAccountStorage{}, acme.Config{
+		BaseURL:        cfg.ACME.BaseURL,
+		TermsOfService: cfg.ACME.TermsOfService,
+		CheckNames:     namePolicy.CheckNames,
+		Validators:     validators,
+	})
+
+	authority.OnRotate(func(ca.Intermediate) {
+		server.ForceEarlyRenewal(time.Now())
+	})
+
+	return server
+}
+
+// acmeValidators creates the validators for each type of challenge the ACME server offers
+func acmeValidators(cfg config.Config) map[string]acme.Validator {
+	return map[string]acme.Validator{
+		acme.ChallengeHTTP01:    &acme.HTTP01Validator{Port: cfg.ACME.HTTP01Port},
+		acme.ChallengeDNS01:     &acme.DNS01Validator{Server: cfg.ACME.DNSServer},
+		acme.ChallengeTLSALPN01: &acme.TLSALPN01Validator{Port: cfg.ACME.TLSALPN01Port},
+	}
+}
+
+// newPersistence creates the persistence selected by name in the config
+func newPersistence(cfg config.Config) (certsman.CertificatePersistenceProvider, error) {
+	switch cfg.Persistence.Name {
+	case config.PersistenceMemory:
+		memoryCache = gcache.New(cfg.Persistence.MemoryLimit).
+			ARC().
+			EvictedFunc(func(key, value interface{}) {
+				// The cache is lazy expired, IE, only gets expunged when accessed OR
+				// if the collection capacity is reached during an addition.  Renewal
+				// is handled by the renewal scheduler instead of relying on this.
+				log.WithFields(log.Fields{
+					"Hostname": fmt.Sprint(key),
+				}).Debug("Certificate expired from cache")
+			}).
+			// Entries are expired individually based on each certificate's NotAfter
+			Build()
+
+		return &storage.InMemStorage{Cache: memoryCache}, nil
+	case config.PersistenceFile:
+		return storage.NewFileStorage(cfg.Persistence.Dir)
+	}
+
+	return nil, fmt.Errorf("unknown persistence %q", cfg.Persistence.Name)
+}
+
+// certValidity is how long every issued certificate is valid for
+func certValidity(cfg config.Config) time.Duration {
+	return time.Minute * time.Duration(cfg.CertDurationMinutes)
+}
+
+// renewalWindow is how long before a certificate expires it is due for renewal
+func renewalWindow(cfg config.Config) time.Duration {
+	return time.Duration(float64(certValidity(cfg)) * cfg.Renewal.RenewBeforeFraction)
+}
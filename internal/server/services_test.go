@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/internal/config"
+	"github.com/devnulled/certsman/pkg/acme"
+	"github.com/devnulled/certsman/pkg/ca"
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// acceptAllChallenges is a validator which accepts every challenge
+var acceptAllChallenges = acme.ValidatorFunc(func(ctx context.Context, identifier acme.Identifier, token string, keyAuthorization string) error {
+	return nil
+})
+
+// renewalWindowStart fetches when the ACME server suggests renewing the certificate
+func renewalWindowStart(t *testing.T, srv *httptest.Server, cert certsman.Certificate) time.Time {
+	leaf, err := certs.ParseCertificatePEM([]byte(cert.CertificateBody))
+	assert.Nil(t, err)
+	id, err := acme.RenewalInfoCertID(leaf)
+	assert.Nil(t, err)
+
+	resp, err := http.Get(srv.URL + acme.DefaultPathPrefix + "/renewal-info/" + id)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var info struct {
+		SuggestedWindow struct {
+			Start time.Time `json:"start"`
+		} `json:"suggestedWindow"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&info))
+	return info.SuggestedWindow.Start
+}
+
+func TestACMERenewalForcedByIntermediateRotation(t *testing.T) {
+	// Every intermediate is already within RotateBefore of expiring, so every certificate signed rotates in a new one
+	authority, err := ca.LoadOrCreate(ca.Config{IntermediateValidity: time.Hour * 3, RotateBefore: time.Hour * 4})
+	assert.Nil(t, err)
+
+	setUpTestServer(t)
+	certService = &certsman.CerfificateService{
+		Issuer:      certs.X509CertIssuer{Signer: authority, Validity: time.Hour},
+		Persistence: &storage.InMemStorage{Cache: gcache.New(10).Build()},
+	}
+	acmeServer = newACMEServer(config.Default(), authority, map[string]acme.Validator{acme.ChallengeHTTP01: acceptAllChallenges})
+	defer func() { acmeServer = nil }()
+
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	client := &certs.ACMEIssuer{
+		DirectoryURL: srv.URL + acme.DefaultPathPrefix + "/directory",
+		Solvers:      []certs.ACMESolver{&certs.HTTP01Solver{}},
+		PollInterval: time.Millisecond * 10,
+	}
+	cert, err := client.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.Nil(t, err)
+	assert.True(t, renewalWindowStart(t, srv, cert).After(time.Now()), "A certificate signed by the active intermediate shouldn't be due yet")
+
+	// Signing any other certificate rotates the intermediate out from under the ACME one
+	w := serveTestRequest(http.MethodGet, "/cert/barlondon.com", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.False(t, renewalWindowStart(t, srv, cert).After(time.Now()), "A certificate signed by a rotated out intermediate should be due straight away")
+}
+
+func TestCertServiceRenewsWithinRenewalWindow(t *testing.T) {
+	setUpTestServer(t)
+	cfg := config.Default()
+	cfg.CertDurationMinutes = 60
+	cfg.Renewal.RenewBeforeFraction = 0.25
+
+	// Certificates only valid for 10 minutes are within the 15 minute renewal window as soon as they are issued
+	certService = newCertService(cfg, certs.StringCertIssuer{Validity: time.Minute * 10}, &storage.InMemStorage{Cache: gcache.New(10).Build()})
+	assert.Equal(t, time.Minute*15, certService.RenewalWindow)
+
+	serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=json", "", nil)
+	renewed := decodeJSON(t, serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=json", "", nil))
+	assert.Equal(t, true, renewed["wasCreated"], "A stored certificate within the renewal window should be issued again")
+
+	certService = newCertService(cfg, certs.StringCertIssuer{Validity: time.Hour}, &storage.InMemStorage{Cache: gcache.New(10).Build()})
+	serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=json", "", nil)
+	cached := decodeJSON(t, serveTestRequest(http.MethodGet, "/cert/fooyork.com?format=json", "", nil))
+	assert.Equal(t, true, cached["wasCached"], "A stored certificate outside the renewal window should be served")
+}
+
+func TestNewIssuerReturnsACMESolver(t *testing.T) {
+	cfg := config.Default()
+	_, solver, err := newIssuer(cfg, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, solver, "Only the acme issuer has challenges to answer")
+
+	cfg.Issuer.Name = config.IssuerACME
+	cfg.Issuer.ACMEDirectoryURL = "https://acme.fooyork.com/directory"
+	cfg.Issuer.ACMEAccountKeyFile = filepath.Join(t.TempDir(), "acme-account.key")
+	issuer, solver, err := newIssuer(cfg, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, solver)
+	assert.Equal(t, []certs.ACMESolver{solver}, issuer.(*certs.ACMEIssuer).Solvers, "The solver served should be the one the issuer uses")
+	assert.Nil(t, acmeHTTP01Solver, "Creating the issuer shouldn't change what the server serves")
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	log "github.com/sirupsen/logrus"
+)
+
+// selfCertificateCache holds the parsed form of the server's own cert, so that handshakes
+// only pay for parsing when the cert has actually been renewed
+type selfCertificateCache struct {
+	mu     sync.Mutex
+	body   string
+	parsed *tls.Certificate
+}
+
+// The parsed server cert used by the HTTPS listener
+var selfCertCache selfCertificateCache
+
+// getSelfCertificate is used as the HTTPS listener's tls.Config.GetCertificate.  It pulls the current server cert
+// from the CerfificateService on every handshake, so renewals take effect without restarting the listener.
+func getSelfCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reqID := requestIDGenerator()
+
+	req := certsman.CertificateRequest{
+		RequestID: reqID,
+		Hostname:  serverConfig.CertServerName,
+	}
+
+	resp := selfCertService.GetOrCreateCertificateContext(hello.Context(), req)
+
+	if !resp.IsSuccess {
+		log.WithFields(log.Fields{
+			"RequestID": reqID,
+			"Hostname":  serverConfig.CertServerName,
+		}).Error("Unable to get server cert for TLS handshake")
+		return nil, resp.Error
+	}
+
+	return selfCertCache.keyPair(resp.Certificate)
+}
+
+// keyPair returns the parsed certificate and key, only parsing them again if the cert has changed
+func (c *selfCertificateCache) keyPair(cert certsman.Certificate) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.parsed != nil && c.body == cert.CertificateBody {
+		return c.parsed, nil
+	}
+
+	if cert.PrivateKey == "" {
+		return nil, errors.New("server cert was issued without a private key")
+	}
+
+	keyPair, err := tls.X509KeyPair([]byte(cert.CertificateBody+cert.CertificateChain), []byte(cert.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"Hostname": cert.Hostname,
+		"NotAfter": cert.NotAfter,
+	}).Info("Loaded current server cert for HTTPS listener")
+
+	c.body = cert.CertificateBody
+	c.parsed = &keyPair
+	return c.parsed, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/internal/config"
+	"github.com/devnulled/certsman/pkg/ca"
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakeSerial connects to the TLS server and returns the serial of the cert it presented
+func handshakeSerial(t *testing.T, addr string, roots *x509.CertPool) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: serverConfig.CertServerName})
+	assert.Nil(t, err, "The handshake should succeed with the server cert")
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.String()
+}
+
+func TestGetSelfCertificateHotReload(t *testing.T) {
+	authority, err := ca.LoadOrCreate(ca.Config{})
+	assert.Nil(t, err)
+
+	serverConfig = config.Default()
+	selfCertService = &certsman.CerfificateService{
+		Issuer:      certs.X509CertIssuer{Signer: authority, Validity: time.Hour},
+		Persistence: &storage.InMemStorage{Cache: gcache.New(1).Build()},
+	}
+	selfCertCache = selfCertificateCache{}
+
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{GetCertificate: getSelfCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Root())
+
+	first := handshakeSerial(t, srv.Listener.Addr().String(), roots)
+	assert.Equal(t, first, handshakeSerial(t, srv.Listener.Addr().String(), roots), "The same cert should be served until it is renewed")
+
+	resp := selfCertService.RenewCertificateContext(context.Background(), certsman.CertificateRequest{Hostname: serverConfig.CertServerName})
+	assert.True(t, resp.IsSuccess)
+
+	renewed := handshakeSerial(t, srv.Listener.Addr().String(), roots)
+	assert.NotEqual(t, first, renewed, "New handshakes should use the renewed cert without a restart")
+}
@@ -0,0 +1,359 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// Most contacts an account can have
+const maxContacts = 10
+
+// How many times a change to an account is retried when another request changes it first
+const maxAccountUpdateAttempts = 3
+
+// accountRequest is the payload of newAccount and account update requests
+type accountRequest struct {
+	// Absent leaves the contacts unchanged on an update, whereas an empty list removes them
+	Contact              []string `json:"contact"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	Status               string   `json:"status"`
+}
+
+// keyChangeRequest is the payload of the inner JWS of a keyChange request, which is signed by the new key
+type keyChangeRequest struct {
+	Account string     `json:"account"`
+	OldKey  JSONWebKey `json:"oldKey"`
+}
+
+// accountResource is an account as it is returned to clients
+type accountResource struct {
+	Status               string   `json:"status"`
+	Contact              []string `json:"contact,omitempty"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed,omitempty"`
+	Orders               string   `json:"orders"`
+}
+
+// newAccountHandler registers the key a request is signed with as a new account, or finds the account it already belongs to
+func (s *Server) newAccountHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithJWK)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var payload accountRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, malformed("account request is not valid JSON"))
+		return
+	}
+
+	thumbprint, _ := req.header.JWK.Thumbprint()
+
+	existing, err := s.accounts.RetrieveAccountByKey(thumbprint)
+	if err == nil && existing.Status != certsman.AccountStatusValid {
+		writeProblem(w, unauthorized("account is %s", existing.Status))
+		return
+	}
+	if err == nil {
+		// Registering the same key again just finds its account
+		w.Header().Set("Location", s.url(r, pathAccount+existing.ID))
+		writeJSON(w, http.StatusOK, s.accountResource(r, existing))
+		return
+	}
+	if err != certsman.ErrAccountNotFound {
+		writeProblem(w, serverInternal("unable to look up account"))
+		return
+	}
+
+	if payload.OnlyReturnExisting {
+		writeProblem(w, newProblem(ErrorAccountDoesNotExist, http.StatusBadRequest, "no account exists for the key"))
+		return
+	}
+
+	if s.cfg.TermsOfService != "" && !payload.TermsOfServiceAgreed {
+		writeProblem(w, newProblem(ErrorUserActionRequired, http.StatusForbidden, "the terms of service at %s must be agreed to", s.cfg.TermsOfService))
+		return
+	}
+
+	if p := validateContacts(payload.Contact); p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	key, _ := json.Marshal(req.header.JWK)
+	acct := certsman.Account{
+		ID:                   uuid.NewV4().String(),
+		Status:               certsman.AccountStatusValid,
+		Contact:              payload.Contact,
+		TermsOfServiceAgreed: payload.TermsOfServiceAgreed,
+		Key:                  string(key),
+		KeyThumbprint:        thumbprint,
+		CreatedAt:            time.Now(),
+	}
+
+	if err := s.accounts.CreateAccount(acct); err != nil {
+		if err == certsman.ErrAccountKeyInUse {
+			// Lost a race with another registration of the same key
+			existing, err = s.accounts.RetrieveAccountByKey(thumbprint)
+			if err == nil {
+				w.Header().Set("Location", s.url(r, pathAccount+existing.ID))
+				writeJSON(w, http.StatusOK, s.accountResource(r, existing))
+				return
+			}
+		}
+		writeProblem(w, serverInternal("unable to store account"))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"AccountID": acct.ID,
+	}).Info("Registered ACME account")
+
+	w.Header().Set("Location", s.url(r, pathAccount+acct.ID))
+	writeJSON(w, http.StatusCreated, s.accountResource(r, acct))
+}
+
+// accountHandler returns an account, updates its contacts, or deactivates it
+func (s *Server) accountHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	if req.account.ID != mux.Vars(r)["id"] {
+		writeProblem(w, unauthorized("requests for an account must be signed by that account"))
+		return
+	}
+
+	// A POST-as-GET just fetches the account
+	if len(req.payload) == 0 {
+		writeJSON(w, http.StatusOK, s.accountResource(r, req.account))
+		return
+	}
+
+	var payload accountRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, malformed("account request is not valid JSON"))
+		return
+	}
+
+	if payload.Status != "" && payload.Status != req.account.Status && payload.Status != certsman.AccountStatusDeactivated {
+		writeProblem(w, malformed("account status can't be changed to %q", payload.Status))
+		return
+	}
+
+	if payload.Contact != nil {
+		if p := validateContacts(payload.Contact); p != nil {
+			writeProblem(w, p)
+			return
+		}
+	}
+
+	acct, p := s.updateAccount(req.account, func(acct *certsman.Account) *Problem {
+		if payload.Contact != nil {
+			acct.Contact = payload.Contact
+		}
+		if payload.Status != "" {
+			acct.Status = payload.Status
+		}
+		return nil
+	})
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	if acct.Status == certsman.AccountStatusDeactivated {
+		// Nothing the account started can be finished now that it can't sign requests
+		s.orders.mu.Lock()
+		s.orders.deactivateAccount(acct.ID)
+		s.orders.mu.Unlock()
+
+		log.WithFields(log.Fields{
+			"AccountID": acct.ID,
+		}).Info("Deactivated ACME account")
+	}
+
+	writeJSON(w, http.StatusOK, s.accountResource(r, acct))
+}
+
+// keyChangeHandler rolls an account over to a new key.  The request is signed by the account's current key, and its
+// payload is another JWS signed by the new key, which names the account and its current key.  Once the key is changed,
+// requests signed by the old key are rejected.
+func (s *Server) keyChangeHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var inner JWS
+	if err := json.Unmarshal(req.payload, &inner); err != nil {
+		writeProblem(w, malformed("keyChange payload is not a flattened JWS"))
+		return
+	}
+
+	header, err := inner.Header()
+	if err != nil {
+		writeProblem(w, malformed("%v", err))
+		return
+	}
+	if !supportedAlgorithm(header.Alg) {
+		p := newProblem(ErrorBadSignatureAlgorithm, http.StatusBadRequest, "signature algorithm %q is not supported", header.Alg)
+		p.Algorithms = supportedAlgorithms
+		writeProblem(w, p)
+		return
+	}
+	if header.JWK == nil || header.KID != "" {
+		writeProblem(w, malformed("inner JWS must be signed with a jwk"))
+		return
+	}
+	if header.Nonce != "" {
+		writeProblem(w, malformed("inner JWS must not have a nonce"))
+		return
+	}
+	if header.URL != req.header.URL {
+		writeProblem(w, malformed("inner JWS was signed for %q, not %q", header.URL, req.header.URL))
+		return
+	}
+
+	newKey, err := header.JWK.PublicKey()
+	if err != nil {
+		writeProblem(w, newProblem(ErrorBadPublicKey, http.StatusBadRequest, "%v", err))
+		return
+	}
+
+	payload, err := inner.Verify(newKey)
+	if err == errUnsupportedAlgorithm {
+		p := newProblem(ErrorBadSignatureAlgorithm, http.StatusBadRequest, "signature algorithm %q can't be used with the new key", header.Alg)
+		p.Algorithms = supportedAlgorithms
+		writeProblem(w, p)
+		return
+	}
+	if err != nil {
+		writeProblem(w, malformed("inner JWS %v", err))
+		return
+	}
+
+	var change keyChangeRequest
+	if err := json.Unmarshal(payload, &change); err != nil {
+		writeProblem(w, malformed("keyChange request is not valid JSON"))
+		return
+	}
+	if change.Account != req.header.KID {
+		writeProblem(w, unauthorized("keyChange request is for account %q, not %q", change.Account, req.header.KID))
+		return
+	}
+
+	oldThumbprint, err := change.OldKey.Thumbprint()
+	if err != nil || oldThumbprint != req.account.KeyThumbprint {
+		writeProblem(w, unauthorized("oldKey is not the account's current key"))
+		return
+	}
+
+	newThumbprint, _ := header.JWK.Thumbprint()
+	if newThumbprint == oldThumbprint {
+		writeProblem(w, malformed("new key is the same as the account's current key"))
+		return
+	}
+
+	newJWK, _ := json.Marshal(header.JWK)
+	acct, p := s.updateAccount(req.account, func(acct *certsman.Account) *Problem {
+		// Another keyChange may have got in first
+		if acct.KeyThumbprint != oldThumbprint {
+			return unauthorized("oldKey is not the account's current key")
+		}
+		acct.Key = string(newJWK)
+		acct.KeyThumbprint = newThumbprint
+		return nil
+	})
+	if p != nil {
+		if p.Status == http.StatusConflict {
+			if existing, err := s.accounts.RetrieveAccountByKey(newThumbprint); err == nil {
+				w.Header().Set("Location", s.url(r, pathAccount+existing.ID))
+			}
+		}
+		writeProblem(w, p)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"AccountID": acct.ID,
+	}).Info("Changed ACME account key")
+
+	writeJSON(w, http.StatusOK, s.accountResource(r, acct))
+}
+
+// updateAccount applies a change to an account and stores it.  If another request changed the account first, the
+// change is applied again to the account it stored.
+func (s *Server) updateAccount(acct certsman.Account, change func(acct *certsman.Account) *Problem) (certsman.Account, *Problem) {
+	for attempt := 0; attempt < maxAccountUpdateAttempts; attempt++ {
+		updated := acct
+		updated.Contact = append([]string(nil), acct.Contact...)
+		if p := change(&updated); p != nil {
+			return acct, p
+		}
+
+		stored, err := s.accounts.UpdateAccount(acct, updated)
+		if err == nil {
+			return stored, nil
+		}
+		if err == certsman.ErrAccountKeyInUse {
+			return acct, newProblem(ErrorMalformed, http.StatusConflict, "key is already in use by another account")
+		}
+		if err != certsman.ErrAccountConflict {
+			return acct, serverInternal("unable to update account")
+		}
+
+		acct = stored
+		if acct.Status != certsman.AccountStatusValid {
+			return acct, unauthorized("account is %s", acct.Status)
+		}
+	}
+
+	return acct, serverInternal("account is being changed by too many requests at once")
+}
+
+// validateContacts checks every contact is a mailto URL with a single address, which is all the server supports
+func validateContacts(contacts []string) *Problem {
+	if len(contacts) > maxContacts {
+		return newProblem(ErrorInvalidContact, http.StatusBadRequest, "at most %d contacts are allowed", maxContacts)
+	}
+
+	for _, contact := range contacts {
+		if !strings.HasPrefix(contact, "mailto:") {
+			return newProblem(ErrorUnsupportedContact, http.StatusBadRequest, "contact %q is not a mailto URL", contact)
+		}
+
+		address := strings.TrimPrefix(contact, "mailto:")
+		if strings.ContainsAny(address, ",?") {
+			return newProblem(ErrorInvalidContact, http.StatusBadRequest, "contact %q must be a single address without fields", contact)
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			return newProblem(ErrorInvalidContact, http.StatusBadRequest, "contact %q is not a valid email address", contact)
+		}
+	}
+
+	return nil
+}
+
+// accountResource renders an account for clients
+func (s *Server) accountResource(r *http.Request, acct certsman.Account) accountResource {
+	return accountResource{
+		Status:               acct.Status,
+		Contact:              acct.Contact,
+		TermsOfServiceAgreed: acct.TermsOfServiceAgreed,
+		Orders:               s.url(r, pathAccount+acct.ID+pathOrders),
+	}
+}
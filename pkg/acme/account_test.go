@@ -0,0 +1,246 @@
+package acme
+
+import (
+	"crypto"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// register creates an account for the client, remembering its URL as the client's kid
+func (c *testClient) register(payload interface{}) *http.Response {
+	resp := c.post(c.url(pathNewAccount), payload)
+	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
+		c.kid = resp.Header.Get("Location")
+	}
+	return resp
+}
+
+// keyChange builds the inner JWS of a keyChange request, signed by the new key
+func (c *testClient) keyChange(newKey crypto.Signer, header JWSHeader, oldKey crypto.PublicKey) JWS {
+	if header.JWK == nil {
+		jwk, _ := NewJSONWebKey(newKey.Public())
+		header.JWK = &jwk
+	}
+	oldJWK, _ := NewJSONWebKey(oldKey)
+	payload, _ := json.Marshal(keyChangeRequest{Account: c.kid, OldKey: oldJWK})
+
+	inner, err := SignJWS(newKey, header, payload)
+	assert.Nil(c.t, err)
+	return inner
+}
+
+func TestNewAccount(t *testing.T) {
+	for alg, key := range testKeys(t) {
+		_, srv := newTestServer(t, Config{})
+
+		c := &testClient{t: t, srv: srv, key: key}
+		resp := c.register(accountRequest{Contact: []string{"mailto:admin@fooyork.com"}, TermsOfServiceAgreed: true})
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Registering a %s key should create an account", alg)
+		assert.Contains(t, c.kid, srv.URL+"/acme/account/")
+
+		var acct accountResource
+		decode(t, resp, &acct)
+		assert.Equal(t, "valid", acct.Status)
+		assert.Equal(t, []string{"mailto:admin@fooyork.com"}, acct.Contact)
+		assert.True(t, acct.TermsOfServiceAgreed)
+
+		srv.Close()
+	}
+}
+
+func TestNewAccountWithExistingKey(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	c.register(accountRequest{}).Body.Close()
+	kid := c.kid
+
+	c.kid = ""
+	resp := c.register(accountRequest{OnlyReturnExisting: true})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Registering the same key again should find its account")
+	assert.Equal(t, kid, c.kid)
+
+	other := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmRS256]}
+	assertProblem(t, other.register(accountRequest{OnlyReturnExisting: true}), ErrorAccountDoesNotExist, http.StatusBadRequest)
+}
+
+func TestNewAccountRequiresTermsOfService(t *testing.T) {
+	_, srv := newTestServer(t, Config{TermsOfService: "https://fooyork.com/tos"})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	assertProblem(t, c.register(accountRequest{}), ErrorUserActionRequired, http.StatusForbidden)
+
+	resp := c.register(accountRequest{TermsOfServiceAgreed: true})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestNewAccountContacts(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+
+	assertProblem(t, c.register(accountRequest{Contact: []string{"tel:+12025550123"}}), ErrorUnsupportedContact, http.StatusBadRequest)
+	assertProblem(t, c.register(accountRequest{Contact: []string{"mailto:not an address"}}), ErrorInvalidContact, http.StatusBadRequest)
+	assertProblem(t, c.register(accountRequest{Contact: []string{"mailto:admin@fooyork.com?subject=hi"}}), ErrorInvalidContact, http.StatusBadRequest)
+}
+
+func TestNewAccountMustUseJWK(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256], kid: srv.URL + "/acme/account/someone"}
+	assertProblem(t, c.register(accountRequest{}), ErrorMalformed, http.StatusBadRequest)
+}
+
+func TestAccountUpdateAndFetch(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmRS256]}
+	c.register(accountRequest{Contact: []string{"mailto:admin@fooyork.com"}}).Body.Close()
+
+	resp := c.post(c.kid, accountRequest{Contact: []string{"mailto:ops@fooyork.com"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var acct accountResource
+	decode(t, resp, &acct)
+	assert.Equal(t, []string{"mailto:ops@fooyork.com"}, acct.Contact, "The contacts should have been updated")
+
+	resp = c.post(c.kid, nil)
+	acct = accountResource{}
+	decode(t, resp, &acct)
+	assert.Equal(t, []string{"mailto:ops@fooyork.com"}, acct.Contact, "A POST-as-GET should return the stored account")
+
+	resp = c.post(c.kid, accountRequest{Contact: []string{}})
+	acct = accountResource{}
+	decode(t, resp, &acct)
+	assert.Empty(t, acct.Contact, "An empty list should remove the contacts")
+}
+
+func TestAccountRequestsMustUseKID(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	c.register(accountRequest{}).Body.Close()
+	kid := c.kid
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	assertProblem(t, c.postHeader(kid, JWSHeader{Nonce: c.nonce(), URL: kid, JWK: &jwk}, nil), ErrorMalformed, http.StatusBadRequest)
+
+	c.kid = srv.URL + "/acme/account/someone"
+	assertProblem(t, c.post(c.kid, nil), ErrorAccountDoesNotExist, http.StatusBadRequest)
+}
+
+func TestAccountCanOnlyBeUsedByItsKey(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	owner := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	owner.register(accountRequest{}).Body.Close()
+
+	other := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	other.register(accountRequest{}).Body.Close()
+
+	// Signed by the other account for the owner's URL
+	assertProblem(t, other.post(owner.kid, accountRequest{Contact: []string{"mailto:evil@fooyork.com"}}), ErrorUnauthorized, http.StatusForbidden)
+
+	// Claiming to be the owner, but signed with the other key
+	other.kid = owner.kid
+	assertProblem(t, other.post(owner.kid, nil), ErrorMalformed, http.StatusBadRequest)
+}
+
+func TestAccountDeactivation(t *testing.T) {
+	acmeServer, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, _ := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	assertProblem(t, c.post(c.kid, accountRequest{Status: StatusRevoked}), ErrorMalformed, http.StatusBadRequest)
+
+	resp := c.post(c.kid, accountRequest{Status: StatusDeactivated})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var acct accountResource
+	decode(t, resp, &acct)
+	assert.Equal(t, StatusDeactivated, acct.Status)
+
+	assertProblem(t, c.post(c.kid, nil), ErrorUnauthorized, http.StatusForbidden)
+	assertProblem(t, c.post(o.Authorizations[0], nil), ErrorUnauthorized, http.StatusForbidden)
+
+	c.kid = ""
+	assertProblem(t, c.register(accountRequest{}), ErrorUnauthorized, http.StatusForbidden)
+
+	acmeServer.orders.mu.Lock()
+	for _, o := range acmeServer.orders.orders {
+		assert.Equal(t, StatusInvalid, o.Status, "The account's orders should be invalid")
+	}
+	for _, authz := range acmeServer.orders.authzs {
+		assert.Equal(t, StatusDeactivated, authz.Status, "The account's authorizations should be deactivated")
+	}
+	acmeServer.orders.mu.Unlock()
+}
+
+func TestKeyChange(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	c.register(accountRequest{}).Body.Close()
+	kid := c.kid
+
+	newKey := testKeys(t)[AlgorithmES256]
+	url := c.url(pathKeyChange)
+	resp := c.post(url, c.keyChange(newKey, JWSHeader{URL: url}, c.key.Public()))
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Rolling over to a new key should succeed")
+	resp.Body.Close()
+
+	assertProblem(t, c.post(kid, nil), ErrorMalformed, http.StatusBadRequest)
+
+	c.key = newKey
+	resp = c.post(kid, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Requests signed by the new key should be accepted")
+	resp.Body.Close()
+
+	c.kid = ""
+	resp = c.register(accountRequest{OnlyReturnExisting: true})
+	resp.Body.Close()
+	assert.Equal(t, kid, c.kid, "The new key should find the account")
+}
+
+func TestKeyChangeRejectsBadRequests(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	other := newRegisteredClient(t, srv)
+	newKey := testKeys(t)[AlgorithmES256]
+	url := c.url(pathKeyChange)
+
+	assertProblem(t, c.post(url, c.keyChange(newKey, JWSHeader{URL: url, Nonce: c.nonce()}, c.key.Public())), ErrorMalformed, http.StatusBadRequest)
+	assertProblem(t, c.post(url, c.keyChange(newKey, JWSHeader{URL: c.kid}, c.key.Public())), ErrorMalformed, http.StatusBadRequest)
+	assertProblem(t, c.post(url, c.keyChange(newKey, JWSHeader{URL: url}, newKey.Public())), ErrorUnauthorized, http.StatusForbidden)
+	assertProblem(t, c.post(url, c.keyChange(c.key, JWSHeader{URL: url}, c.key.Public())), ErrorMalformed, http.StatusBadRequest)
+
+	// The inner JWS names another account
+	kid := c.kid
+	c.kid = other.kid
+	inner := c.keyChange(newKey, JWSHeader{URL: url}, c.key.Public())
+	c.kid = kid
+	assertProblem(t, c.post(url, inner), ErrorUnauthorized, http.StatusForbidden)
+
+	resp := c.post(url, c.keyChange(other.key, JWSHeader{URL: url}, c.key.Public()))
+	assert.Equal(t, other.kid, resp.Header.Get("Location"), "A key in use should point at the account using it")
+	assertProblem(t, resp, ErrorMalformed, http.StatusConflict)
+
+	resp = c.post(kid, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The account should still have its old key")
+	resp.Body.Close()
+}
@@ -0,0 +1,361 @@
+/*
+
+The acme package provides an RFC 8555 ACME server, so that ACME clients can register accounts and get certificates from certsman.
+
+acme.go - the server, its directory and the checks every signed request goes through
+account.go - registering, updating and deactivating accounts, and rolling over their keys
+authz.go - authorizations, and the challenges which validate them
+dns01.go - validates dns-01 challenges
+http01.go - validates http-01 challenges
+jws.go - the JSON Web Signatures and Keys that requests are signed with
+nonce.go - nonces which stop requests being replayed
+order.go - orders, from creation through to finalizing them and downloading the certificate
+problem.go - the problem documents errors are reported with
+renewalinfo.go - tells clients when to renew their certificates (ACME Renewal Information)
+revoke.go - revoking certificates
+tlsalpn01.go - validates tls-alpn-01 challenges
+
+*/
+package acme
+
+import (
+	"crypto"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// DefaultPathPrefix is the path the ACME resources are served under when no prefix is configured
+const DefaultPathPrefix = "/acme"
+
+// Largest request body the server will read
+const maxRequestBytes = 64 * 1024
+
+// Paths of the ACME resources, under the prefix
+const (
+	pathDirectory     = "/directory"
+	pathNewNonce      = "/new-nonce"
+	pathNewAccount    = "/new-account"
+	pathAccount       = "/account/"
+	pathOrders        = "/orders"
+	pathNewOrder      = "/new-order"
+	pathOrder         = "/order/"
+	pathFinalize      = "/finalize"
+	pathAuthorization = "/authz/"
+	pathChallenge     = "/chall/"
+	pathCertificate   = "/cert/"
+	pathRevokeCert    = "/revoke-cert"
+	pathKeyChange     = "/key-change"
+	pathRenewalInfo   = "/renewal-info/"
+)
+
+// Config provides the settings for the ACME server
+type Config struct {
+	// URL the server is reachable at by clients, e.g. https://certsman.example.com.  Empty uses the host of each request.
+	BaseURL string
+	// Path the ACME resources are served under
+	PathPrefix string
+	// URL of the terms of service clients must agree to when registering.  Empty doesn't require agreement.
+	TermsOfService string
+	// How long a nonce can be used for after it is handed out
+	NonceLifetime time.Duration
+	// How many unused nonces are kept before the oldest are forgotten
+	MaxNonces int
+	// How long an order, and its authorizations, can be completed in
+	OrderLifetime time.Duration
+	// Checks the names an order is for are allowed, e.g. a certsman.NamePolicy's CheckNames.  Nil allows any name.
+	CheckNames func(names []string) error
+
+	// Validators for each type of challenge the server offers, by challenge type
+	Validators map[string]Validator
+	// How long a challenge's validation can take
+	ValidationTimeout time.Duration
+}
+
+// Server serves the ACME resources
+type Server struct {
+	certs    *certsman.CerfificateService
+	accounts certsman.AccountPersistenceProvider
+	cfg      Config
+	nonces   *nonceStore
+	orders   *orderStore
+}
+
+// NewServer creates an ACME server which issues certificates through the cert service, and stores its accounts in the
+// given persistence
+func NewServer(certs *certsman.CerfificateService, accounts certsman.AccountPersistenceProvider, cfg Config) *Server {
+	if cfg.PathPrefix == "" {
+		cfg.PathPrefix = DefaultPathPrefix
+	}
+	if cfg.OrderLifetime <= 0 {
+		cfg.OrderLifetime = DefaultOrderLifetime
+	}
+	if cfg.ValidationTimeout <= 0 {
+		cfg.ValidationTimeout = DefaultValidationTimeout
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	cfg.PathPrefix = "/" + strings.Trim(cfg.PathPrefix, "/")
+
+	return &Server{
+		certs:    certs,
+		accounts: accounts,
+		cfg:      cfg,
+		nonces:   newNonceStore(cfg.NonceLifetime, cfg.MaxNonces),
+		orders:   newOrderStore(),
+	}
+}
+
+// RegisterRoutes adds the ACME resources to the router, under the configured path prefix
+func (s *Server) RegisterRoutes(r *mux.Router) {
+	sub := r.PathPrefix(s.cfg.PathPrefix).Subrouter()
+	sub.Use(s.commonHeaders)
+
+	sub.HandleFunc(pathDirectory, s.directoryHandler).Methods("GET")
+	sub.HandleFunc(pathNewNonce, s.newNonceHandler).Methods("HEAD", "GET")
+	sub.HandleFunc(pathNewAccount, s.newAccountHandler).Methods("POST")
+	sub.HandleFunc(pathAccount+"{id}", s.accountHandler).Methods("POST")
+	sub.HandleFunc(pathAccount+"{id}"+pathOrders, s.accountOrdersHandler).Methods("POST")
+	sub.HandleFunc(pathNewOrder, s.newOrderHandler).Methods("POST")
+	sub.HandleFunc(pathOrder+"{id}", s.orderHandler).Methods("POST")
+	sub.HandleFunc(pathOrder+"{id}"+pathFinalize, s.finalizeHandler).Methods("POST")
+	sub.HandleFunc(pathAuthorization+"{id}", s.authorizationHandler).Methods("POST")
+	sub.HandleFunc(pathChallenge+"{id}", s.challengeHandler).Methods("POST")
+	sub.HandleFunc(pathCertificate+"{id}", s.certificateHandler).Methods("POST")
+	sub.HandleFunc(pathRevokeCert, s.revokeCertHandler).Methods("POST")
+	sub.HandleFunc(pathKeyChange, s.keyChangeHandler).Methods("POST")
+	sub.HandleFunc(pathRenewalInfo+"{id}", s.renewalInfoHandler).Methods("GET")
+}
+
+// commonHeaders gives every response a link to the directory.  Only newNonce and responses to POSTs, which are all
+// signed with a JWS, are given a fresh nonce, so reading the directory or renewal information doesn't fill the store.
+func (s *Server) commonHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || strings.HasSuffix(r.URL.Path, pathNewNonce) {
+			if nonce, err := s.nonces.New(); err == nil {
+				w.Header().Set("Replay-Nonce", nonce)
+			} else {
+				log.Error("Unable to create ACME nonce: ", err)
+			}
+		}
+
+		if !strings.HasSuffix(r.URL.Path, pathDirectory) {
+			w.Header().Add("Link", link(s.url(r, pathDirectory), "index"))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// directory lists the URLs of the ACME resources, which is all a client needs to be configured with
+type directory struct {
+	NewNonce    string        `json:"newNonce"`
+	NewAccount  string        `json:"newAccount"`
+	NewOrder    string        `json:"newOrder"`
+	RevokeCert  string        `json:"revokeCert"`
+	KeyChange   string        `json:"keyChange"`
+	RenewalInfo string        `json:"renewalInfo"`
+	Meta        directoryMeta `json:"meta"`
+}
+
+type directoryMeta struct {
+	TermsOfService          string `json:"termsOfService,omitempty"`
+	ExternalAccountRequired bool   `json:"externalAccountRequired"`
+}
+
+func (s *Server) directoryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, directory{
+		NewNonce:   s.url(r, pathNewNonce),
+		NewAccount: s.url(r, pathNewAccount),
+		NewOrder:   s.url(r, pathNewOrder),
+		RevokeCert: s.url(r, pathRevokeCert),
+		KeyChange:  s.url(r, pathKeyChange),
+		// Certificate identifiers are appended to it
+		RenewalInfo: strings.TrimSuffix(s.url(r, pathRenewalInfo), "/"),
+		Meta: directoryMeta{
+			TermsOfService: s.cfg.TermsOfService,
+		},
+	})
+}
+
+func (s *Server) newNonceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == "GET" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// signedRequest is a request whose JWS has been verified
+type signedRequest struct {
+	header JWSHeader
+	// The decoded payload, which is empty for a POST-as-GET
+	payload []byte
+	// The key the request was signed with
+	key crypto.PublicKey
+	// The account the request was signed by, if it was signed with a kid
+	account certsman.Account
+}
+
+// signedWith is how a request must identify the key it was signed with
+type signedWith int
+
+const (
+	// The request names its account with a kid
+	signedWithKID signedWith = iota
+	// The request embeds its key as a jwk
+	signedWithJWK
+	// The request can do either
+	signedWithEither
+)
+
+// verifyRequest checks a signed request's nonce, URL and signature.  Requests to newAccount are signed with the key
+// they register, so they must embed it as a jwk.  Most other requests must name their account with a kid.
+func (s *Server) verifyRequest(r *http.Request, with signedWith) (signedRequest, *Problem) {
+	var req signedRequest
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/jose+json" {
+		return req, newProblem(ErrorMalformed, http.StatusUnsupportedMediaType, "content type must be application/jose+json, not %q", contentType)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxRequestBytes))
+	if err != nil {
+		return req, malformed("unable to read request body")
+	}
+
+	var jws JWS
+	if err := json.Unmarshal(body, &jws); err != nil {
+		return req, malformed("request body is not a flattened JWS")
+	}
+
+	req.header, err = jws.Header()
+	if err != nil {
+		return req, malformed("%v", err)
+	}
+
+	if !supportedAlgorithm(req.header.Alg) {
+		p := newProblem(ErrorBadSignatureAlgorithm, http.StatusBadRequest, "signature algorithm %q is not supported", req.header.Alg)
+		p.Algorithms = supportedAlgorithms
+		return req, p
+	}
+
+	if !s.nonces.Consume(req.header.Nonce) {
+		return req, newProblem(ErrorBadNonce, http.StatusBadRequest, "nonce is invalid, expired or already used")
+	}
+
+	if expected := s.url(r, r.URL.Path[len(s.cfg.PathPrefix):]); req.header.URL != expected {
+		return req, unauthorized("request was signed for %q, not %q", req.header.URL, expected)
+	}
+
+	if req.header.JWK != nil && req.header.KID != "" {
+		return req, malformed("only one of jwk and kid can be given")
+	}
+
+	if with == signedWithJWK && req.header.JWK == nil {
+		return req, malformed("request must be signed with a jwk")
+	}
+	if with == signedWithKID && req.header.KID == "" {
+		return req, malformed("request must be signed with a kid")
+	}
+
+	if req.header.JWK != nil {
+		req.key, err = req.header.JWK.PublicKey()
+		if err != nil {
+			return req, newProblem(ErrorBadPublicKey, http.StatusBadRequest, "%v", err)
+		}
+	} else {
+		if req.header.KID == "" {
+			return req, malformed("request must be signed with a jwk or kid")
+		}
+
+		var p *Problem
+		req.account, req.key, p = s.lookupAccount(r, req.header.KID)
+		if p != nil {
+			return req, p
+		}
+	}
+
+	req.payload, err = jws.Verify(req.key)
+	if err == errUnsupportedAlgorithm {
+		p := newProblem(ErrorBadSignatureAlgorithm, http.StatusBadRequest, "signature algorithm %q can't be used with the key", req.header.Alg)
+		p.Algorithms = supportedAlgorithms
+		return req, p
+	}
+	if err != nil {
+		return req, malformed("%v", err)
+	}
+
+	return req, nil
+}
+
+// lookupAccount finds the account a kid refers to, and its key.  Only valid accounts can sign requests.
+func (s *Server) lookupAccount(r *http.Request, kid string) (certsman.Account, crypto.PublicKey, *Problem) {
+	prefix := s.url(r, pathAccount)
+	if !strings.HasPrefix(kid, prefix) {
+		return certsman.Account{}, nil, newProblem(ErrorAccountDoesNotExist, http.StatusBadRequest, "kid %q is not an account URL", kid)
+	}
+
+	acct, err := s.accounts.RetrieveAccount(strings.TrimPrefix(kid, prefix))
+	if err == certsman.ErrAccountNotFound {
+		return acct, nil, newProblem(ErrorAccountDoesNotExist, http.StatusBadRequest, "no account exists for kid %q", kid)
+	}
+	if err != nil {
+		return acct, nil, serverInternal("unable to retrieve account")
+	}
+
+	if acct.Status != certsman.AccountStatusValid {
+		return acct, nil, unauthorized("account is %s", acct.Status)
+	}
+
+	var jwk JSONWebKey
+	if err := json.Unmarshal([]byte(acct.Key), &jwk); err != nil {
+		return acct, nil, serverInternal("unable to read account key")
+	}
+	key, err := jwk.PublicKey()
+	if err != nil {
+		return acct, nil, serverInternal("unable to read account key")
+	}
+
+	return acct, key, nil
+}
+
+// url returns the absolute URL of an ACME resource
+func (s *Server) url(r *http.Request, path string) string {
+	base := s.cfg.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + s.cfg.PathPrefix + path
+}
+
+func supportedAlgorithm(alg string) bool {
+	for _, supported := range supportedAlgorithms {
+		if alg == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// link formats a Link header value
+func link(url string, rel string) string {
+	return "<" + url + ">;rel=\"" + rel + "\""
+}
+
+// writeJSON responds with a JSON resource
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,314 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+)
+
+// newTestServer starts an ACME server on a local listener, which issues X.509 certificates from an in-memory CA
+func newTestServer(t *testing.T, cfg Config) (*Server, *httptest.Server) {
+	issuer, err := newTestCAIssuer()
+	assert.Nil(t, err)
+
+	svc := &certsman.CerfificateService{
+		Issuer:      issuer,
+		Persistence: &storage.InMemStorage{Cache: gcache.New(100).Build()},
+	}
+	acmeServer := NewServer(svc, &storage.InMemAccountStorage{}, cfg)
+
+	r := mux.NewRouter()
+	acmeServer.RegisterRoutes(r)
+
+	return acmeServer, httptest.NewServer(r)
+}
+
+// testCAIssuer issues certificates from a self-signed root, for a CSR's key or for a key it generates.  The tests can't
+// use pkg/ca and certs.X509CertIssuer, as pkg/certs imports this package.
+type testCAIssuer struct {
+	root *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCAIssuer() (testCAIssuer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return testCAIssuer{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "certsman ACME test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return testCAIssuer{}, err
+	}
+	root, err := x509.ParseCertificate(der)
+	if err != nil {
+		return testCAIssuer{}, err
+	}
+
+	return testCAIssuer{root: root, key: key}, nil
+}
+
+func (i testCAIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	var key crypto.Signer
+	var pub crypto.PublicKey
+	var err error
+
+	switch {
+	case req.CSR != nil:
+		pub = req.CSR.PublicKey
+	case req.KeyAlgorithm == "" || req.KeyAlgorithm == certsman.KeyAlgorithmECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case req.KeyAlgorithm == certsman.KeyAlgorithmRSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		err = fmt.Errorf("%w: %q", certsman.ErrKeyAlgorithmNotSupported, req.KeyAlgorithm)
+	}
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+	if key != nil {
+		pub = key.Public()
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: req.Hostname},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if req.CSR != nil {
+		template.DNSNames, template.IPAddresses = req.CSR.DNSNames, req.CSR.IPAddresses
+	} else {
+		template.DNSNames, template.IPAddresses = certsman.SplitNames(req.SubjectNames())
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.root, pub, i.key)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	cert := certsman.Certificate{
+		Hostname:         req.Hostname,
+		CertificateBody:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CertificateChain: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.root.Raw})),
+		NotBefore:        leaf.NotBefore,
+		NotAfter:         leaf.NotAfter,
+		KeyAlgorithm:     certsman.KeyAlgorithmOf(pub),
+	}
+	if key != nil {
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return certsman.Certificate{}, err
+		}
+		cert.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	}
+
+	return cert, nil
+}
+
+// testClient signs requests to the test server with its key
+type testClient struct {
+	t   *testing.T
+	srv *httptest.Server
+	key crypto.Signer
+	// The account URL, once registered
+	kid string
+}
+
+func (c *testClient) url(path string) string {
+	return c.srv.URL + DefaultPathPrefix + path
+}
+
+func (c *testClient) nonce() string {
+	resp, err := http.Head(c.url(pathNewNonce))
+	assert.Nil(c.t, err)
+	resp.Body.Close()
+	return resp.Header.Get("Replay-Nonce")
+}
+
+// post signs the payload for the URL and posts it.  A nil payload is a POST-as-GET.
+func (c *testClient) post(url string, payload interface{}) *http.Response {
+	return c.postHeader(url, JWSHeader{Nonce: c.nonce(), URL: url}, payload)
+}
+
+// postHeader posts the payload signed with the given header, adding the jwk or kid if it doesn't have either
+func (c *testClient) postHeader(url string, header JWSHeader, payload interface{}) *http.Response {
+	if header.JWK == nil && header.KID == "" {
+		if c.kid != "" {
+			header.KID = c.kid
+		} else {
+			jwk, _ := NewJSONWebKey(c.key.Public())
+			header.JWK = &jwk
+		}
+	}
+
+	var body []byte
+	if payload != nil {
+		body, _ = json.Marshal(payload)
+	}
+
+	jws, err := SignJWS(c.key, header, body)
+	assert.Nil(c.t, err)
+
+	return c.postJWS(url, jws)
+}
+
+func (c *testClient) postJWS(url string, jws JWS) *http.Response {
+	body, _ := json.Marshal(jws)
+	resp, err := http.Post(url, "application/jose+json", strings.NewReader(string(body)))
+	assert.Nil(c.t, err)
+	return resp
+}
+
+// decode reads a JSON response into v
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	defer resp.Body.Close()
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+}
+
+// assertProblem checks the response is a problem document of the given type
+func assertProblem(t *testing.T, resp *http.Response, problemType string, status int) {
+	var p Problem
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	decode(t, resp, &p)
+	assert.Equal(t, problemType, p.Type, p.Detail)
+	assert.Equal(t, status, resp.StatusCode)
+	assert.Equal(t, status, p.Status)
+}
+
+func TestDirectory(t *testing.T) {
+	_, srv := newTestServer(t, Config{TermsOfService: "https://fooyork.com/tos"})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/acme/directory")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var dir directory
+	decode(t, resp, &dir)
+	assert.Empty(t, resp.Header.Get("Replay-Nonce"), "Only newNonce and POSTs should hand out nonces")
+	assert.Equal(t, srv.URL+"/acme/new-nonce", dir.NewNonce)
+	assert.Equal(t, srv.URL+"/acme/new-account", dir.NewAccount)
+	assert.Equal(t, srv.URL+"/acme/revoke-cert", dir.RevokeCert)
+	assert.Equal(t, srv.URL+"/acme/key-change", dir.KeyChange)
+	assert.Equal(t, "https://fooyork.com/tos", dir.Meta.TermsOfService)
+}
+
+func TestDirectoryUsesBaseURL(t *testing.T) {
+	_, srv := newTestServer(t, Config{BaseURL: "https://certsman.fooyork.com/", PathPrefix: "acme/v2"})
+	defer srv.Close()
+
+	resp, _ := http.Get(srv.URL + "/acme/v2/directory")
+
+	var dir directory
+	decode(t, resp, &dir)
+	assert.Equal(t, "https://certsman.fooyork.com/acme/v2/new-account", dir.NewAccount)
+}
+
+func TestNewNonce(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	resp, err := http.Head(srv.URL + "/acme/new-nonce")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Replay-Nonce"))
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	assert.Contains(t, resp.Header.Get("Link"), `/acme/directory>;rel="index"`)
+
+	resp, _ = http.Get(srv.URL + "/acme/new-nonce")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestRequestNonceIsNotReplayable(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	url := c.url(pathNewAccount)
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	jws, _ := SignJWS(c.key, JWSHeader{Nonce: c.nonce(), URL: url, JWK: &jwk}, []byte(`{}`))
+
+	resp := c.postJWS(url, jws)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "The first request should be accepted")
+	resp.Body.Close()
+
+	resp = c.postJWS(url, jws)
+	assert.NotEmpty(t, resp.Header.Get("Replay-Nonce"), "A rejected POST should hand out a nonce to retry with")
+	assertProblem(t, resp, ErrorBadNonce, http.StatusBadRequest)
+	assertProblem(t, c.postHeader(url, JWSHeader{Nonce: "made-up", URL: url}, struct{}{}), ErrorBadNonce, http.StatusBadRequest)
+}
+
+func TestRequestMustBeSignedForItsURL(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+
+	resp := c.postHeader(c.url(pathNewAccount), JWSHeader{Nonce: c.nonce(), URL: c.url(pathAccount + "someone")}, struct{}{})
+	assertProblem(t, resp, ErrorUnauthorized, http.StatusForbidden)
+}
+
+func TestRequestMustBeJOSE(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/acme/new-account", "application/json", strings.NewReader("{}"))
+	assert.Nil(t, err)
+	assertProblem(t, resp, ErrorMalformed, http.StatusUnsupportedMediaType)
+}
+
+func TestRequestWithUnsupportedAlgorithm(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	c := &testClient{t: t, srv: srv, key: testKeys(t)[AlgorithmES256]}
+	url := c.url(pathNewAccount)
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	jws, _ := SignJWS(c.key, JWSHeader{Nonce: c.nonce(), URL: url, JWK: &jwk}, []byte(`{}`))
+	header, _ := json.Marshal(JWSHeader{Alg: "HS256", Nonce: c.nonce(), URL: url, JWK: &jwk})
+	jws.Protected = encodeSegment(header)
+
+	resp := c.postJWS(url, jws)
+	var p Problem
+	decode(t, resp, &p)
+	assert.Equal(t, ErrorBadSignatureAlgorithm, p.Type)
+	assert.Equal(t, supportedAlgorithms, p.Algorithms, "The supported algorithms should be listed")
+}
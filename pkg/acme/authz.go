@@ -0,0 +1,335 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// DefaultValidationTimeout is how long a challenge's validation can take when no timeout is configured
+const DefaultValidationTimeout = time.Second * 30
+
+// Types of challenges a client can fulfil to prove it controls an identifier
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeDNS01     = "dns-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// Validator checks that a client has fulfilled a type of challenge for an identifier.  When it hasn't, the error
+// should be a *Problem explaining why, which is passed on to the client.
+type Validator interface {
+	Validate(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error
+}
+
+// ValidatorFunc lets a function be used as a Validator
+type ValidatorFunc func(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error
+
+// Validate calls the function
+func (f ValidatorFunc) Validate(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+	return f(ctx, identifier, token, keyAuthorization)
+}
+
+// authorization is an account's proof that it controls an identifier, which it gets by fulfilling one of the challenges
+type authorization struct {
+	ID         string
+	AccountID  string
+	Identifier Identifier
+	Status     string
+	Expires    time.Time
+	// Whether the order was for *. the identifier
+	Wildcard   bool
+	Challenges []*challenge
+}
+
+// refresh expires the authorization once it is past its expiry
+func (a *authorization) refresh(now time.Time) {
+	if (a.Status == StatusPending || a.Status == StatusValid) && !now.Before(a.Expires) {
+		a.Status = StatusExpired
+	}
+}
+
+// challenge is one way of proving control of an authorization's identifier
+type challenge struct {
+	ID              string
+	AuthorizationID string
+	Type            string
+	Status          string
+	Token           string
+	Validated       time.Time
+	// Why the challenge is invalid
+	Error *Problem
+}
+
+// authorizationResource is an authorization as it is returned to clients
+type authorizationResource struct {
+	Identifier Identifier          `json:"identifier"`
+	Status     string              `json:"status"`
+	Expires    time.Time           `json:"expires"`
+	Challenges []challengeResource `json:"challenges"`
+	Wildcard   bool                `json:"wildcard,omitempty"`
+}
+
+// challengeResource is a challenge as it is returned to clients
+type challengeResource struct {
+	Type      string     `json:"type"`
+	URL       string     `json:"url"`
+	Status    string     `json:"status"`
+	Token     string     `json:"token"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *Problem   `json:"error,omitempty"`
+}
+
+// authorizationRequest is the payload of a request to update an authorization
+type authorizationRequest struct {
+	Status string `json:"status"`
+}
+
+// newAuthorization creates a pending authorization for an identifier, with a challenge for each type which can validate it
+func (s *Server) newAuthorization(accountID string, identifier Identifier, expires time.Time) (*authorization, *Problem) {
+	authz := &authorization{
+		ID:         uuid.NewV4().String(),
+		AccountID:  accountID,
+		Identifier: identifier,
+		Status:     StatusPending,
+		Expires:    expires,
+	}
+
+	if strings.HasPrefix(identifier.Value, "*.") {
+		authz.Wildcard = true
+		authz.Identifier.Value = strings.TrimPrefix(identifier.Value, "*.")
+	}
+
+	for _, challengeType := range s.challengeTypes() {
+		if !challengeAllowed(challengeType, authz.Identifier, authz.Wildcard) {
+			continue
+		}
+
+		token, err := newToken()
+		if err != nil {
+			return nil, serverInternal("unable to create challenge token")
+		}
+
+		authz.Challenges = append(authz.Challenges, &challenge{
+			ID:              uuid.NewV4().String(),
+			AuthorizationID: authz.ID,
+			Type:            challengeType,
+			Status:          StatusPending,
+			Token:           token,
+		})
+	}
+
+	if len(authz.Challenges) == 0 {
+		return nil, newProblem(ErrorRejectedIdentifier, http.StatusBadRequest, "no challenge the server supports can validate %s", identifier.Value)
+	}
+
+	return authz, nil
+}
+
+// challengeAllowed reports whether a challenge type can prove control of an identifier.  Wildcards can only be
+// proven through DNS, and IP addresses can't be proven through DNS.
+func challengeAllowed(challengeType string, identifier Identifier, wildcard bool) bool {
+	if wildcard {
+		return challengeType == ChallengeDNS01
+	}
+	if identifier.Type == IdentifierIP {
+		return challengeType != ChallengeDNS01
+	}
+	return true
+}
+
+// authorizationHandler returns an authorization, or deactivates it
+func (s *Server) authorizationHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var payload authorizationRequest
+	if len(req.payload) > 0 {
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			writeProblem(w, malformed("authorization request is not valid JSON"))
+			return
+		}
+	}
+
+	s.orders.mu.Lock()
+	defer s.orders.mu.Unlock()
+
+	authz, ok := s.orders.authzs[mux.Vars(r)["id"]]
+	if !ok {
+		writeProblem(w, newProblem(ErrorMalformed, http.StatusNotFound, "no such authorization"))
+		return
+	}
+	if authz.AccountID != req.account.ID {
+		writeProblem(w, unauthorized("authorization belongs to another account"))
+		return
+	}
+
+	authz.refresh(time.Now())
+
+	switch payload.Status {
+	case "":
+	case StatusDeactivated:
+		if authz.Status != StatusPending && authz.Status != StatusValid {
+			writeProblem(w, malformed("a %s authorization can't be deactivated", authz.Status))
+			return
+		}
+		authz.Status = StatusDeactivated
+	default:
+		writeProblem(w, malformed("authorization status can't be changed to %q", payload.Status))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.authorizationResource(r, authz))
+}
+
+// challengeHandler starts validating a challenge when the client says it is ready, or returns it
+func (s *Server) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	s.orders.mu.Lock()
+	defer s.orders.mu.Unlock()
+
+	chall, ok := s.orders.challenges[mux.Vars(r)["id"]]
+	if !ok {
+		writeProblem(w, newProblem(ErrorMalformed, http.StatusNotFound, "no such challenge"))
+		return
+	}
+
+	authz := s.orders.authzs[chall.AuthorizationID]
+	if authz.AccountID != req.account.ID {
+		writeProblem(w, unauthorized("challenge belongs to another account"))
+		return
+	}
+
+	authz.refresh(time.Now())
+
+	// Any payload, normally {}, asks for validation, whereas a POST-as-GET just fetches the challenge
+	if len(req.payload) > 0 && chall.Status == StatusPending {
+		if authz.Status != StatusPending {
+			writeProblem(w, malformed("authorization is %s", authz.Status))
+			return
+		}
+
+		chall.Status = StatusProcessing
+		go s.validateChallenge(authz, chall, req.account)
+	}
+
+	w.Header().Add("Link", link(s.url(r, pathAuthorization+authz.ID), "up"))
+	writeJSON(w, http.StatusOK, s.challengeResource(r, chall))
+}
+
+// validateChallenge runs the challenge's validator, then records the outcome on it and its authorization
+func (s *Server) validateChallenge(authz *authorization, chall *challenge, acct certsman.Account) {
+	s.orders.mu.Lock()
+	identifier := authz.Identifier
+	token := chall.Token
+	challengeType := chall.Type
+	s.orders.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ValidationTimeout)
+	defer cancel()
+
+	err := s.cfg.Validators[challengeType].Validate(ctx, identifier, token, token+"."+acct.KeyThumbprint)
+
+	s.orders.mu.Lock()
+	defer s.orders.mu.Unlock()
+
+	fields := log.Fields{
+		"AccountID":       authz.AccountID,
+		"AuthorizationID": authz.ID,
+		"Challenge":       challengeType,
+	}
+
+	if err != nil {
+		chall.Status = StatusInvalid
+		chall.Error = validationProblem(err)
+		if authz.Status == StatusPending {
+			authz.Status = StatusInvalid
+		}
+		log.WithFields(fields).Info("ACME challenge failed for ", identifier.Value, ": ", err)
+		return
+	}
+
+	chall.Status = StatusValid
+	chall.Validated = time.Now().UTC().Truncate(time.Second)
+	if authz.Status == StatusPending {
+		authz.Status = StatusValid
+	}
+	log.WithFields(fields).Info("ACME challenge validated for ", identifier.Value)
+}
+
+// challengeTypes lists the types of challenge the server has validators for, in a stable order
+func (s *Server) challengeTypes() []string {
+	var types []string
+	for _, challengeType := range []string{ChallengeHTTP01, ChallengeDNS01, ChallengeTLSALPN01} {
+		if s.cfg.Validators[challengeType] != nil {
+			types = append(types, challengeType)
+		}
+	}
+	return types
+}
+
+// authorizationResource renders an authorization for clients.  The caller must hold the lock.
+func (s *Server) authorizationResource(r *http.Request, authz *authorization) authorizationResource {
+	resource := authorizationResource{
+		Identifier: authz.Identifier,
+		Status:     authz.Status,
+		Expires:    authz.Expires,
+		Wildcard:   authz.Wildcard,
+	}
+
+	for _, chall := range authz.Challenges {
+		resource.Challenges = append(resource.Challenges, s.challengeResource(r, chall))
+	}
+	return resource
+}
+
+// challengeResource renders a challenge for clients.  The caller must hold the lock.
+func (s *Server) challengeResource(r *http.Request, chall *challenge) challengeResource {
+	resource := challengeResource{
+		Type:   chall.Type,
+		URL:    s.url(r, pathChallenge+chall.ID),
+		Status: chall.Status,
+		Token:  chall.Token,
+		Error:  chall.Error,
+	}
+
+	if !chall.Validated.IsZero() {
+		validated := chall.Validated
+		resource.Validated = &validated
+	}
+	return resource
+}
+
+// validationProblem turns a validator's error into the problem reported to the client
+func validationProblem(err error) *Problem {
+	if p, ok := err.(*Problem); ok {
+		return p
+	}
+	return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "%v", err)
+}
+
+// newToken creates a random challenge token
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encodeSegment(b), nil
+}
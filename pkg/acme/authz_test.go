@@ -0,0 +1,98 @@
+package acme
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChallengeTypesForIdentifiers(t *testing.T) {
+	validators := map[string]Validator{ChallengeHTTP01: acceptAll, ChallengeDNS01: acceptAll, ChallengeTLSALPN01: acceptAll}
+	_, srv := newTestServer(t, Config{Validators: validators})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, _ := c.newOrder(append(dnsIdentifiers("fooyork.com", "*.fooyork.com"), Identifier{Type: IdentifierIP, Value: "127.0.0.1"}))
+
+	challengeTypes := func(authz authorizationResource) []string {
+		var types []string
+		for _, chall := range authz.Challenges {
+			types = append(types, chall.Type)
+		}
+		return types
+	}
+
+	authz := c.getAuthorization(o.Authorizations[0])
+	assert.Equal(t, []string{ChallengeHTTP01, ChallengeDNS01, ChallengeTLSALPN01}, challengeTypes(authz))
+
+	authz = c.getAuthorization(o.Authorizations[1])
+	assert.Equal(t, "fooyork.com", authz.Identifier.Value, "The wildcard should be removed from the identifier")
+	assert.True(t, authz.Wildcard)
+	assert.Equal(t, []string{ChallengeDNS01}, challengeTypes(authz), "Wildcards can only be validated through DNS")
+
+	authz = c.getAuthorization(o.Authorizations[2])
+	assert.Equal(t, []string{ChallengeHTTP01, ChallengeTLSALPN01}, challengeTypes(authz), "IP addresses can't be validated through DNS")
+}
+
+func TestChallengeValidatorGetsKeyAuthorization(t *testing.T) {
+	var mu sync.Mutex
+	var gotIdentifier Identifier
+	var gotToken, gotKeyAuthorization string
+
+	recorder := ValidatorFunc(func(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		gotIdentifier, gotToken, gotKeyAuthorization = identifier, token, keyAuthorization
+		return nil
+	})
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: recorder}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, _ := c.newOrder(dnsIdentifiers("fooyork.com"))
+	authz := c.getAuthorization(o.Authorizations[0])
+	chall := authz.Challenges[0]
+
+	resp := c.post(chall.URL, nil)
+	var fetched challengeResource
+	decode(t, resp, &fetched)
+	assert.Equal(t, StatusPending, fetched.Status, "A POST-as-GET shouldn't start validation")
+
+	resp = c.post(chall.URL, struct{}{})
+	assert.Contains(t, resp.Header["Link"], link(o.Authorizations[0], "up"), "The challenge should link to its authorization")
+	resp.Body.Close()
+
+	authz = c.waitForAuthorization(o.Authorizations[0])
+	assert.Equal(t, StatusValid, authz.Status)
+	assert.Equal(t, StatusValid, authz.Challenges[0].Status)
+	assert.NotNil(t, authz.Challenges[0].Validated)
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	thumbprint, _ := jwk.Thumbprint()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, gotIdentifier)
+	assert.Equal(t, chall.Token, gotToken)
+	assert.Equal(t, chall.Token+"."+thumbprint, gotKeyAuthorization, "The key authorization should be the token and account key thumbprint")
+}
+
+func TestDeactivateAuthorization(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	var authz authorizationResource
+	decode(t, c.post(o.Authorizations[0], authorizationRequest{Status: StatusDeactivated}), &authz)
+	assert.Equal(t, StatusDeactivated, authz.Status)
+
+	assertProblem(t, c.post(authz.Challenges[0].URL, struct{}{}), ErrorMalformed, http.StatusBadRequest)
+	assert.Equal(t, StatusInvalid, c.getOrder(orderURL).Status, "Deactivating an authorization should fail its order")
+
+	assertProblem(t, c.post(o.Authorizations[0], authorizationRequest{Status: StatusValid}), ErrorMalformed, http.StatusBadRequest)
+}
@@ -0,0 +1,67 @@
+package acme
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DNS01Label is prepended to a domain to name the TXT record holding its dns-01 challenge response
+const DNS01Label = "_acme-challenge."
+
+// DNS01Validator validates dns-01 challenges (RFC 8555 section 8.4) by looking up the _acme-challenge TXT records of
+// the identifier and checking one of them is the digest of the key authorization.  It is the only way to validate wildcards.
+type DNS01Validator struct {
+	// Address of the DNS server the TXT records are looked up with, e.g. 10.0.0.2:53.  Empty uses the system's resolver.
+	Server string
+}
+
+// DNS01TXTValue returns the TXT record a client publishes to fulfil a dns-01 challenge
+func DNS01TXTValue(keyAuthorization string) string {
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	return encodeSegment(digest[:])
+}
+
+// Validate looks up the identifier's challenge TXT records
+func (d *DNS01Validator) Validate(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+	if identifier.Type != IdentifierDNS {
+		return malformed("dns-01 can't validate %s identifiers", identifier.Type)
+	}
+
+	// Fully qualified, so the lookup doesn't go through the search domains
+	name := DNS01Label + identifier.Value + "."
+
+	records, err := d.resolver().LookupTXT(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "no TXT record found at %s", strings.TrimSuffix(name, "."))
+		}
+		return newProblem(ErrorDNS, http.StatusBadRequest, "looking up TXT records for %s: %v", strings.TrimSuffix(name, "."), err)
+	}
+
+	expected := DNS01TXTValue(keyAuthorization)
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			return nil
+		}
+	}
+
+	return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "none of the %d TXT records at %s match the key authorization", len(records), strings.TrimSuffix(name, "."))
+}
+
+// resolver returns a resolver which sends every query to the configured server, or the system's resolver if there isn't one
+func (d *DNS01Validator) resolver() *net.Resolver {
+	if d.Server == "" {
+		return net.DefaultResolver
+	}
+
+	server := d.Server
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server)
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package acme
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubDNSServer answers TXT queries over UDP from a map, like the DNS provider a client publishes challenge responses to
+type stubDNSServer struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+func newStubDNSServer(t *testing.T) *stubDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s := &stubDNSServer{conn: conn, records: make(map[string][]string)}
+	go s.serve()
+	return s
+}
+
+func (s *stubDNSServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubDNSServer) close() {
+	s.conn.Close()
+}
+
+func (s *stubDNSServer) set(name string, values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[strings.ToLower(name)] = values
+}
+
+func (s *stubDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer builds the response to a single question query, with the question copied back and any TXT records as answers
+func (s *stubDNSServer) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+
+	// Walk the labels of the question's name
+	var labels []string
+	offset := 12
+	for offset < len(query) && query[offset] != 0 {
+		length := int(query[offset])
+		if offset+1+length > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	offset++
+	if offset+4 > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[offset:])
+	question := query[12 : offset+4]
+
+	s.mu.Lock()
+	var values []string
+	if qtype == 16 {
+		values = s.records[strings.ToLower(strings.Join(labels, "."))]
+	}
+	s.mu.Unlock()
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	flags := uint16(0x8180)
+	if values == nil {
+		// NXDOMAIN
+		flags |= 3
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(values)))
+	resp = append(resp, question...)
+
+	for _, value := range values {
+		// A pointer to the question's name, then TXT, IN, a 60 second TTL, and one character-string
+		resp = append(resp, 0xc0, 12, 0, 16, 0, 1, 0, 0, 0, 60)
+		resp = append(resp, byte((len(value)+1)>>8), byte(len(value)+1), byte(len(value)))
+		resp = append(resp, value...)
+	}
+	return resp
+}
+
+func TestDNS01Validate(t *testing.T) {
+	dns := newStubDNSServer(t)
+	defer dns.close()
+
+	validator := &DNS01Validator{Server: dns.addr()}
+	identifier := Identifier{Type: IdentifierDNS, Value: "fooyork.com"}
+
+	dns.set("_acme-challenge.fooyork.com", "some-other-record", DNS01TXTValue("token1.thumbprint"))
+
+	err := validator.Validate(context.Background(), identifier, "token1", "token1.thumbprint")
+	assert.Nil(t, err, "A TXT record with the key authorization digest should validate")
+
+	err = validator.Validate(context.Background(), identifier, "token1", "token1.otherthumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "The wrong digest shouldn't validate")
+
+	err = validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "barmont.com"}, "token1", "token1.thumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "A missing TXT record shouldn't validate")
+
+	err = validator.Validate(context.Background(), Identifier{Type: IdentifierIP, Value: "127.0.0.1"}, "token1", "token1.thumbprint")
+	assert.NotNil(t, err, "IP addresses can't be validated through DNS")
+}
+
+func TestDNS01TXTValue(t *testing.T) {
+	// base64url(SHA-256("token.thumbprint"))
+	assert.Equal(t, "61rBZ_4knHblO0MNoxFsXZ_eTFUHum0B6IVRbhvUn5I", DNS01TXTValue("token.thumbprint"))
+}
+
+func TestDNS01WildcardOrder(t *testing.T) {
+	dns := newStubDNSServer(t)
+	defer dns.close()
+
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{
+		ChallengeHTTP01: acceptAll,
+		ChallengeDNS01:  &DNS01Validator{Server: dns.addr()},
+	}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("*.fooyork.com"))
+
+	authz := c.getAuthorization(o.Authorizations[0])
+	chall := authz.Challenges[0]
+	assert.Equal(t, ChallengeDNS01, chall.Type)
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	thumbprint, _ := jwk.Thumbprint()
+	dns.set("_acme-challenge.fooyork.com", DNS01TXTValue(chall.Token+"."+thumbprint))
+
+	c.post(chall.URL, struct{}{}).Body.Close()
+	assert.Equal(t, StatusValid, c.waitForAuthorization(o.Authorizations[0]).Status, "Publishing the TXT record should validate the wildcard")
+	assert.Equal(t, StatusReady, c.getOrder(orderURL).Status)
+}
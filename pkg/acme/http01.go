@@ -0,0 +1,119 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultHTTP01Port is the port http-01 challenges are fetched from when no port is configured
+const DefaultHTTP01Port = 80
+
+// Most of a challenge response that is read, which is far more than a key authorization needs
+const maxHTTP01ResponseBytes = 8 * 1024
+
+// Most redirects followed when fetching a challenge response
+const maxHTTP01Redirects = 10
+
+// HTTP01Validator validates http-01 challenges (RFC 8555 section 8.3) by fetching
+// http://{identifier}/.well-known/acme-challenge/{token} and checking the response is the key authorization
+type HTTP01Validator struct {
+	// Connects to the identifier.  Defaults to a net.Dialer, and can be overridden to resolve names with another DNS
+	// server, or to point validation at a local server in tests.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Port the challenge response is fetched from, which is 80 outside of testing and staging
+	Port int
+}
+
+// Validate fetches the challenge response from the identifier, following redirects to other http or https URLs on the
+// standard ports.  Redirects to IP addresses or to localhost aren't followed, so a challenge can't be used to probe the
+// server's own network.
+func (h *HTTP01Validator) Validate(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+	port := h.Port
+	if port == 0 {
+		port = DefaultHTTP01Port
+	}
+
+	host := net.JoinHostPort(identifier.Value, strconv.Itoa(port))
+	if port == DefaultHTTP01Port {
+		host = identifier.Value
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	challengeURL := "http://" + host + "/.well-known/acme-challenge/" + token
+
+	dial := h.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: dial,
+			// Redirects to https are allowed, and the certificate being replaced may well have expired
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxHTTP01Redirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to unsupported scheme %q", req.URL.Scheme)
+			}
+			return checkRedirectHost(req.URL)
+		},
+	}
+
+	req, err := http.NewRequest("GET", challengeURL, nil)
+	if err != nil {
+		return malformed("unable to build challenge URL for %q", identifier.Value)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return newProblem(ErrorConnection, http.StatusBadRequest, "fetching %s: %v", challengeURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "fetching %s returned %d, not 200", challengeURL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxHTTP01ResponseBytes))
+	if err != nil {
+		return newProblem(ErrorConnection, http.StatusBadRequest, "reading %s: %v", challengeURL, err)
+	}
+
+	// Trailing whitespace, such as a newline from echo, is ignored
+	if strings.TrimRight(string(body), " \t\r\n") != keyAuthorization {
+		return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "%s did not return the key authorization", challengeURL)
+	}
+
+	return nil
+}
+
+// checkRedirectHost checks a redirect is to a DNS name, on port 80 or 443
+func checkRedirectHost(u *url.URL) error {
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		return fmt.Errorf("redirected to unsupported port %s", port)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if net.ParseIP(host) != nil {
+		return fmt.Errorf("redirected to IP address %s", host)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("redirected to loopback name %s", host)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package acme
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// challengeResponder serves http-01 challenge responses, like a client would on its web server
+type challengeResponder struct {
+	mu        sync.Mutex
+	responses map[string]string
+	// The Host of every request
+	hosts []string
+}
+
+func (c *challengeResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hosts = append(c.hosts, r.Host)
+
+	response, ok := c.responses[strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprintln(w, response)
+}
+
+func (c *challengeResponder) set(token string, keyAuthorization string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.responses[token] = keyAuthorization
+}
+
+// newChallengeResponder starts serving challenge responses, returning a validator which connects to it for every identifier
+func newChallengeResponder() (*challengeResponder, *httptest.Server, *HTTP01Validator) {
+	responder := &challengeResponder{responses: make(map[string]string)}
+	srv := httptest.NewServer(responder)
+
+	validator := &HTTP01Validator{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+	return responder, srv, validator
+}
+
+func TestHTTP01Validate(t *testing.T) {
+	responder, srv, validator := newChallengeResponder()
+	defer srv.Close()
+
+	responder.set("token1", "token1.thumbprint")
+
+	err := validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.thumbprint")
+	assert.Nil(t, err, "The right key authorization should validate")
+	assert.Equal(t, []string{"fooyork.com"}, responder.hosts, "The challenge should be fetched from the identifier")
+
+	err = validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.otherthumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "The wrong key authorization shouldn't validate")
+
+	err = validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token2", "token2.thumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "A missing challenge response shouldn't validate")
+}
+
+func TestHTTP01ValidateIPAddress(t *testing.T) {
+	responder, srv, validator := newChallengeResponder()
+	defer srv.Close()
+
+	responder.set("token1", "token1.thumbprint")
+
+	err := validator.Validate(context.Background(), Identifier{Type: IdentifierIP, Value: "::1"}, "token1", "token1.thumbprint")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"[::1]"}, responder.hosts, "IPv6 addresses should be bracketed")
+}
+
+func TestHTTP01FollowsRedirects(t *testing.T) {
+	responder, srv, validator := newChallengeResponder()
+	defer srv.Close()
+
+	responder.set("token1", "token1.thumbprint")
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://www.fooyork.com"+r.URL.Path, http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	validator.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "www.") {
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, redirector.Listener.Addr().String())
+	}
+
+	err := validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.thumbprint")
+	assert.Nil(t, err, "The redirect should have been followed")
+	assert.Equal(t, []string{"www.fooyork.com"}, responder.hosts)
+}
+
+func TestHTTP01RefusesUnsafeRedirects(t *testing.T) {
+	responder, srv, validator := newChallengeResponder()
+	defer srv.Close()
+
+	responder.set("token1", "token1.thumbprint")
+
+	for _, target := range []string{
+		"http://www.fooyork.com:8080",
+		"https://www.fooyork.com:8443",
+		"http://127.0.0.1",
+		"http://10.0.0.1",
+		"http://[::1]",
+		"http://localhost",
+		"http://foo.localhost.",
+	} {
+		redirector := httptest.NewServer(http.RedirectHandler(target+"/.well-known/acme-challenge/token1", http.StatusFound))
+		validator.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "fooyork.com") {
+				return (&net.Dialer{}).DialContext(ctx, network, redirector.Listener.Addr().String())
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+		}
+
+		err := validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.thumbprint")
+		if assert.NotNil(t, err, "A redirect to %s shouldn't be followed", target) {
+			assert.Equal(t, ErrorConnection, err.(*Problem).Type)
+		}
+		redirector.Close()
+	}
+
+	assert.Empty(t, responder.hosts, "None of the redirects should have reached the responder")
+}
+
+func TestHTTP01ConnectionFailure(t *testing.T) {
+	_, srv, validator := newChallengeResponder()
+	srv.Close()
+
+	err := validator.Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.thumbprint")
+	assert.Equal(t, ErrorConnection, err.(*Problem).Type, "An unreachable identifier should be a connection problem")
+}
+
+func TestHTTP01OrderLifecycle(t *testing.T) {
+	responder, challengeSrv, validator := newChallengeResponder()
+	defer challengeSrv.Close()
+
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: validator}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	thumbprint, _ := jwk.Thumbprint()
+
+	authz := c.getAuthorization(o.Authorizations[0])
+	chall := authz.Challenges[0]
+	assert.Equal(t, ChallengeHTTP01, chall.Type)
+
+	responder.set(chall.Token, chall.Token+"."+thumbprint)
+	c.post(chall.URL, struct{}{}).Body.Close()
+
+	assert.Equal(t, StatusValid, c.waitForAuthorization(o.Authorizations[0]).Status, "Serving the key authorization should validate the challenge")
+	assert.Equal(t, StatusReady, c.getOrder(orderURL).Status)
+}
@@ -0,0 +1,271 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Signature algorithms the ACME server accepts
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+)
+
+// MinRSAKeyBits is the smallest RSA key the ACME server accepts
+const MinRSAKeyBits = 2048
+
+// supportedAlgorithms lists the signature algorithms in the order they are reported to clients
+var supportedAlgorithms = []string{AlgorithmRS256, AlgorithmES256}
+
+var errUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+var errBadSignature = errors.New("signature does not verify")
+
+// JSONWebKey is an RFC 7517 public key, which is how ACME clients send their account keys
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Elliptic curve keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// NewJSONWebKey creates the JSON Web Key for an RSA or P-256 ECDSA public key
+func NewJSONWebKey(pub crypto.PublicKey) (JSONWebKey, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA",
+			N:   encodeSegment(key.N.Bytes()),
+			E:   encodeSegment(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JSONWebKey{}, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		return JSONWebKey{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   encodeSegment(padBytes(key.X.Bytes(), 32)),
+			Y:   encodeSegment(padBytes(key.Y.Bytes(), 32)),
+		}, nil
+	}
+
+	return JSONWebKey{}, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// PublicKey returns the RSA or ECDSA public key described by the JSON Web Key
+func (k JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, nErr := decodeSegment(k.N)
+		e, eErr := decodeSegment(k.E)
+		if nErr != nil || eErr != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < MinRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", MinRSAKeyBits)
+		}
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, xErr := decodeSegment(k.X)
+		y, yErr := decodeSegment(k.Y)
+		if xErr != nil || yErr != nil || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid EC key")
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of the key, which identifies it regardless of how its JSON is formatted
+func (k JSONWebKey) Thumbprint() (string, error) {
+	var canonical string
+
+	// The members are the required ones for the key type, in lexicographic order
+	switch k.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	sum := sha256.Sum256([]byte(canonical))
+	return encodeSegment(sum[:]), nil
+}
+
+// JWSHeader is the protected header of an ACME request.  Exactly one of JWK or KID is set.
+type JWSHeader struct {
+	Alg   string      `json:"alg"`
+	Nonce string      `json:"nonce,omitempty"`
+	URL   string      `json:"url"`
+	KID   string      `json:"kid,omitempty"`
+	JWK   *JSONWebKey `json:"jwk,omitempty"`
+}
+
+// JWS is an RFC 7515 JSON Web Signature using the flattened JSON serialization, which every ACME request is sent as
+type JWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// SignJWS signs the payload with the key, setting the header's algorithm from the key.  An empty payload is a POST-as-GET.
+func SignJWS(key crypto.Signer, header JWSHeader, payload []byte) (JWS, error) {
+	alg, err := algorithmFor(key.Public())
+	if err != nil {
+		return JWS{}, err
+	}
+	header.Alg = alg
+
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return JWS{}, err
+	}
+
+	jws := JWS{
+		Protected: encodeSegment(protected),
+		Payload:   encodeSegment(payload),
+	}
+
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return JWS{}, err
+	}
+
+	if alg == AlgorithmES256 {
+		// ECDSA signs in ASN.1, but JWS wants the fixed size r || s
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+			return JWS{}, err
+		}
+		sig = append(padBytes(parsed.R.Bytes(), 32), padBytes(parsed.S.Bytes(), 32)...)
+	}
+
+	jws.Signature = encodeSegment(sig)
+	return jws, nil
+}
+
+// Header decodes the protected header, without checking the signature
+func (j JWS) Header() (JWSHeader, error) {
+	var header JWSHeader
+
+	protected, err := decodeSegment(j.Protected)
+	if err != nil {
+		return header, errors.New("protected header is not base64url")
+	}
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return header, errors.New("protected header is not JSON")
+	}
+	return header, nil
+}
+
+// Verify checks the signature was made by the key with the algorithm in the header, returning the payload if it was
+func (j JWS) Verify(pub crypto.PublicKey) ([]byte, error) {
+	header, err := j.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := algorithmFor(pub)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != alg {
+		return nil, errUnsupportedAlgorithm
+	}
+
+	sig, err := decodeSegment(j.Signature)
+	if err != nil {
+		return nil, errBadSignature
+	}
+
+	digest := sha256.Sum256([]byte(j.Protected + "." + j.Payload))
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return nil, errBadSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errBadSignature
+		}
+	}
+
+	payload, err := decodeSegment(j.Payload)
+	if err != nil {
+		return nil, errors.New("payload is not base64url")
+	}
+	return payload, nil
+}
+
+// algorithmFor returns the signature algorithm used with a key
+func algorithmFor(pub crypto.PublicKey) (string, error) {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return AlgorithmRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return AlgorithmES256, nil
+		}
+	}
+	return "", errUnsupportedAlgorithm
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// padBytes left pads a big-endian number with zeros to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,98 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	return map[string]crypto.Signer{
+		AlgorithmRS256: rsaKey,
+		AlgorithmES256: ecKey,
+	}
+}
+
+func TestSignAndVerifyJWS(t *testing.T) {
+	for alg, key := range testKeys(t) {
+		jws, err := SignJWS(key, JWSHeader{Nonce: "nonce", URL: "https://fooyork.com/acme/new-account"}, []byte(`{"hello":"world"}`))
+		assert.Nil(t, err, "Signing with %s shouldn't fail", alg)
+
+		header, err := jws.Header()
+		assert.Nil(t, err)
+		assert.Equal(t, alg, header.Alg, "The algorithm should be set from the key")
+
+		payload, err := jws.Verify(key.Public())
+		assert.Nil(t, err, "A %s signature should verify", alg)
+		assert.Equal(t, `{"hello":"world"}`, string(payload))
+
+		tampered := jws
+		tampered.Payload = encodeSegment([]byte(`{"hello":"mars"}`))
+		_, err = tampered.Verify(key.Public())
+		assert.Equal(t, errBadSignature, err, "A tampered %s payload shouldn't verify", alg)
+	}
+}
+
+func TestVerifyJWSWithWrongKey(t *testing.T) {
+	keys := testKeys(t)
+
+	jws, _ := SignJWS(keys[AlgorithmES256], JWSHeader{URL: "https://fooyork.com"}, nil)
+
+	_, err := jws.Verify(keys[AlgorithmRS256].Public())
+	assert.Equal(t, errUnsupportedAlgorithm, err, "An ES256 signature can't be checked with an RSA key")
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err = jws.Verify(other.Public())
+	assert.Equal(t, errBadSignature, err, "Another key's signature shouldn't verify")
+}
+
+func TestJSONWebKeyRoundTrip(t *testing.T) {
+	for alg, key := range testKeys(t) {
+		jwk, err := NewJSONWebKey(key.Public())
+		assert.Nil(t, err, "Creating a %s JWK shouldn't fail", alg)
+
+		pub, err := jwk.PublicKey()
+		assert.Nil(t, err)
+
+		again, _ := NewJSONWebKey(pub)
+		assert.Equal(t, jwk, again, "The %s JWK should survive being parsed", alg)
+	}
+}
+
+func TestJSONWebKeyThumbprint(t *testing.T) {
+	// The example from RFC 7638 section 3.1
+	jwk := JSONWebKey{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+
+	thumbprint, err := jwk.Thumbprint()
+	assert.Nil(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", thumbprint)
+}
+
+func TestJSONWebKeyRejectsWeakKeys(t *testing.T) {
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	jwk, _ := NewJSONWebKey(small.Public())
+
+	_, err := jwk.PublicKey()
+	assert.NotNil(t, err, "RSA keys smaller than 2048 bits should be rejected")
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, err = NewJSONWebKey(p384.Public())
+	assert.NotNil(t, err, "Only P-256 EC keys are supported")
+
+	_, err = JSONWebKey{Kty: "EC", Crv: "P-256", X: encodeSegment(make([]byte, 32)), Y: encodeSegment(make([]byte, 32))}.PublicKey()
+	assert.NotNil(t, err, "Points that aren't on the curve should be rejected")
+}
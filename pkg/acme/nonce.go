@@ -0,0 +1,101 @@
+package acme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+// DefaultNonceLifetime is how long a nonce can be used for after it is handed out
+const DefaultNonceLifetime = time.Hour
+
+// DefaultMaxNonces is how many unused nonces are kept before the oldest are forgotten
+const DefaultMaxNonces = 10000
+
+// nonceStore hands out nonces and accepts each one exactly once, so that a captured request can't be replayed.  It keeps
+// at most max unused nonces, forgetting the oldest to make room, so clients which never use theirs can't exhaust memory.
+type nonceStore struct {
+	lifetime time.Duration
+	max      int
+
+	mu sync.Mutex
+	// Unused nonces, and when they expire
+	nonces map[string]time.Time
+	// Nonces in the order they were handed out, oldest first.  Used nonces are only dropped once they reach the front,
+	// or when it is compacted.
+	issued []string
+}
+
+func newNonceStore(lifetime time.Duration, max int) *nonceStore {
+	if lifetime <= 0 {
+		lifetime = DefaultNonceLifetime
+	}
+	if max <= 0 {
+		max = DefaultMaxNonces
+	}
+
+	return &nonceStore{
+		lifetime: lifetime,
+		max:      max,
+		nonces:   make(map[string]time.Time),
+	}
+}
+
+// New creates a nonce which can be used once before it expires
+func (n *nonceStore) New() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	n.prune(now)
+	n.nonces[nonce] = now.Add(n.lifetime)
+	n.issued = append(n.issued, nonce)
+	return nonce, nil
+}
+
+// Consume reports whether the nonce was handed out and hasn't expired or been used yet.  Either way, it can't be used again.
+func (n *nonceStore) Consume(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expires, ok := n.nonces[nonce]
+	if !ok {
+		return false
+	}
+
+	delete(n.nonces, nonce)
+	return time.Now().Before(expires)
+}
+
+// prune forgets used and expired nonces from the front of the queue, and then the oldest unused ones until there is room
+// for another.  Every nonce has the same lifetime, so the oldest are the first to expire.  The caller must hold the lock.
+func (n *nonceStore) prune(now time.Time) {
+	for len(n.issued) > 0 {
+		oldest := n.issued[0]
+		expires, ok := n.nonces[oldest]
+		if ok && now.Before(expires) && len(n.nonces) < n.max {
+			break
+		}
+
+		delete(n.nonces, oldest)
+		n.issued = n.issued[1:]
+	}
+
+	// Drop the used nonces stuck behind unused ones, so the queue can't grow without bound
+	if len(n.issued) > 2*n.max {
+		unused := make([]string, 0, len(n.nonces))
+		for _, nonce := range n.issued {
+			if _, ok := n.nonces[nonce]; ok {
+				unused = append(unused, nonce)
+			}
+		}
+		n.issued = unused
+	}
+}
@@ -0,0 +1,48 @@
+package acme
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceCanOnlyBeUsedOnce(t *testing.T) {
+	nonces := newNonceStore(time.Hour, 0)
+
+	nonce, err := nonces.New()
+	assert.Nil(t, err)
+
+	assert.True(t, nonces.Consume(nonce), "A new nonce should be accepted")
+	assert.False(t, nonces.Consume(nonce), "A used nonce should be rejected")
+	assert.False(t, nonces.Consume("made-up"), "A nonce that wasn't handed out should be rejected")
+}
+
+func TestNonceExpires(t *testing.T) {
+	nonces := newNonceStore(time.Millisecond*10, 0)
+
+	nonce, _ := nonces.New()
+	time.Sleep(time.Millisecond * 20)
+
+	assert.False(t, nonces.Consume(nonce), "An expired nonce should be rejected")
+}
+
+func TestNonceStoreForgetsOldestNonces(t *testing.T) {
+	nonces := newNonceStore(time.Hour, 2)
+
+	first, _ := nonces.New()
+	second, _ := nonces.New()
+	third, _ := nonces.New()
+
+	assert.False(t, nonces.Consume(first), "The oldest nonce should be forgotten to make room")
+	assert.True(t, nonces.Consume(second))
+	assert.True(t, nonces.Consume(third))
+
+	for i := 0; i < 10; i++ {
+		nonce, _ := nonces.New()
+		nonces.Consume(nonce)
+	}
+	kept, _ := nonces.New()
+	assert.True(t, nonces.Consume(kept), "Used nonces shouldn't take up room")
+	assert.True(t, len(nonces.issued) <= 4, "Used nonces should be dropped from the queue")
+}
@@ -0,0 +1,610 @@
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// DefaultOrderLifetime is how long an order and its authorizations can be completed in when no lifetime is configured
+const DefaultOrderLifetime = time.Hour * 24
+
+// Most identifiers an order can have
+const maxIdentifiers = 100
+
+// Statuses of orders, authorizations and challenges
+const (
+	StatusPending     = "pending"
+	StatusReady       = "ready"
+	StatusProcessing  = "processing"
+	StatusValid       = "valid"
+	StatusInvalid     = "invalid"
+	StatusExpired     = "expired"
+	StatusDeactivated = "deactivated"
+	StatusRevoked     = "revoked"
+)
+
+// Types of identifiers certificates can be ordered for
+const (
+	IdentifierDNS = "dns"
+	IdentifierIP  = "ip"
+)
+
+// Identifier is a name a certificate is ordered for
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// order is a request for a certificate, which can be finalized once every one of its authorizations is valid
+type order struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Expires     time.Time
+	Identifiers []Identifier
+	// In the same order as the identifiers
+	AuthorizationIDs []string
+	// Set once the order is valid
+	CertificateID string
+	// Why the order is invalid
+	Error *Problem
+}
+
+// issuedCertificate is a certificate issued by finalizing an order
+type issuedCertificate struct {
+	ID          string
+	AccountID   string
+	OrderID     string
+	Certificate certsman.Certificate
+	IssuedAt    time.Time
+	// Identifies the certificate to the renewalInfo resource.  Empty if it can't be identified.
+	RenewalInfoID string
+}
+
+// orderStore keeps orders, authorizations, challenges and certificates in memory.  Everything in it is only read or
+// changed while holding the lock.
+type orderStore struct {
+	mu         sync.Mutex
+	orders     map[string]*order
+	authzs     map[string]*authorization
+	challenges map[string]*challenge
+	certs      map[string]*issuedCertificate
+	// When expired orders were last forgotten
+	pruned time.Time
+
+	// Certificates issued before renewIssuedBefore have been due for renewal since renewForcedAt
+	renewIssuedBefore time.Time
+	renewForcedAt     time.Time
+}
+
+func newOrderStore() *orderStore {
+	return &orderStore{
+		orders:     make(map[string]*order),
+		authzs:     make(map[string]*authorization),
+		challenges: make(map[string]*challenge),
+		certs:      make(map[string]*issuedCertificate),
+	}
+}
+
+// refreshOrder moves a pending or ready order on to the status its authorizations, and its expiry, call for
+func (st *orderStore) refreshOrder(o *order, now time.Time) {
+	if o.Status != StatusPending && o.Status != StatusReady {
+		return
+	}
+
+	if !now.Before(o.Expires) {
+		o.Status = StatusInvalid
+		o.Error = unauthorized("order expired before it was finalized")
+		return
+	}
+
+	allValid := true
+	for _, id := range o.AuthorizationIDs {
+		authz := st.authzs[id]
+		authz.refresh(now)
+
+		switch authz.Status {
+		case StatusValid:
+		case StatusPending:
+			allValid = false
+		default:
+			o.Status = StatusInvalid
+			o.Error = unauthorized("authorization for %s is %s", authz.Identifier.Value, authz.Status)
+			return
+		}
+	}
+
+	if allValid {
+		o.Status = StatusReady
+	}
+}
+
+// deactivateAccount deactivates the account's authorizations, and invalidates its orders which haven't been finalized.
+// The caller must hold the lock.
+func (st *orderStore) deactivateAccount(accountID string) {
+	for _, authz := range st.authzs {
+		if authz.AccountID == accountID && (authz.Status == StatusPending || authz.Status == StatusValid) {
+			authz.Status = StatusDeactivated
+		}
+	}
+
+	for _, o := range st.orders {
+		if o.AccountID == accountID && (o.Status == StatusPending || o.Status == StatusReady) {
+			o.Status = StatusInvalid
+			o.Error = unauthorized("account was deactivated")
+		}
+	}
+}
+
+// prune forgets orders which expired before they were finalized, and orders whose certificate has expired, along with
+// their authorizations.  It runs at most once a minute.  The caller must hold the lock.
+func (st *orderStore) prune(now time.Time) {
+	if now.Sub(st.pruned) < time.Minute {
+		return
+	}
+	st.pruned = now
+
+	for id, o := range st.orders {
+		if cert, ok := st.certs[o.CertificateID]; ok {
+			if now.Before(cert.Certificate.NotAfter) {
+				continue
+			}
+			delete(st.certs, o.CertificateID)
+		} else if now.Before(o.Expires) {
+			continue
+		}
+
+		for _, authzID := range o.AuthorizationIDs {
+			for _, chall := range st.authzs[authzID].Challenges {
+				delete(st.challenges, chall.ID)
+			}
+			delete(st.authzs, authzID)
+		}
+		delete(st.orders, id)
+	}
+}
+
+// newOrderRequest is the payload of a newOrder request
+type newOrderRequest struct {
+	Identifiers []Identifier `json:"identifiers"`
+	NotBefore   string       `json:"notBefore"`
+	NotAfter    string       `json:"notAfter"`
+}
+
+// orderResource is an order as it is returned to clients
+type orderResource struct {
+	Status         string       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *Problem     `json:"error,omitempty"`
+}
+
+// newOrderHandler creates an order, with a pending authorization for each of its identifiers
+func (s *Server) newOrderHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var payload newOrderRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, malformed("order request is not valid JSON"))
+		return
+	}
+
+	if payload.NotBefore != "" || payload.NotAfter != "" {
+		writeProblem(w, malformed("notBefore and notAfter are not supported"))
+		return
+	}
+
+	identifiers, p := normalizeIdentifiers(payload.Identifiers)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+	if s.cfg.CheckNames != nil {
+		if err := s.cfg.CheckNames(identifierNames(identifiers)); err != nil {
+			writeProblem(w, newProblem(ErrorRejectedIdentifier, http.StatusBadRequest, "%v", err))
+			return
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	o := &order{
+		ID:          uuid.NewV4().String(),
+		AccountID:   req.account.ID,
+		Status:      StatusPending,
+		Expires:     now.Add(s.cfg.OrderLifetime),
+		Identifiers: identifiers,
+	}
+
+	var authzs []*authorization
+	for _, identifier := range identifiers {
+		authz, p := s.newAuthorization(req.account.ID, identifier, o.Expires)
+		if p != nil {
+			writeProblem(w, p)
+			return
+		}
+		authzs = append(authzs, authz)
+		o.AuthorizationIDs = append(o.AuthorizationIDs, authz.ID)
+	}
+
+	s.orders.mu.Lock()
+	s.orders.prune(now)
+	s.orders.orders[o.ID] = o
+	for _, authz := range authzs {
+		s.orders.authzs[authz.ID] = authz
+		for _, chall := range authz.Challenges {
+			s.orders.challenges[chall.ID] = chall
+		}
+	}
+	resource := s.orderResource(r, o)
+	s.orders.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"AccountID": req.account.ID,
+		"OrderID":   o.ID,
+	}).Info("Created ACME order for ", identifierValues(identifiers))
+
+	w.Header().Set("Location", s.url(r, pathOrder+o.ID))
+	writeJSON(w, http.StatusCreated, resource)
+}
+
+// orderHandler returns an order
+func (s *Server) orderHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	s.orders.mu.Lock()
+	defer s.orders.mu.Unlock()
+
+	o, p := s.lookupOrder(req, mux.Vars(r)["id"])
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	s.orders.refreshOrder(o, time.Now())
+	writeJSON(w, http.StatusOK, s.orderResource(r, o))
+}
+
+// finalizeRequest is the payload of a finalize request
+type finalizeRequest struct {
+	// The base64url DER of a PKCS#10 request
+	CSR string `json:"csr"`
+}
+
+// finalizeHandler issues the certificate for a ready order, for the key in the submitted CSR
+func (s *Server) finalizeHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var payload finalizeRequest
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		writeProblem(w, malformed("finalize request is not valid JSON"))
+		return
+	}
+
+	s.orders.mu.Lock()
+	o, p := s.lookupOrder(req, mux.Vars(r)["id"])
+	if p != nil {
+		s.orders.mu.Unlock()
+		writeProblem(w, p)
+		return
+	}
+
+	s.orders.refreshOrder(o, time.Now())
+	if o.Status != StatusReady {
+		s.orders.mu.Unlock()
+		writeProblem(w, newProblem(ErrorOrderNotReady, http.StatusForbidden, "order is %s, not ready", o.Status))
+		return
+	}
+
+	csr, p := parseOrderCSR(payload.CSR, o.Identifiers, req.account)
+	if p != nil {
+		s.orders.mu.Unlock()
+		writeProblem(w, p)
+		return
+	}
+
+	// Stops the order being finalized twice while the certificate is issued
+	o.Status = StatusProcessing
+	s.orders.mu.Unlock()
+
+	certReq := certsman.CertificateRequest{
+		RequestID: uuid.NewV4().String(),
+		Hostname:  o.Identifiers[0].Value,
+		CSR:       csr,
+	}
+	resp := s.certs.IssueCertificateContext(r.Context(), certReq)
+
+	s.orders.mu.Lock()
+	if resp.IsSuccess {
+		cert := &issuedCertificate{
+			ID:            uuid.NewV4().String(),
+			AccountID:     o.AccountID,
+			OrderID:       o.ID,
+			Certificate:   resp.Certificate,
+			IssuedAt:      time.Now(),
+			RenewalInfoID: renewalInfoID(resp.Certificate),
+		}
+		s.orders.certs[cert.ID] = cert
+		o.CertificateID = cert.ID
+		o.Status = StatusValid
+	} else if r.Context().Err() != nil {
+		// The client went away, so let it finalize again
+		o.Status = StatusReady
+	} else {
+		// What went wrong inside the server is only logged, with the request ID the client is given to quote
+		log.WithFields(log.Fields{
+			"RequestID": certReq.RequestID,
+			"OrderID":   o.ID,
+		}).Error("Unable to issue certificate for ACME order: ", resp.Error)
+
+		o.Status = StatusInvalid
+		o.Error = serverInternal("unable to issue certificate, request %s", certReq.RequestID)
+	}
+	resource := s.orderResource(r, o)
+	s.orders.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"RequestID": certReq.RequestID,
+		"Hostname":  certReq.Hostname,
+		"AccountID": req.account.ID,
+		"OrderID":   o.ID,
+	}).Info("Finalized ACME order as ", resource.Status)
+
+	w.Header().Set("Location", s.url(r, pathOrder+o.ID))
+	writeJSON(w, http.StatusOK, resource)
+}
+
+// renewalInfoID returns the renewalInfo identifier of an issued certificate, or empty if it doesn't have one
+func renewalInfoID(cert certsman.Certificate) string {
+	block, _ := pem.Decode([]byte(cert.CertificateBody))
+	if block == nil {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return ""
+	}
+
+	id, _ := RenewalInfoCertID(leaf)
+	return id
+}
+
+// certificateHandler downloads the certificate issued for an order, along with its chain
+func (s *Server) certificateHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	s.orders.mu.Lock()
+	cert, ok := s.orders.certs[mux.Vars(r)["id"]]
+	var issued certsman.Certificate
+	if ok {
+		issued = cert.Certificate
+	}
+	s.orders.mu.Unlock()
+
+	if !ok {
+		writeProblem(w, newProblem(ErrorMalformed, http.StatusNotFound, "no such certificate"))
+		return
+	}
+	if cert.AccountID != req.account.ID {
+		writeProblem(w, unauthorized("certificate belongs to another account"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(issued.CertificateBody + issued.CertificateChain))
+}
+
+// ordersListResource lists an account's orders
+type ordersListResource struct {
+	Orders []string `json:"orders"`
+}
+
+// accountOrdersHandler lists the URLs of an account's orders
+func (s *Server) accountOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithKID)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	if req.account.ID != mux.Vars(r)["id"] {
+		writeProblem(w, unauthorized("requests for an account must be signed by that account"))
+		return
+	}
+
+	list := ordersListResource{Orders: []string{}}
+
+	s.orders.mu.Lock()
+	for _, o := range s.orders.orders {
+		if o.AccountID == req.account.ID {
+			list.Orders = append(list.Orders, s.url(r, pathOrder+o.ID))
+		}
+	}
+	s.orders.mu.Unlock()
+
+	sort.Strings(list.Orders)
+	writeJSON(w, http.StatusOK, list)
+}
+
+// lookupOrder finds an order belonging to the request's account.  The caller must hold the lock.
+func (s *Server) lookupOrder(req signedRequest, id string) (*order, *Problem) {
+	o, ok := s.orders.orders[id]
+	if !ok {
+		return nil, newProblem(ErrorMalformed, http.StatusNotFound, "no such order")
+	}
+	if o.AccountID != req.account.ID {
+		return nil, unauthorized("order belongs to another account")
+	}
+	return o, nil
+}
+
+// orderResource renders an order for clients.  The caller must hold the lock.
+func (s *Server) orderResource(r *http.Request, o *order) orderResource {
+	resource := orderResource{
+		Status:      o.Status,
+		Expires:     o.Expires,
+		Identifiers: o.Identifiers,
+		Finalize:    s.url(r, pathOrder+o.ID+pathFinalize),
+		Error:       o.Error,
+	}
+
+	for _, id := range o.AuthorizationIDs {
+		resource.Authorizations = append(resource.Authorizations, s.url(r, pathAuthorization+id))
+	}
+	if o.CertificateID != "" {
+		resource.Certificate = s.url(r, pathCertificate+o.CertificateID)
+	}
+
+	return resource
+}
+
+// normalizeIdentifiers checks the identifiers are names certificates can be issued for, lower-casing and de-duplicating them
+func normalizeIdentifiers(identifiers []Identifier) ([]Identifier, *Problem) {
+	if len(identifiers) == 0 {
+		return nil, malformed("an order needs at least one identifier")
+	}
+	if len(identifiers) > maxIdentifiers {
+		return nil, newProblem(ErrorRejectedIdentifier, http.StatusBadRequest, "an order can have at most %d identifiers", maxIdentifiers)
+	}
+
+	seen := make(map[Identifier]bool)
+	var normalized []Identifier
+
+	for _, identifier := range identifiers {
+		switch identifier.Type {
+		case IdentifierDNS:
+			identifier.Value = strings.TrimSuffix(strings.ToLower(identifier.Value), ".")
+			if !validDNSName(identifier.Value) {
+				return nil, newProblem(ErrorRejectedIdentifier, http.StatusBadRequest, "%q is not a valid DNS name", identifier.Value)
+			}
+		case IdentifierIP:
+			ip := net.ParseIP(identifier.Value)
+			if ip == nil {
+				return nil, newProblem(ErrorRejectedIdentifier, http.StatusBadRequest, "%q is not a valid IP address", identifier.Value)
+			}
+			identifier.Value = ip.String()
+		default:
+			return nil, newProblem(ErrorUnsupportedIdentifier, http.StatusBadRequest, "identifier type %q is not supported", identifier.Type)
+		}
+
+		if !seen[identifier] {
+			seen[identifier] = true
+			normalized = append(normalized, identifier)
+		}
+	}
+
+	return normalized, nil
+}
+
+// validDNSName checks a lower-cased name is a hostname, which may start with a wildcard label
+func validDNSName(name string) bool {
+	if !certsman.ValidDNSName(name) {
+		return false
+	}
+
+	// Names ordered over ACME also have to be fully qualified, and not an IP address in disguise
+	name = strings.TrimPrefix(name, "*.")
+	return strings.Contains(name, ".") && net.ParseIP(name) == nil
+}
+
+// parseOrderCSR decodes a finalize request's CSR and checks it asks for exactly the order's identifiers
+func parseOrderCSR(encoded string, identifiers []Identifier, acct certsman.Account) (*x509.CertificateRequest, *Problem) {
+	der, err := decodeSegment(encoded)
+	if err != nil {
+		return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr is not base64url")
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr is not a PKCS#10 request: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr signature does not verify")
+	}
+
+	if jwk, err := NewJSONWebKey(csr.PublicKey); err == nil {
+		if thumbprint, _ := jwk.Thumbprint(); thumbprint == acct.KeyThumbprint {
+			return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "the certificate key can't be the account key")
+		}
+	}
+
+	requested := make(map[Identifier]bool)
+	for _, name := range csr.DNSNames {
+		requested[Identifier{Type: IdentifierDNS, Value: strings.ToLower(name)}] = true
+	}
+	for _, ip := range csr.IPAddresses {
+		requested[Identifier{Type: IdentifierIP, Value: ip.String()}] = true
+	}
+
+	ordered := make(map[Identifier]bool)
+	for _, identifier := range identifiers {
+		ordered[identifier] = true
+	}
+
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		if !ordered[Identifier{Type: IdentifierDNS, Value: cn}] && !ordered[Identifier{Type: IdentifierIP, Value: cn}] {
+			return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr common name %q is not in the order", csr.Subject.CommonName)
+		}
+	}
+
+	if len(requested) != len(ordered) {
+		return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr must request exactly the order's identifiers")
+	}
+	for identifier := range requested {
+		if !ordered[identifier] {
+			return nil, newProblem(ErrorBadCSR, http.StatusBadRequest, "csr requests %q which is not in the order", identifier.Value)
+		}
+	}
+
+	return csr, nil
+}
+
+// identifierNames returns the values of the identifiers
+func identifierNames(identifiers []Identifier) []string {
+	names := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		names = append(names, identifier.Value)
+	}
+	return names
+}
+
+// identifierValues lists the identifiers for logging
+func identifierValues(identifiers []Identifier) string {
+	var values []string
+	for _, identifier := range identifiers {
+		values = append(values, identifier.Value)
+	}
+	return strings.Join(values, ", ")
+}
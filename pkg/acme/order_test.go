@@ -0,0 +1,283 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// acceptAll is a validator which accepts every challenge
+var acceptAll = ValidatorFunc(func(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+	return nil
+})
+
+// newRegisteredClient creates a client with a new account on the test server
+func newRegisteredClient(t *testing.T, srv *httptest.Server) *testClient {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := &testClient{t: t, srv: srv, key: key}
+	c.register(accountRequest{}).Body.Close()
+	return c
+}
+
+func dnsIdentifiers(names ...string) []Identifier {
+	var identifiers []Identifier
+	for _, name := range names {
+		identifiers = append(identifiers, Identifier{Type: IdentifierDNS, Value: name})
+	}
+	return identifiers
+}
+
+// newOrder creates an order, returning it and its URL
+func (c *testClient) newOrder(identifiers []Identifier) (orderResource, string) {
+	resp := c.post(c.url(pathNewOrder), newOrderRequest{Identifiers: identifiers})
+	assert.Equal(c.t, http.StatusCreated, resp.StatusCode)
+
+	var o orderResource
+	decode(c.t, resp, &o)
+	return o, resp.Header.Get("Location")
+}
+
+func (c *testClient) getOrder(url string) orderResource {
+	var o orderResource
+	decode(c.t, c.post(url, nil), &o)
+	return o
+}
+
+func (c *testClient) getAuthorization(url string) authorizationResource {
+	var authz authorizationResource
+	decode(c.t, c.post(url, nil), &authz)
+	return authz
+}
+
+// waitForAuthorization polls an authorization until it is no longer pending
+func (c *testClient) waitForAuthorization(url string) authorizationResource {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		authz := c.getAuthorization(url)
+		if authz.Status != StatusPending || time.Now().After(deadline) {
+			return authz
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// authorize fulfils the first challenge of every one of the order's authorizations
+func (c *testClient) authorize(o orderResource) {
+	for _, authzURL := range o.Authorizations {
+		authz := c.getAuthorization(authzURL)
+		c.post(authz.Challenges[0].URL, struct{}{}).Body.Close()
+		assert.Equal(c.t, StatusValid, c.waitForAuthorization(authzURL).Status)
+	}
+}
+
+// newCSR creates a base64url DER CSR for the names, which may be IP addresses
+func newCSR(t *testing.T, key crypto.Signer, commonName string, names ...string) string {
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	assert.Nil(t, err)
+	return encodeSegment(der)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+
+	o, orderURL := c.newOrder(append(dnsIdentifiers("FooYork.com", "www.fooyork.com"), Identifier{Type: IdentifierIP, Value: "127.0.0.1"}))
+	assert.Equal(t, StatusPending, o.Status)
+	assert.Equal(t, "fooyork.com", o.Identifiers[0].Value, "DNS identifiers should be lower-cased")
+	assert.Len(t, o.Authorizations, 3, "Every identifier should have an authorization")
+	assert.Contains(t, o.Finalize, orderURL)
+
+	c.authorize(o)
+	assert.Equal(t, StatusReady, c.getOrder(orderURL).Status, "The order should be ready once every authorization is valid")
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp := c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "fooyork.com", "fooyork.com", "www.fooyork.com", "127.0.0.1")})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	decode(t, resp, &o)
+	assert.Equal(t, StatusValid, o.Status, "The order should be valid once its certificate is issued")
+	assert.NotEmpty(t, o.Certificate)
+
+	resp = c.post(o.Certificate, nil)
+	assert.Equal(t, "application/pem-certificate-chain", resp.Header.Get("Content-Type"))
+	chain, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	block, rest := pem.Decode(chain)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err, "The certificate should be PEM")
+	assert.Equal(t, certKey.Public(), leaf.PublicKey, "The certificate should be for the CSR's key")
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com"}, leaf.DNSNames)
+	assert.Len(t, leaf.IPAddresses, 1)
+
+	intermediate, _ := pem.Decode(rest)
+	assert.NotNil(t, intermediate, "The chain should follow the certificate")
+
+	var orders ordersListResource
+	decode(t, c.post(c.kid+pathOrders, nil), &orders)
+	assert.Equal(t, []string{orderURL}, orders.Orders, "The order should be listed on the account")
+}
+
+func TestFinalizeBeforeReady(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, _ := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp := c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "", "fooyork.com")})
+	assertProblem(t, resp, ErrorOrderNotReady, http.StatusForbidden)
+}
+
+func TestFinalizeRejectsMismatchedCSR(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com", "www.fooyork.com"))
+	c.authorize(o)
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	assertProblem(t, c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "", "fooyork.com")}), ErrorBadCSR, http.StatusBadRequest)
+	assertProblem(t, c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "", "fooyork.com", "www.fooyork.com", "evil.com")}), ErrorBadCSR, http.StatusBadRequest)
+	assertProblem(t, c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "evil.com", "fooyork.com", "www.fooyork.com")}), ErrorBadCSR, http.StatusBadRequest)
+	assertProblem(t, c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, c.key, "", "fooyork.com", "www.fooyork.com")}), ErrorBadCSR, http.StatusBadRequest)
+	assertProblem(t, c.post(o.Finalize, finalizeRequest{CSR: "not-a-csr"}), ErrorBadCSR, http.StatusBadRequest)
+
+	assert.Equal(t, StatusReady, c.getOrder(orderURL).Status, "A rejected CSR should leave the order ready")
+}
+
+// failingIssuer fails every request with an error which gives away details of the server
+type failingIssuer struct{}
+
+func (failingIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return certsman.Certificate{}, errors.New("open /var/lib/certsman/ca/intermediate.key: disk on fire")
+}
+
+func TestFinalizeHidesIssuerErrors(t *testing.T) {
+	s, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+	s.certs.Issuer = failingIssuer{}
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+	c.authorize(o)
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.post(o.Finalize, finalizeRequest{CSR: newCSR(t, certKey, "", "fooyork.com")}).Body.Close()
+
+	o = c.getOrder(orderURL)
+	assert.Equal(t, StatusInvalid, o.Status)
+	if assert.NotNil(t, o.Error) {
+		assert.Equal(t, ErrorServerInternal, o.Error.Type)
+		assert.NotContains(t, o.Error.Detail, "disk on fire", "What went wrong inside the server shouldn't be handed back")
+	}
+}
+
+func TestNewOrderRejectsBadIdentifiers(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	url := c.url(pathNewOrder)
+
+	assertProblem(t, c.post(url, newOrderRequest{}), ErrorMalformed, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("not a hostname")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("localhost")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("foo.*.fooyork.com")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: []Identifier{{Type: "email", Value: "admin@fooyork.com"}}}), ErrorUnsupportedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("fooyork.com"), NotAfter: "2030-01-01T00:00:00Z"}), ErrorMalformed, http.StatusBadRequest)
+
+	// Only dns-01 can validate wildcards, which this server doesn't offer
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("*.fooyork.com")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+}
+
+func TestNewOrderRejectsIdentifiersOutsideNamePolicy(t *testing.T) {
+	policy := certsman.NamePolicy{AllowedDomains: []string{"fooyork.com"}}
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}, CheckNames: policy.CheckNames})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	url := c.url(pathNewOrder)
+
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("barlondon.com")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: dnsIdentifiers("www.fooyork.com", "barlondon.com")}), ErrorRejectedIdentifier, http.StatusBadRequest)
+	assertProblem(t, c.post(url, newOrderRequest{Identifiers: []Identifier{{Type: IdentifierIP, Value: "10.0.0.1"}}}), ErrorRejectedIdentifier, http.StatusBadRequest)
+
+	o, _ := c.newOrder(dnsIdentifiers("www.fooyork.com"))
+	assert.Equal(t, StatusPending, o.Status)
+}
+
+func TestOrderBelongsToAccount(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	owner := newRegisteredClient(t, srv)
+	o, orderURL := owner.newOrder(dnsIdentifiers("fooyork.com"))
+
+	other := newRegisteredClient(t, srv)
+	assertProblem(t, other.post(orderURL, nil), ErrorUnauthorized, http.StatusForbidden)
+	assertProblem(t, other.post(o.Authorizations[0], nil), ErrorUnauthorized, http.StatusForbidden)
+}
+
+func TestOrderInvalidWhenChallengeFails(t *testing.T) {
+	rejectAll := ValidatorFunc(func(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+		return errors.New("wrong key authorization")
+	})
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: rejectAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	authz := c.getAuthorization(o.Authorizations[0])
+	c.post(authz.Challenges[0].URL, struct{}{}).Body.Close()
+
+	authz = c.waitForAuthorization(o.Authorizations[0])
+	assert.Equal(t, StatusInvalid, authz.Status)
+	assert.Equal(t, StatusInvalid, authz.Challenges[0].Status)
+	assert.Equal(t, ErrorIncorrectResponse, authz.Challenges[0].Error.Type)
+
+	o = c.getOrder(orderURL)
+	assert.Equal(t, StatusInvalid, o.Status, "A failed authorization should fail the order")
+	assert.NotNil(t, o.Error)
+}
+
+func TestOrderExpires(t *testing.T) {
+	_, srv := newTestServer(t, Config{OrderLifetime: time.Millisecond, Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	_, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+	time.Sleep(time.Millisecond * 5)
+
+	assert.Equal(t, StatusInvalid, c.getOrder(orderURL).Status, "An order which wasn't finalized in time should be invalid")
+}
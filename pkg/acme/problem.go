@@ -0,0 +1,73 @@
+package acme
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error types from RFC 8555 section 6.7
+const (
+	ErrorAccountDoesNotExist   = "urn:ietf:params:acme:error:accountDoesNotExist"
+	ErrorAlreadyRevoked        = "urn:ietf:params:acme:error:alreadyRevoked"
+	ErrorBadCSR                = "urn:ietf:params:acme:error:badCSR"
+	ErrorBadNonce              = "urn:ietf:params:acme:error:badNonce"
+	ErrorBadPublicKey          = "urn:ietf:params:acme:error:badPublicKey"
+	ErrorBadRevocationReason   = "urn:ietf:params:acme:error:badRevocationReason"
+	ErrorBadSignatureAlgorithm = "urn:ietf:params:acme:error:badSignatureAlgorithm"
+	ErrorConnection            = "urn:ietf:params:acme:error:connection"
+	ErrorDNS                   = "urn:ietf:params:acme:error:dns"
+	ErrorIncorrectResponse     = "urn:ietf:params:acme:error:incorrectResponse"
+	ErrorInvalidContact        = "urn:ietf:params:acme:error:invalidContact"
+	ErrorMalformed             = "urn:ietf:params:acme:error:malformed"
+	ErrorOrderNotReady         = "urn:ietf:params:acme:error:orderNotReady"
+	ErrorRejectedIdentifier    = "urn:ietf:params:acme:error:rejectedIdentifier"
+	ErrorServerInternal        = "urn:ietf:params:acme:error:serverInternal"
+	ErrorTLS                   = "urn:ietf:params:acme:error:tls"
+	ErrorUnauthorized          = "urn:ietf:params:acme:error:unauthorized"
+	ErrorUnsupportedContact    = "urn:ietf:params:acme:error:unsupportedContact"
+	ErrorUnsupportedIdentifier = "urn:ietf:params:acme:error:unsupportedIdentifier"
+	ErrorUserActionRequired    = "urn:ietf:params:acme:error:userActionRequired"
+)
+
+// Problem is an RFC 7807 problem document, which is how the ACME server reports every error
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status"`
+
+	// Signature algorithms the server accepts, for badSignatureAlgorithm problems
+	Algorithms []string `json:"algorithms,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+// newProblem creates a problem with a formatted detail
+func newProblem(problemType string, status int, format string, args ...interface{}) *Problem {
+	return &Problem{
+		Type:   problemType,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+func malformed(format string, args ...interface{}) *Problem {
+	return newProblem(ErrorMalformed, http.StatusBadRequest, format, args...)
+}
+
+func unauthorized(format string, args ...interface{}) *Problem {
+	return newProblem(ErrorUnauthorized, http.StatusForbidden, format, args...)
+}
+
+func serverInternal(format string, args ...interface{}) *Problem {
+	return newProblem(ErrorServerInternal, http.StatusInternalServerError, format, args...)
+}
+
+// writeProblem responds with a problem document
+func writeProblem(w http.ResponseWriter, p *Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,133 @@
+package acme
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultRenewalInfoRetryAfter is how long clients are told to wait before checking a certificate's renewal info again
+const DefaultRenewalInfoRetryAfter = time.Hour * 6
+
+// How long a forced renewal window lasts, so that every client told to renew at once doesn't do so at the same moment
+const forcedRenewalSpread = time.Hour
+
+// errNoAuthorityKeyID is returned for certificates which can't be identified to the renewalInfo resource
+var errNoAuthorityKeyID = errors.New("certificate has no authority key identifier")
+
+// renewalInfoResource is the renewal info of a certificate as it is returned to clients
+type renewalInfoResource struct {
+	SuggestedWindow suggestedWindow `json:"suggestedWindow"`
+}
+
+// suggestedWindow is when a client should renew a certificate.  A window which is already over means as soon as possible.
+type suggestedWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RenewalInfoCertID returns the identifier a certificate's renewal info is fetched with, which is its authority key
+// identifier and serial number, base64url encoded and joined with a dot
+func RenewalInfoCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errNoAuthorityKeyID
+	}
+
+	// The serial is encoded as the bytes of its DER INTEGER, which are padded so it isn't read as negative
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return encodeSegment(cert.AuthorityKeyId) + "." + encodeSegment(serial), nil
+}
+
+// ForceEarlyRenewal tells clients to renew every certificate issued before the given time as soon as they can, e.g. after
+// rotating to a new intermediate.  Revoked certificates are always due for renewal.
+func (s *Server) ForceEarlyRenewal(issuedBefore time.Time) {
+	s.orders.mu.Lock()
+	defer s.orders.mu.Unlock()
+
+	s.orders.renewIssuedBefore = issuedBefore
+	s.orders.renewForcedAt = time.Now()
+
+	log.WithFields(log.Fields{
+		"IssuedBefore": issuedBefore,
+	}).Info("Forcing early renewal of ACME certificates")
+}
+
+// renewalInfoHandler returns when a certificate should be renewed.  It isn't signed, so clients can check it as often as
+// they like.
+func (s *Server) renewalInfoHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if parts := strings.Split(id, "."); len(parts) != 2 || !validSegment(parts[0]) || !validSegment(parts[1]) {
+		writeProblem(w, malformed("%q is not a certificate identifier", id))
+		return
+	}
+
+	s.orders.mu.Lock()
+	cert := s.orders.findCertificateByID(id)
+	var window suggestedWindow
+	if cert != nil {
+		window = s.orders.suggestedWindow(cert)
+	}
+	s.orders.mu.Unlock()
+
+	if cert == nil {
+		writeProblem(w, newProblem(ErrorMalformed, http.StatusNotFound, "no certificate was issued for %q", id))
+		return
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(DefaultRenewalInfoRetryAfter/time.Second)))
+	writeJSON(w, http.StatusOK, renewalInfoResource{SuggestedWindow: window})
+}
+
+// findCertificateByID returns the certificate with the renewalInfo identifier, or nil.  The caller must hold the lock.
+func (st *orderStore) findCertificateByID(id string) *issuedCertificate {
+	for _, cert := range st.certs {
+		if cert.RenewalInfoID == id {
+			return cert
+		}
+	}
+	return nil
+}
+
+// suggestedWindow works out when a certificate should be renewed.  Normally that is from when a third of its lifetime is
+// left until a sixth is, but a revoked certificate, or one whose renewal has been forced, is due straight away.
+// The caller must hold the lock.
+func (st *orderStore) suggestedWindow(cert *issuedCertificate) suggestedWindow {
+	c := cert.Certificate
+	lifetime := c.NotAfter.Sub(c.NotBefore)
+	window := suggestedWindow{
+		Start: c.NotAfter.Add(-lifetime / 3),
+		End:   c.NotAfter.Add(-lifetime / 6),
+	}
+
+	var forcedAt time.Time
+	if c.IsRevoked() {
+		forcedAt = c.RevokedAt
+	} else if cert.IssuedAt.Before(st.renewIssuedBefore) {
+		forcedAt = st.renewForcedAt
+	}
+
+	if !forcedAt.IsZero() && forcedAt.Before(window.Start) {
+		window.Start = forcedAt
+		if end := forcedAt.Add(forcedRenewalSpread); end.Before(window.End) {
+			window.End = end
+		}
+	}
+
+	return window
+}
+
+// validSegment reports whether s is non-empty base64url
+func validSegment(s string) bool {
+	b, err := decodeSegment(s)
+	return err == nil && len(b) > 0
+}
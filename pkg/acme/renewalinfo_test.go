@@ -0,0 +1,103 @@
+package acme
+
+import (
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// getRenewalInfo fetches the renewal info of a certificate
+func getRenewalInfo(t *testing.T, c *testClient, der []byte) (renewalInfoResource, *http.Response) {
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	id, err := RenewalInfoCertID(cert)
+	assert.Nil(t, err, "Issued certificates should have an authority key identifier")
+
+	resp, err := http.Get(c.url(pathRenewalInfo + id))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var info renewalInfoResource
+	decode(t, resp, &info)
+	return info, resp
+}
+
+func TestRenewalInfoCertID(t *testing.T) {
+	cert := &x509.Certificate{
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+		SerialNumber:   big.NewInt(0x87654321),
+	}
+
+	id, err := RenewalInfoCertID(cert)
+	assert.Nil(t, err)
+	assert.Equal(t, "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE", id, "A serial with its high bit set should be padded")
+
+	_, err = RenewalInfoCertID(&x509.Certificate{SerialNumber: big.NewInt(1)})
+	assert.Equal(t, errNoAuthorityKeyID, err)
+}
+
+func TestRenewalInfo(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	var dir directory
+	resp, _ := http.Get(srv.URL + "/acme/directory")
+	decode(t, resp, &dir)
+	assert.Equal(t, srv.URL+"/acme/renewal-info", dir.RenewalInfo)
+
+	c := newRegisteredClient(t, srv)
+	der, _ := c.issueCertificate("fooyork.com")
+	cert, _ := x509.ParseCertificate(der)
+
+	info, resp := getRenewalInfo(t, c, der)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.True(t, info.SuggestedWindow.Start.After(time.Now()), "A new certificate shouldn't be due for renewal yet")
+	assert.True(t, info.SuggestedWindow.Start.Before(info.SuggestedWindow.End))
+	assert.True(t, info.SuggestedWindow.End.Before(cert.NotAfter), "The window should end before the certificate expires")
+}
+
+func TestRenewalInfoRevoked(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	der, _ := c.issueCertificate("fooyork.com")
+
+	c.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}).Body.Close()
+
+	info, _ := getRenewalInfo(t, c, der)
+	assert.False(t, info.SuggestedWindow.Start.After(time.Now()), "A revoked certificate should be renewed straight away")
+}
+
+func TestRenewalInfoForced(t *testing.T) {
+	acmeServer, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	before, _ := c.issueCertificate("fooyork.com")
+
+	acmeServer.ForceEarlyRenewal(time.Now())
+	after, _ := c.issueCertificate("fooyork.com")
+
+	info, _ := getRenewalInfo(t, c, before)
+	assert.False(t, info.SuggestedWindow.Start.After(time.Now()), "A certificate issued before the cutoff should be renewed straight away")
+	assert.True(t, info.SuggestedWindow.End.After(info.SuggestedWindow.Start), "Renewals should be spread out")
+
+	info, _ = getRenewalInfo(t, c, after)
+	assert.True(t, info.SuggestedWindow.Start.After(time.Now()), "A certificate issued after the cutoff shouldn't be affected")
+}
+
+func TestRenewalInfoUnknownCertificate(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	resp, _ := http.Get(srv.URL + "/acme/renewal-info/aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE")
+	assertProblem(t, resp, ErrorMalformed, http.StatusNotFound)
+
+	resp, _ = http.Get(srv.URL + "/acme/renewal-info/not-an-id")
+	assertProblem(t, resp, ErrorMalformed, http.StatusBadRequest)
+}
@@ -0,0 +1,230 @@
+package acme
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// Revocation reasons from RFC 5280 section 5.3.1 which clients can give
+const (
+	RevocationReasonUnspecified          = 0
+	RevocationReasonKeyCompromise        = 1
+	RevocationReasonAffiliationChanged   = 3
+	RevocationReasonSuperseded           = 4
+	RevocationReasonCessationOfOperation = 5
+)
+
+// revocationRequest is the payload of a revokeCert request
+type revocationRequest struct {
+	// The base64url DER of the certificate
+	Certificate string `json:"certificate"`
+	Reason      *int   `json:"reason"`
+}
+
+// revokeCertHandler revokes a certificate.  The request can be signed by the account which ordered the certificate, by an
+// account which holds authorizations for every one of its names, or with the certificate's own key.
+func (s *Server) revokeCertHandler(w http.ResponseWriter, r *http.Request) {
+	req, p := s.verifyRequest(r, signedWithEither)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	var revReq revocationRequest
+	if err := json.Unmarshal(req.payload, &revReq); err != nil {
+		writeProblem(w, malformed("request payload is not a revocation request"))
+		return
+	}
+
+	der, err := decodeSegment(revReq.Certificate)
+	if err != nil {
+		writeProblem(w, malformed("certificate is not base64url encoded"))
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		writeProblem(w, malformed("certificate can't be parsed: %v", err))
+		return
+	}
+
+	reason := RevocationReasonUnspecified
+	if revReq.Reason != nil {
+		reason = *revReq.Reason
+	}
+	if !supportedRevocationReason(reason) {
+		writeProblem(w, newProblem(ErrorBadRevocationReason, http.StatusBadRequest, "revocation reason %d is not supported", reason))
+		return
+	}
+
+	// Certificates are stored in the same PEM encoding the issuer gave them in
+	body := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	identifiers := certificateIdentifiers(cert)
+
+	s.orders.mu.Lock()
+	issued := s.orders.findCertificate(body)
+	if p := s.orders.authorizeRevocation(req, cert, issued, identifiers, time.Now()); p != nil {
+		s.orders.mu.Unlock()
+		writeProblem(w, p)
+		return
+	}
+	if issued != nil {
+		if issued.Certificate.IsRevoked() {
+			s.orders.mu.Unlock()
+			writeProblem(w, newProblem(ErrorAlreadyRevoked, http.StatusBadRequest, "certificate has already been revoked"))
+			return
+		}
+		issued.Certificate.RevokedAt = time.Now()
+		issued.Certificate.RevocationReason = reason
+	}
+	s.orders.mu.Unlock()
+
+	// The certificate may also be the one handed out for one of its names, or for all of them together, with or without
+	// its key algorithm, in which case it needs replacing
+	requestID := uuid.NewV4().String()
+	var certReqs []certsman.CertificateRequest
+	for _, identifier := range identifiers {
+		certReqs = append(certReqs, certsman.CertificateRequest{RequestID: requestID, Hostname: identifier.Value})
+	}
+	if len(identifiers) > 1 {
+		allNames := certsman.CertificateRequest{RequestID: requestID, Hostname: identifiers[0].Value}
+		for _, identifier := range identifiers[1:] {
+			allNames.Names = append(allNames.Names, identifier.Value)
+		}
+		certReqs = append(certReqs, allNames)
+	}
+
+	// Certificates requested with a key algorithm are stored apart from those which left it to the issuer
+	if alg := certsman.KeyAlgorithmOf(cert.PublicKey); alg != "" {
+		for _, certReq := range certReqs {
+			certReq.KeyAlgorithm = alg
+			certReqs = append(certReqs, certReq)
+		}
+	}
+
+	revoked := issued != nil
+	alreadyRevoked := false
+	var storeErr error
+	for _, certReq := range certReqs {
+		_, err := s.certs.RevokeCertificateContext(r.Context(), certReq, body, reason)
+		switch err {
+		case nil:
+			revoked = true
+		case certsman.ErrCertificateRevoked:
+			alreadyRevoked = true
+		case certsman.ErrCertificateNotFound:
+		default:
+			storeErr = err
+		}
+	}
+
+	if !revoked {
+		switch {
+		case storeErr != nil:
+			writeProblem(w, serverInternal("unable to revoke certificate"))
+		case alreadyRevoked:
+			writeProblem(w, newProblem(ErrorAlreadyRevoked, http.StatusBadRequest, "certificate has already been revoked"))
+		default:
+			writeProblem(w, newProblem(ErrorMalformed, http.StatusNotFound, "certificate was not issued by this server"))
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": requestID,
+		"Serial":    cert.SerialNumber.String(),
+		"Reason":    reason,
+		"AccountID": req.account.ID,
+	}).Info("Revoked certificate for ", identifierValues(identifiers))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// findCertificate returns the certificate issued for an order which has the given body, or nil.  The caller must hold
+// the lock.
+func (st *orderStore) findCertificate(body string) *issuedCertificate {
+	for _, cert := range st.certs {
+		if cert.Certificate.CertificateBody == body {
+			return cert
+		}
+	}
+	return nil
+}
+
+// authorizeRevocation checks whoever signed a revocation request is allowed to revoke the certificate.  The caller must
+// hold the lock.
+func (st *orderStore) authorizeRevocation(req signedRequest, cert *x509.Certificate, issued *issuedCertificate, identifiers []Identifier, now time.Time) *Problem {
+	if req.header.JWK != nil {
+		certKey, err := NewJSONWebKey(cert.PublicKey)
+		if err != nil {
+			return unauthorized("request must be signed with the certificate's key")
+		}
+		certThumbprint, _ := certKey.Thumbprint()
+		if thumbprint, _ := req.header.JWK.Thumbprint(); thumbprint != certThumbprint {
+			return unauthorized("request must be signed with the certificate's key")
+		}
+		return nil
+	}
+
+	if issued != nil && issued.AccountID == req.account.ID {
+		return nil
+	}
+
+	for _, identifier := range identifiers {
+		if !st.hasValidAuthorization(req.account.ID, identifier, now) {
+			return unauthorized("account is not authorized for %s", identifier.Value)
+		}
+	}
+	return nil
+}
+
+// hasValidAuthorization reports whether the account holds a valid authorization for the identifier.  A wildcard name is
+// covered by an authorization for its base domain.  The caller must hold the lock.
+func (st *orderStore) hasValidAuthorization(accountID string, identifier Identifier, now time.Time) bool {
+	value := strings.TrimPrefix(identifier.Value, "*.")
+
+	for _, authz := range st.authzs {
+		if authz.AccountID != accountID || authz.Identifier.Type != identifier.Type || authz.Identifier.Value != value {
+			continue
+		}
+
+		authz.refresh(now)
+		if authz.Status == StatusValid {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateIdentifiers returns the names a certificate was issued for
+func certificateIdentifiers(cert *x509.Certificate) []Identifier {
+	var identifiers []Identifier
+	for _, name := range cert.DNSNames {
+		identifiers = append(identifiers, Identifier{Type: IdentifierDNS, Value: strings.ToLower(name)})
+	}
+	for _, ip := range cert.IPAddresses {
+		identifiers = append(identifiers, Identifier{Type: IdentifierIP, Value: ip.String()})
+	}
+
+	if len(identifiers) == 0 && cert.Subject.CommonName != "" {
+		identifiers = append(identifiers, Identifier{Type: IdentifierDNS, Value: strings.ToLower(cert.Subject.CommonName)})
+	}
+	return identifiers
+}
+
+func supportedRevocationReason(reason int) bool {
+	switch reason {
+	case RevocationReasonUnspecified, RevocationReasonKeyCompromise, RevocationReasonAffiliationChanged,
+		RevocationReasonSuperseded, RevocationReasonCessationOfOperation:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// issueCertificate orders and downloads a certificate for the names, returning its DER and key
+func (c *testClient) issueCertificate(names ...string) ([]byte, crypto.Signer) {
+	o, _ := c.newOrder(dnsIdentifiers(names...))
+	c.authorize(o)
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp := c.post(o.Finalize, finalizeRequest{CSR: newCSR(c.t, certKey, names[0], names...)})
+	decode(c.t, resp, &o)
+
+	resp = c.post(o.Certificate, nil)
+	chain, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	block, _ := pem.Decode(chain)
+	return block.Bytes, certKey
+}
+
+func TestRevokeCertWithAccountKey(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	der, _ := c.issueCertificate("fooyork.com")
+
+	resp := c.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "The account which ordered the certificate should be able to revoke it")
+	resp.Body.Close()
+
+	assertProblem(t, c.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}), ErrorAlreadyRevoked, http.StatusBadRequest)
+}
+
+func TestRevokeCertWithCertificateKey(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	der, certKey := c.issueCertificate("fooyork.com")
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	impostor := &testClient{t: t, srv: srv, key: otherKey}
+	assertProblem(t, impostor.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}), ErrorUnauthorized, http.StatusForbidden)
+
+	reason := RevocationReasonKeyCompromise
+	holder := &testClient{t: t, srv: srv, key: certKey}
+	resp := holder.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der), Reason: &reason})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Whoever holds the certificate's key should be able to revoke it")
+	resp.Body.Close()
+}
+
+func TestRevokeCertWithAuthorizations(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	der, _ := c.issueCertificate("fooyork.com", "www.fooyork.com")
+
+	other := newRegisteredClient(t, srv)
+	assertProblem(t, other.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}), ErrorUnauthorized, http.StatusForbidden)
+
+	o, _ := other.newOrder(dnsIdentifiers("fooyork.com"))
+	other.authorize(o)
+	assertProblem(t, other.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}), ErrorUnauthorized, http.StatusForbidden)
+
+	o, _ = other.newOrder(dnsIdentifiers("www.fooyork.com"))
+	other.authorize(o)
+	resp := other.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "An account authorized for every name should be able to revoke the certificate")
+	resp.Body.Close()
+}
+
+func TestRevokeCertReason(t *testing.T) {
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeHTTP01: acceptAll}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	der, _ := c.issueCertificate("fooyork.com")
+
+	reason := 7
+	assertProblem(t, c.post(c.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der), Reason: &reason}), ErrorBadRevocationReason, http.StatusBadRequest)
+
+	assertProblem(t, c.post(c.url(pathRevokeCert), revocationRequest{Certificate: "not a certificate"}), ErrorMalformed, http.StatusBadRequest)
+}
+
+func TestRevokeCertNotIssuedHere(t *testing.T) {
+	_, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fooyork.com"},
+		DNSNames:     []string{"fooyork.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+
+	holder := &testClient{t: t, srv: srv, key: key}
+	assertProblem(t, holder.post(holder.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(der)}), ErrorMalformed, http.StatusNotFound)
+}
+
+func TestRevokeStoredCert(t *testing.T) {
+	acmeServer, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	first := acmeServer.certs.GetOrCreateCertificate(req)
+	assert.True(t, first.IsSuccess)
+
+	block, _ := pem.Decode([]byte(first.Certificate.PrivateKey))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	assert.Nil(t, err)
+	block, _ = pem.Decode([]byte(first.Certificate.CertificateBody))
+
+	holder := &testClient{t: t, srv: srv, key: key.(crypto.Signer)}
+	resp := holder.post(holder.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(block.Bytes)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A certificate handed out for a hostname should be revocable with its key")
+	resp.Body.Close()
+
+	stored, _ := acmeServer.certs.Persistence.RetrieveCertificate(req)
+	assert.True(t, stored.IsRevoked(), "The stored certificate should be marked as revoked")
+
+	second := acmeServer.certs.GetOrCreateCertificateContext(context.Background(), req)
+	assert.True(t, second.IsSuccess)
+	assert.NotEqual(t, first.Certificate.CertificateBody, second.Certificate.CertificateBody, "A fresh certificate should be issued in place of the revoked one")
+}
+
+func TestRevokeStoredMultiNameCert(t *testing.T) {
+	acmeServer, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com", Names: []string{"www.fooyork.com"}}
+	issued := acmeServer.certs.GetOrCreateCertificate(req)
+	assert.True(t, issued.IsSuccess)
+
+	block, _ := pem.Decode([]byte(issued.Certificate.PrivateKey))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	assert.Nil(t, err)
+	block, _ = pem.Decode([]byte(issued.Certificate.CertificateBody))
+
+	holder := &testClient{t: t, srv: srv, key: key.(crypto.Signer)}
+	resp := holder.post(holder.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(block.Bytes)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A certificate handed out for several names should be revocable")
+	resp.Body.Close()
+
+	stored, _ := acmeServer.certs.Persistence.RetrieveCertificate(req)
+	assert.True(t, stored.IsRevoked(), "The certificate stored for the names should be marked as revoked")
+}
+
+func TestRevokeStoredCertWithKeyAlgorithm(t *testing.T) {
+	acmeServer, srv := newTestServer(t, Config{})
+	defer srv.Close()
+
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com", KeyAlgorithm: certsman.KeyAlgorithmRSA2048}
+	issued := acmeServer.certs.GetOrCreateCertificate(req)
+	assert.True(t, issued.IsSuccess)
+
+	block, _ := pem.Decode([]byte(issued.Certificate.PrivateKey))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	assert.Nil(t, err)
+	block, _ = pem.Decode([]byte(issued.Certificate.CertificateBody))
+
+	holder := &testClient{t: t, srv: srv, key: key.(crypto.Signer)}
+	resp := holder.post(holder.url(pathRevokeCert), revocationRequest{Certificate: encodeSegment(block.Bytes)})
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "A certificate requested with a key algorithm should be revocable")
+	resp.Body.Close()
+
+	stored, _ := acmeServer.certs.Persistence.RetrieveCertificate(req)
+	assert.True(t, stored.IsRevoked(), "The certificate stored for the key algorithm should be marked as revoked")
+
+	again := acmeServer.certs.GetOrCreateCertificate(req)
+	assert.NotEqual(t, issued.Certificate.CertificateBody, again.Certificate.CertificateBody, "The revoked certificate shouldn't be handed out again")
+}
@@ -0,0 +1,185 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTLSALPN01Port is the port tls-alpn-01 challenges are validated on when no port is configured
+const DefaultTLSALPN01Port = 443
+
+// ALPNProtocol is the application protocol negotiated for tls-alpn-01 validation
+const ALPNProtocol = "acme-tls/1"
+
+// idPeACMEIdentifier is the id-pe-acmeIdentifier extension holding the key authorization digest (RFC 8737 section 6.1)
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// TLSALPN01Validator validates tls-alpn-01 challenges (RFC 8737) by connecting to the identifier with the acme-tls/1
+// protocol, and checking the self-signed certificate it presents carries the key authorization digest
+type TLSALPN01Validator struct {
+	// Connects to the identifier.  Defaults to a net.Dialer, and can be overridden to point validation at a local server in tests.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Port the identifier is connected to, which is 443 outside of testing and staging
+	Port int
+}
+
+// Validate performs the acme-tls/1 handshake with the identifier and checks its certificate
+func (v *TLSALPN01Validator) Validate(ctx context.Context, identifier Identifier, token string, keyAuthorization string) error {
+	port := v.Port
+	if port == 0 {
+		port = DefaultTLSALPN01Port
+	}
+	addr := net.JoinHostPort(identifier.Value, strconv.Itoa(port))
+
+	serverName := identifier.Value
+	if identifier.Type == IdentifierIP {
+		// IP addresses are sent as their reverse DNS name, as SNI can't carry an address (RFC 8738 section 6)
+		serverName = reverseDNSName(net.ParseIP(identifier.Value))
+	}
+
+	dial := v.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	rawConn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return newProblem(ErrorConnection, http.StatusBadRequest, "connecting to %s: %v", addr, err)
+	}
+	defer rawConn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		rawConn.SetDeadline(deadline)
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{
+		ServerName: serverName,
+		NextProtos: []string{ALPNProtocol},
+		// The validation certificate is self-signed, and is checked below instead
+		InsecureSkipVerify: true,
+	})
+	if err := conn.Handshake(); err != nil {
+		return newProblem(ErrorTLS, http.StatusBadRequest, "TLS handshake with %s: %v", addr, err)
+	}
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ALPNProtocol {
+		return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "%s did not negotiate %s", addr, ALPNProtocol)
+	}
+	if len(state.PeerCertificates) == 0 {
+		return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "%s did not present a certificate", addr)
+	}
+
+	return checkTLSALPN01Certificate(state.PeerCertificates[0], identifier, keyAuthorization)
+}
+
+// checkTLSALPN01Certificate checks a validation certificate is for exactly the identifier, and has a critical
+// acmeIdentifier extension holding the key authorization digest
+func checkTLSALPN01Certificate(cert *x509.Certificate, identifier Identifier, keyAuthorization string) error {
+	switch identifier.Type {
+	case IdentifierDNS:
+		if len(cert.DNSNames) != 1 || !strings.EqualFold(cert.DNSNames[0], identifier.Value) || len(cert.IPAddresses) != 0 {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "validation certificate must be for %s alone", identifier.Value)
+		}
+	case IdentifierIP:
+		if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP(identifier.Value)) || len(cert.DNSNames) != 0 {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "validation certificate must be for %s alone", identifier.Value)
+		}
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		if !ext.Critical {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "acmeIdentifier extension must be critical")
+		}
+
+		var value []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &value); err != nil || len(rest) != 0 {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "acmeIdentifier extension is not an octet string")
+		}
+		if string(value) != string(digest[:]) {
+			return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "acmeIdentifier extension does not match the key authorization")
+		}
+		return nil
+	}
+
+	return newProblem(ErrorIncorrectResponse, http.StatusForbidden, "validation certificate has no acmeIdentifier extension")
+}
+
+// TLSALPN01Certificate creates the self-signed certificate a client presents to fulfil a tls-alpn-01 challenge
+func TLSALPN01Certificate(identifier Identifier, keyAuthorization string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identifier.Value},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeACMEIdentifier, Critical: true, Value: extValue},
+		},
+	}
+	if identifier.Type == IdentifierIP {
+		template.IPAddresses = []net.IP{net.ParseIP(identifier.Value)}
+	} else {
+		template.DNSNames = []string{identifier.Value}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// reverseDNSName returns the in-addr.arpa or ip6.arpa name of an IP address
+func reverseDNSName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
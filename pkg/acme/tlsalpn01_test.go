@@ -0,0 +1,144 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// alpnResponder serves tls-alpn-01 validation certificates, like a client would on its edge host
+type alpnResponder struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+	// The server name of every handshake
+	serverNames []string
+}
+
+func newALPNResponder(t *testing.T, protocols ...string) *alpnResponder {
+	a := &alpnResponder{certs: make(map[string]*tls.Certificate)}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: protocols,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.serverNames = append(a.serverNames, hello.ServerName)
+			return a.certs[hello.ServerName], nil
+		},
+	})
+	assert.Nil(t, err)
+	a.listener = listener
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	return a
+}
+
+func (a *alpnResponder) set(t *testing.T, serverName string, identifier Identifier, keyAuthorization string) {
+	cert, err := TLSALPN01Certificate(identifier, keyAuthorization)
+	assert.Nil(t, err)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.certs[serverName] = &cert
+}
+
+// validator returns a validator which connects to the responder for every identifier
+func (a *alpnResponder) validator() *TLSALPN01Validator {
+	return &TLSALPN01Validator{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, a.listener.Addr().String())
+		},
+	}
+}
+
+func TestTLSALPN01Validate(t *testing.T) {
+	responder := newALPNResponder(t, ALPNProtocol)
+	defer responder.listener.Close()
+
+	identifier := Identifier{Type: IdentifierDNS, Value: "fooyork.com"}
+	responder.set(t, "fooyork.com", identifier, "token1.thumbprint")
+
+	validator := responder.validator()
+
+	assert.Nil(t, validator.Validate(context.Background(), identifier, "token1", "token1.thumbprint"), "The right certificate should validate")
+	assert.Equal(t, []string{"fooyork.com"}, responder.serverNames, "The identifier should be sent as the server name")
+
+	err := validator.Validate(context.Background(), identifier, "token1", "token1.otherthumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "The wrong key authorization shouldn't validate")
+
+	responder.set(t, "fooyork.com", Identifier{Type: IdentifierDNS, Value: "www.fooyork.com"}, "token1.thumbprint")
+	err = validator.Validate(context.Background(), identifier, "token1", "token1.thumbprint")
+	assert.Equal(t, ErrorIncorrectResponse, err.(*Problem).Type, "A certificate for another name shouldn't validate")
+}
+
+func TestTLSALPN01ValidateIPAddress(t *testing.T) {
+	responder := newALPNResponder(t, ALPNProtocol)
+	defer responder.listener.Close()
+
+	identifier := Identifier{Type: IdentifierIP, Value: "127.0.0.1"}
+	responder.set(t, "1.0.0.127.in-addr.arpa", identifier, "token1.thumbprint")
+
+	assert.Nil(t, responder.validator().Validate(context.Background(), identifier, "token1", "token1.thumbprint"))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa", reverseDNSName(net.ParseIP("::1")))
+}
+
+func TestTLSALPN01RequiresProtocol(t *testing.T) {
+	responder := newALPNResponder(t, "http/1.1")
+	defer responder.listener.Close()
+
+	identifier := Identifier{Type: IdentifierDNS, Value: "fooyork.com"}
+	responder.set(t, "fooyork.com", identifier, "token1.thumbprint")
+
+	err := responder.validator().Validate(context.Background(), identifier, "token1", "token1.thumbprint")
+	assert.NotNil(t, err, "A server which doesn't speak acme-tls/1 shouldn't validate")
+}
+
+func TestTLSALPN01ConnectionFailure(t *testing.T) {
+	responder := newALPNResponder(t, ALPNProtocol)
+	responder.listener.Close()
+
+	err := responder.validator().Validate(context.Background(), Identifier{Type: IdentifierDNS, Value: "fooyork.com"}, "token1", "token1.thumbprint")
+	assert.Equal(t, ErrorConnection, err.(*Problem).Type)
+}
+
+func TestTLSALPN01OrderLifecycle(t *testing.T) {
+	responder := newALPNResponder(t, ALPNProtocol)
+	defer responder.listener.Close()
+
+	_, srv := newTestServer(t, Config{Validators: map[string]Validator{ChallengeTLSALPN01: responder.validator()}})
+	defer srv.Close()
+
+	c := newRegisteredClient(t, srv)
+	o, orderURL := c.newOrder(dnsIdentifiers("fooyork.com"))
+
+	authz := c.getAuthorization(o.Authorizations[0])
+	chall := authz.Challenges[0]
+	assert.Equal(t, ChallengeTLSALPN01, chall.Type)
+
+	jwk, _ := NewJSONWebKey(c.key.Public())
+	thumbprint, _ := jwk.Thumbprint()
+	responder.set(t, "fooyork.com", authz.Identifier, chall.Token+"."+thumbprint)
+
+	c.post(chall.URL, struct{}{}).Body.Close()
+	authz = c.waitForAuthorization(o.Authorizations[0])
+	assert.Equal(t, StatusValid, authz.Status, "Presenting the validation certificate should validate the challenge")
+	assert.Equal(t, StatusValid, authz.Challenges[0].Status, "The outcome should be recorded on the challenge")
+	assert.Equal(t, StatusReady, c.getOrder(orderURL).Status)
+}
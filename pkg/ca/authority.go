@@ -0,0 +1,494 @@
+/*
+The ca package provides a local certificate authority for certsman.
+
+authority.go - A root and intermediate CA hierarchy which signs leaf certificates with the active intermediate
+
+*/
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default common name for the root certificate
+const DefaultRootCommonName = "certsman Root CA"
+
+// Default common name for intermediate certificates
+const DefaultIntermediateCommonName = "certsman Intermediate CA"
+
+// Default lifetime of the root certificate
+const DefaultRootValidity = time.Hour * 24 * 365 * 10
+
+// Default lifetime of an intermediate certificate
+const DefaultIntermediateValidity = time.Hour * 24 * 365
+
+// File names used when the authority is kept on disk
+const (
+	rootCertFile        = "root.pem"
+	rootKeyFile         = "root-key.pem"
+	intermediateDirName = "intermediates"
+	activeFile          = "active"
+)
+
+// Config provides the settings used to load or create an Authority
+type Config struct {
+	// Directory the root and intermediates are loaded from and saved to.  Empty keeps everything in memory.
+	Dir string
+
+	RootCommonName         string
+	IntermediateCommonName string
+
+	RootValidity         time.Duration
+	IntermediateValidity time.Duration
+	// How long before the active intermediate expires a new one is rotated in.  Zero is a third of IntermediateValidity.
+	RotateBefore time.Duration
+}
+
+// ErrIntermediateExpired is returned when the active intermediate has expired and can't be replaced
+var ErrIntermediateExpired = errors.New("the active intermediate CA has expired")
+
+// Intermediate is an intermediate CA certificate and the key used to sign leaves with it
+type Intermediate struct {
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+}
+
+// Authority is a root CA and its intermediates.  Leaves are always signed by the active intermediate,
+// while previously active intermediates are kept around so already issued leaves keep verifying.
+type Authority struct {
+	config Config
+
+	root    *x509.Certificate
+	rootKey crypto.Signer
+
+	mu            sync.RWMutex
+	intermediates []Intermediate
+	active        int
+	onRotate      []func(Intermediate)
+
+	// Held while deciding whether to rotate an expiring intermediate, so concurrent signers rotate it only once
+	rotateMu sync.Mutex
+}
+
+// LoadOrCreate loads the authority found in cfg.Dir, generating a root and an intermediate for anything that is missing
+func LoadOrCreate(cfg Config) (*Authority, error) {
+	cfg = withDefaults(cfg)
+	a := &Authority{config: cfg, active: -1}
+
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, intermediateDirName), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	loaded, err := a.loadRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	if !loaded {
+		log.WithFields(log.Fields{
+			"Dir": cfg.Dir,
+		}).Info("No root CA found.  Generating a new one.")
+
+		if err := a.generateRoot(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := a.loadIntermediates(); err != nil {
+		return nil, err
+	}
+
+	if a.active < 0 {
+		if _, err := a.RotateIntermediate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// Root returns the root CA certificate
+func (a *Authority) Root() *x509.Certificate {
+	return a.root
+}
+
+// ActiveIntermediate returns the intermediate which currently signs leaves
+func (a *Authority) ActiveIntermediate() Intermediate {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.intermediates[a.active]
+}
+
+// Intermediates returns every intermediate known to the authority which has not yet expired
+func (a *Authority) Intermediates() []*x509.Certificate {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	now := time.Now()
+	var result []*x509.Certificate
+	for _, in := range a.intermediates {
+		if now.Before(in.Certificate.NotAfter) {
+			result = append(result, in.Certificate)
+		}
+	}
+	return result
+}
+
+// OnRotate registers a func which is called with the new intermediate every time one becomes active, e.g. to have
+// clients renew the leaves signed by the old one
+func (a *Authority) OnRotate(fn func(Intermediate)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.onRotate = append(a.onRotate, fn)
+}
+
+// RotateIntermediate mints a new intermediate and makes it the active signer.  Older intermediates stay
+// valid until they expire, so leaves signed by them keep verifying.
+func (a *Authority) RotateIntermediate() (Intermediate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Intermediate{}, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return Intermediate{}, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(a.config.IntermediateValidity)
+	if notAfter.After(a.root.NotAfter) {
+		notAfter = a.root.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: a.config.IntermediateCommonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.root, key.Public(), a.rootKey)
+	if err != nil {
+		return Intermediate{}, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Intermediate{}, err
+	}
+
+	in := Intermediate{Certificate: cert, PrivateKey: key}
+
+	onRotate, err := a.activate(in)
+	if err != nil {
+		return Intermediate{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"Serial":   serial.Text(16),
+		"NotAfter": notAfter,
+	}).Info("Rotated to a new intermediate CA")
+
+	for _, fn := range onRotate {
+		fn(in)
+	}
+
+	return in, nil
+}
+
+// activate saves a new intermediate and makes it the active one, returning the funcs to tell about it.  The active file
+// and the active intermediate are changed under the same lock, so concurrent rotations can't leave them pointing at
+// different intermediates.
+func (a *Authority) activate(in Intermediate) ([]func(Intermediate), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.config.Dir != "" {
+		serial := in.Certificate.SerialNumber.Text(16)
+		base := filepath.Join(a.config.Dir, intermediateDirName, serial)
+		if err := writeKeyPair(base+".pem", base+"-key.pem", in.Certificate, in.PrivateKey); err != nil {
+			return nil, err
+		}
+
+		activePath := filepath.Join(a.config.Dir, intermediateDirName, activeFile)
+		if err := ioutil.WriteFile(activePath, []byte(serial+"\n"), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	a.intermediates = append(a.intermediates, in)
+	a.active = len(a.intermediates) - 1
+
+	return a.onRotate, nil
+}
+
+// SignCertificate signs the template with the active intermediate, returning the leaf and the chain up to (but not including) the root.
+// An intermediate which is within RotateBefore of expiring is rotated out first.
+func (a *Authority) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, [][]byte, error) {
+	if err := a.rotateIfExpiring(); err != nil {
+		// The current intermediate can still be used, as long as it hasn't expired
+		log.Error("Unable to rotate the expiring intermediate CA: ", err)
+	}
+
+	in := a.ActiveIntermediate()
+	if !time.Now().Before(in.Certificate.NotAfter) {
+		return nil, nil, ErrIntermediateExpired
+	}
+
+	// A leaf can never outlive the intermediate that signed it.  The clamp is made to a copy, as the template is the caller's.
+	leaf := *template
+	if leaf.NotAfter.After(in.Certificate.NotAfter) {
+		leaf.NotAfter = in.Certificate.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &leaf, in.Certificate, pub, in.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return der, [][]byte{in.Certificate.Raw}, nil
+}
+
+// rotateIfExpiring rotates to a new intermediate when the active one is within RotateBefore of expiring
+func (a *Authority) rotateIfExpiring() error {
+	if !a.expiring(a.ActiveIntermediate()) {
+		return nil
+	}
+
+	a.rotateMu.Lock()
+	defer a.rotateMu.Unlock()
+
+	// Another signer may have rotated it while this one waited
+	if !a.expiring(a.ActiveIntermediate()) {
+		return nil
+	}
+
+	_, err := a.RotateIntermediate()
+	return err
+}
+
+// expiring reports whether an intermediate is due to be rotated out.  Intermediates can't outlive the root, so one which
+// already expires with the root is kept, as a new one wouldn't last any longer.
+func (a *Authority) expiring(in Intermediate) bool {
+	notAfter := in.Certificate.NotAfter
+	return time.Until(notAfter) < a.config.RotateBefore && notAfter.Before(a.root.NotAfter)
+}
+
+// loadRoot loads the root from disk, reporting whether one was found
+func (a *Authority) loadRoot() (bool, error) {
+	if a.config.Dir == "" {
+		return false, nil
+	}
+
+	certPath := filepath.Join(a.config.Dir, rootCertFile)
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	cert, key, err := readKeyPair(certPath, filepath.Join(a.config.Dir, rootKeyFile))
+	if err != nil {
+		return false, err
+	}
+
+	a.root = cert
+	a.rootKey = key
+	return true, nil
+}
+
+// generateRoot creates a new self-signed root, saving it to disk if configured to
+func (a *Authority) generateRoot() error {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: a.config.RootCommonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(a.config.RootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	if a.config.Dir != "" {
+		err := writeKeyPair(filepath.Join(a.config.Dir, rootCertFile), filepath.Join(a.config.Dir, rootKeyFile), cert, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.root = cert
+	a.rootKey = key
+	return nil
+}
+
+// loadIntermediates loads every intermediate issued by the root from disk, making the newest unexpired one active
+func (a *Authority) loadIntermediates() error {
+	if a.config.Dir == "" {
+		return nil
+	}
+
+	dir := filepath.Join(a.config.Dir, intermediateDirName)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var loaded []Intermediate
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".pem") || strings.HasSuffix(name, "-key.pem") {
+			continue
+		}
+
+		base := strings.TrimSuffix(name, ".pem")
+		cert, key, err := readKeyPair(filepath.Join(dir, name), filepath.Join(dir, base+"-key.pem"))
+		if err != nil {
+			return err
+		}
+
+		if err := cert.CheckSignatureFrom(a.root); err != nil {
+			log.WithFields(log.Fields{
+				"File": name,
+			}).Warn("Ignoring intermediate which was not issued by the root CA")
+			continue
+		}
+
+		loaded = append(loaded, Intermediate{Certificate: cert, PrivateKey: key})
+	}
+
+	sort.SliceStable(loaded, func(i, j int) bool {
+		return loaded[i].Certificate.NotBefore.Before(loaded[j].Certificate.NotBefore)
+	})
+
+	a.intermediates = loaded
+	a.active = -1
+
+	// Prefer the intermediate that was recorded as active, as certificate times only have second precision
+	activeSerial, _ := ioutil.ReadFile(filepath.Join(dir, activeFile))
+	now := time.Now()
+	for i := len(loaded) - 1; i >= 0; i-- {
+		if !now.Before(loaded[i].Certificate.NotAfter) {
+			continue
+		}
+		if a.active < 0 {
+			a.active = i
+		}
+		if loaded[i].Certificate.SerialNumber.Text(16) == strings.TrimSpace(string(activeSerial)) {
+			a.active = i
+			break
+		}
+	}
+
+	return nil
+}
+
+// withDefaults fills in any settings which were left empty
+func withDefaults(cfg Config) Config {
+	if cfg.RootCommonName == "" {
+		cfg.RootCommonName = DefaultRootCommonName
+	}
+	if cfg.IntermediateCommonName == "" {
+		cfg.IntermediateCommonName = DefaultIntermediateCommonName
+	}
+	if cfg.RootValidity <= 0 {
+		cfg.RootValidity = DefaultRootValidity
+	}
+	if cfg.IntermediateValidity <= 0 {
+		cfg.IntermediateValidity = DefaultIntermediateValidity
+	}
+	if cfg.RotateBefore <= 0 {
+		cfg.RotateBefore = cfg.IntermediateValidity / 3
+	}
+	return cfg
+}
+
+// readKeyPair reads a PEM encoded certificate and private key from disk
+func readKeyPair(certPath string, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := certs.ParseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := certs.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// writeKeyPair writes a certificate and its private key to disk, keeping the key readable only by its owner
+func writeKeyPair(certPath string, keyPath string, cert *x509.Certificate, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+}
+
+// randomSerialNumber generates a random 128 bit certificate serial number
+func randomSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
@@ -0,0 +1,218 @@
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+// issueAndVerify issues a leaf through the X509CertIssuer and verifies it against the authority's root
+func issueAndVerify(t *testing.T, a *Authority, hostname string) *x509.Certificate {
+	issuer := certs.X509CertIssuer{Signer: a}
+
+	cert, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: hostname})
+	assert.Nil(t, err, "Issuing a certificate shouldn't fail")
+
+	leaf, err := certs.ParseCertificatePEM([]byte(cert.CertificateBody))
+	assert.Nil(t, err, "The certificate body should be PEM encoded")
+
+	intermediate, err := certs.ParseCertificatePEM([]byte(cert.CertificateChain))
+	assert.Nil(t, err, "The chain should contain the intermediate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(a.Root())
+	inters := x509.NewCertPool()
+	inters.AddCert(intermediate)
+
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots, Intermediates: inters})
+	assert.Nil(t, err, "The leaf should verify against the root using the served chain")
+
+	return intermediate
+}
+
+func TestLoadOrCreateInMemory(t *testing.T) {
+	a, err := LoadOrCreate(Config{})
+	assert.Nil(t, err, "Creating an in-memory authority shouldn't fail")
+	assert.True(t, a.Root().IsCA, "The root should be a CA")
+	assert.Len(t, a.Intermediates(), 1, "A new authority should have one intermediate")
+
+	issueAndVerify(t, a, "fooyork.com")
+}
+
+func TestRotateIntermediate(t *testing.T) {
+	a, _ := LoadOrCreate(Config{})
+
+	before := issueAndVerify(t, a, "before.com")
+
+	_, err := a.RotateIntermediate()
+	assert.Nil(t, err, "Rotating the intermediate shouldn't fail")
+
+	after := issueAndVerify(t, a, "after.com")
+
+	assert.NotEqual(t, before.SerialNumber, after.SerialNumber, "Leaves should be signed by the new intermediate")
+	assert.Len(t, a.Intermediates(), 2, "The old intermediate should still be valid")
+}
+
+func TestOnRotate(t *testing.T) {
+	a, _ := LoadOrCreate(Config{})
+
+	var rotatedTo []Intermediate
+	a.OnRotate(func(in Intermediate) {
+		rotatedTo = append(rotatedTo, in)
+	})
+
+	in, err := a.RotateIntermediate()
+	assert.Nil(t, err)
+	if assert.Len(t, rotatedTo, 1, "Rotating should call the registered func") {
+		assert.Equal(t, in.Certificate.Raw, rotatedTo[0].Certificate.Raw, "The func should be given the new intermediate")
+		assert.Equal(t, in.Certificate.Raw, a.ActiveIntermediate().Certificate.Raw, "The new intermediate should already be active")
+	}
+}
+
+func TestLoadOrCreateFromDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certsman-ca")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	first, err := LoadOrCreate(Config{Dir: dir})
+	assert.Nil(t, err, "Creating an authority on disk shouldn't fail")
+	first.RotateIntermediate()
+
+	second, err := LoadOrCreate(Config{Dir: dir})
+	assert.Nil(t, err, "Loading the authority from disk shouldn't fail")
+
+	assert.Equal(t, first.Root().Raw, second.Root().Raw, "The root should be loaded from disk")
+	assert.Equal(t, first.ActiveIntermediate().Certificate.Raw, second.ActiveIntermediate().Certificate.Raw, "The newest intermediate should be active")
+	assert.Len(t, second.Intermediates(), 2, "Every intermediate should be loaded from disk")
+
+	info, err := os.Stat(dir + "/" + rootKeyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "The root key should only be readable by its owner")
+}
+
+func TestLeafDoesNotOutliveIntermediate(t *testing.T) {
+	a, _ := LoadOrCreate(Config{IntermediateValidity: time.Hour})
+	issuer := certs.X509CertIssuer{Signer: a, Validity: time.Hour * 48}
+
+	cert, _ := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	leaf, _ := certs.ParseCertificatePEM([]byte(cert.CertificateBody))
+
+	assert.False(t, leaf.NotAfter.After(a.ActiveIntermediate().Certificate.NotAfter), "The leaf should be clamped to the intermediate")
+}
+
+func TestSignCertificateLeavesTemplateAlone(t *testing.T) {
+	a, _ := LoadOrCreate(Config{IntermediateValidity: time.Hour})
+
+	notAfter := time.Now().Add(time.Hour * 48)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fooyork.com"},
+		DNSNames:     []string{"fooyork.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     notAfter,
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	der, _, err := a.SignCertificate(template, key.Public())
+	assert.Nil(t, err)
+	leaf, _ := x509.ParseCertificate(der)
+
+	assert.True(t, leaf.NotAfter.Before(notAfter), "The leaf should be clamped to the intermediate")
+	assert.Equal(t, notAfter, template.NotAfter, "The caller's template shouldn't be changed")
+}
+
+func TestConcurrentRotationsOnDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certsman-ca")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := LoadOrCreate(Config{Dir: dir})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.RotateIntermediate()
+		}()
+	}
+	wg.Wait()
+
+	reloaded, err := LoadOrCreate(Config{Dir: dir})
+	assert.Nil(t, err)
+	assert.Equal(t, a.ActiveIntermediate().Certificate.Raw, reloaded.ActiveIntermediate().Certificate.Raw, "The intermediate active on disk should be the one which was active in memory")
+}
+
+// activateExpiredIntermediate makes an intermediate which has already expired the active one
+func activateExpiredIntermediate(t *testing.T, a *Authority) Intermediate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "expired intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour * 48),
+		NotAfter:              time.Now().Add(-time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.root, key.Public(), a.rootKey)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+
+	in := Intermediate{Certificate: cert, PrivateKey: key}
+	a.mu.Lock()
+	a.intermediates = append(a.intermediates, in)
+	a.active = len(a.intermediates) - 1
+	a.mu.Unlock()
+	return in
+}
+
+func TestSignCertificateRotatesExpiredIntermediate(t *testing.T) {
+	a, _ := LoadOrCreate(Config{})
+	expired := activateExpiredIntermediate(t, a)
+
+	var rotated bool
+	a.OnRotate(func(Intermediate) {
+		rotated = true
+	})
+
+	issueAndVerify(t, a, "fooyork.com")
+	assert.True(t, rotated, "Signing should have rotated out the expired intermediate")
+	assert.NotEqual(t, expired.Certificate.Raw, a.ActiveIntermediate().Certificate.Raw)
+}
+
+func TestSignCertificateRotatesExpiringIntermediate(t *testing.T) {
+	a, _ := LoadOrCreate(Config{IntermediateValidity: time.Hour * 3, RotateBefore: time.Hour})
+	first := a.ActiveIntermediate()
+
+	issueAndVerify(t, a, "fooyork.com")
+	assert.Equal(t, first.Certificate.Raw, a.ActiveIntermediate().Certificate.Raw, "An intermediate with time left shouldn't be rotated")
+
+	a.config.RotateBefore = time.Hour * 4
+	issueAndVerify(t, a, "fooyork.com")
+	assert.NotEqual(t, first.Certificate.Raw, a.ActiveIntermediate().Certificate.Raw, "An intermediate close to expiring should be rotated")
+}
+
+func TestSignCertificateRefusesExpiredIntermediate(t *testing.T) {
+	// The intermediate can't outlive the root, so once the root has expired there is nothing to rotate to
+	a, err := LoadOrCreate(Config{RootValidity: time.Millisecond})
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 5)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, _, err = a.SignCertificate(&x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}, key.Public())
+	assert.Equal(t, ErrIntermediateExpired, err, "Leaves shouldn't be signed by an expired intermediate")
+}
@@ -0,0 +1,702 @@
+/*
+The ACMEIssuer is a CertificateIssuer which gets certificates from an upstream ACME CA, such as Let's Encrypt.
+It registers an account, orders the certificate, solves the challenges for it through pluggable solvers, then
+finalizes the order and downloads the certificate.
+*/
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/acme"
+	"github.com/devnulled/certsman/pkg/certsman"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultACMEPollInterval is how often the ACME issuer checks on authorizations and orders when no interval is configured
+const DefaultACMEPollInterval = time.Second
+
+// ACMEHTTP01Path is the path http-01 challenge responses are fetched from by the CA
+const ACMEHTTP01Path = "/.well-known/acme-challenge/"
+
+// How many times a request is retried when the CA rejects its nonce
+const maxACMENonceRetries = 3
+
+// Most bytes read from any response from the CA
+const maxACMEResponseBytes = 1024 * 1024
+
+// ACMESolver fulfils one type of ACME challenge, e.g. by serving http-01 responses or publishing dns-01 records
+type ACMESolver interface {
+	// ChallengeType is the type of challenge solved, e.g. http-01
+	ChallengeType() string
+	// Present makes the response to a challenge available to the CA
+	Present(ctx context.Context, identifier string, token string, keyAuthorization string) error
+	// CleanUp removes the response once the challenge is over
+	CleanUp(ctx context.Context, identifier string, token string, keyAuthorization string) error
+}
+
+// ACMEError is a problem document the CA responded with
+type ACMEError struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (e *ACMEError) Error() string {
+	return fmt.Sprintf("acme: %s: %s", e.Type, e.Detail)
+}
+
+// ACMEIssuer issues certificates from an upstream ACME CA.  Its account is registered the first time it issues one.
+type ACMEIssuer struct {
+	// URL of the CA's directory
+	DirectoryURL string
+	// Solvers for the challenges the CA may offer.  The first solver for one of an authorization's challenges is used.
+	Solvers []ACMESolver
+	// Contacts registered with the account, e.g. mailto:admin@example.com
+	Contact []string
+	// Whether the CA's terms of service are agreed to.  Registration fails if the CA has terms which aren't.
+	AgreeToTerms bool
+	// Key the account is registered with.  A new key, and so a new account, is generated if it is nil.
+	AccountKey *ecdsa.PrivateKey
+	// Client requests are made with.  Nil uses http.DefaultClient.
+	HTTPClient *http.Client
+	// How often authorizations and orders are checked on while the CA is working on them
+	PollInterval time.Duration
+	// Algorithm of the keys generated for requests which don't ask for one.  Empty is DefaultKeyAlgorithm.
+	KeyAlgorithm string
+
+	// Guards registering the account, which only happens once
+	accountMu sync.Mutex
+	directory acmeDirectory
+	kid       string
+
+	// Guards the nonces handed out by the CA, which are each used for one request
+	nonceMu sync.Mutex
+	nonces  []string
+}
+
+// acmeDirectory is the CA's directory of resource URLs
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	Meta       struct {
+		TermsOfService string `json:"termsOfService"`
+	} `json:"meta"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string     `json:"status"`
+	Authorizations []string   `json:"authorizations"`
+	Finalize       string     `json:"finalize"`
+	Certificate    string     `json:"certificate"`
+	Error          *ACMEError `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string     `json:"type"`
+	URL    string     `json:"url"`
+	Token  string     `json:"token"`
+	Status string     `json:"status"`
+	Error  *ACMEError `json:"error"`
+}
+
+// IssueCertificate gets a certificate for the requested hostname from the CA
+func (a *ACMEIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return a.IssueCertificateContext(context.Background(), req)
+}
+
+// IssueCertificateContext gets a certificate for the requested hostname and names from the CA, giving up once ctx is done.
+// A new key pair is generated for the certificate, unless the request has a CSR, in which case the certificate is
+// issued for the CSR's key and names and has no private key.
+func (a *ACMEIssuer) IssueCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if err := a.ensureAccount(ctx); err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	var key crypto.Signer
+	csr := req.CSR
+	if csr == nil {
+		alg := req.KeyAlgorithm
+		if alg == "" {
+			alg = a.KeyAlgorithm
+		}
+
+		var err error
+		key, err = GenerateKey(alg)
+		if err != nil {
+			return certsman.Certificate{}, err
+		}
+		if csr, err = newNamesCSR(req.SubjectNames(), key); err != nil {
+			return certsman.Certificate{}, err
+		}
+	}
+
+	var identifiers []acmeIdentifier
+	for _, name := range csr.DNSNames {
+		identifiers = append(identifiers, acmeIdentifier{Type: "dns", Value: name})
+	}
+	for _, ip := range csr.IPAddresses {
+		identifiers = append(identifiers, acmeIdentifier{Type: "ip", Value: ip.String()})
+	}
+	if len(identifiers) == 0 {
+		return certsman.Certificate{}, errors.New("certificate request has no names")
+	}
+
+	var order acmeOrder
+	resp, err := a.post(ctx, a.directory.NewOrder, map[string]interface{}{"identifiers": identifiers}, &order)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+	orderURL := resp.header.Get("Location")
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+		"Order":     orderURL,
+	}).Debug("Created ACME order for ", req.Hostname)
+
+	for _, authzURL := range order.Authorizations {
+		if err := a.authorize(ctx, authzURL); err != nil {
+			return certsman.Certificate{}, err
+		}
+	}
+
+	if err := a.pollOrder(ctx, orderURL, &order, "pending"); err != nil {
+		return certsman.Certificate{}, err
+	}
+	if order.Status != "ready" {
+		return certsman.Certificate{}, orderError(order)
+	}
+
+	if _, err := a.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr.Raw)}, &order); err != nil {
+		return certsman.Certificate{}, err
+	}
+	if err := a.pollOrder(ctx, orderURL, &order, "processing"); err != nil {
+		return certsman.Certificate{}, err
+	}
+	if order.Status != "valid" {
+		return certsman.Certificate{}, orderError(order)
+	}
+
+	resp, err = a.post(ctx, order.Certificate, nil, nil)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	cert, err := parseACMECertificate(req.Hostname, resp.body, csr)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	cert.KeyAlgorithm = certsman.KeyAlgorithmOf(csr.PublicKey)
+	if key != nil {
+		if cert.PrivateKey, err = marshalPrivateKeyPEM(key); err != nil {
+			return certsman.Certificate{}, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+		"NotAfter":  cert.NotAfter,
+	}).Info("ACME certificate issued for ", req.Hostname)
+
+	return cert, nil
+}
+
+// ensureAccount fetches the CA's directory and registers the account, unless that has already been done
+func (a *ACMEIssuer) ensureAccount(ctx context.Context) error {
+	a.accountMu.Lock()
+	defer a.accountMu.Unlock()
+
+	if a.kid != "" {
+		return nil
+	}
+
+	if a.directory.NewAccount == "" {
+		httpReq, err := http.NewRequestWithContext(ctx, "GET", a.DirectoryURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := a.do(httpReq)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(resp.body, &a.directory); err != nil {
+			return fmt.Errorf("acme: directory is not valid JSON: %v", err)
+		}
+	}
+
+	if a.directory.Meta.TermsOfService != "" && !a.AgreeToTerms {
+		return fmt.Errorf("acme: the terms of service at %s must be agreed to", a.directory.Meta.TermsOfService)
+	}
+
+	if a.AccountKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		a.AccountKey = key
+	}
+
+	account := map[string]interface{}{
+		"contact":              a.Contact,
+		"termsOfServiceAgreed": a.AgreeToTerms,
+	}
+	resp, err := a.postAs(ctx, a.directory.NewAccount, account, nil, true)
+	if err != nil {
+		return err
+	}
+
+	a.kid = resp.header.Get("Location")
+	if a.kid == "" {
+		return errors.New("acme: account was registered without a URL")
+	}
+
+	log.WithFields(log.Fields{
+		"Account": a.kid,
+	}).Info("Registered ACME account")
+	return nil
+}
+
+// authorize solves one of an authorization's challenges, unless it is already valid
+func (a *ACMEIssuer) authorize(ctx context.Context, authzURL string) error {
+	var authz acmeAuthorization
+	if _, err := a.post(ctx, authzURL, nil, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	solver, chall := a.solverFor(authz)
+	if solver == nil {
+		return fmt.Errorf("acme: no solver for any of the challenges for %s", authz.Identifier.Value)
+	}
+
+	jwk, err := acme.NewJSONWebKey(a.AccountKey.Public())
+	if err != nil {
+		return err
+	}
+	thumbprint, err := jwk.Thumbprint()
+	if err != nil {
+		return err
+	}
+
+	keyAuthorization := chall.Token + "." + thumbprint
+	if err := solver.Present(ctx, authz.Identifier.Value, chall.Token, keyAuthorization); err != nil {
+		return err
+	}
+	defer func() {
+		// The challenge is over either way, so clean up even if ctx is done
+		if err := solver.CleanUp(context.Background(), authz.Identifier.Value, chall.Token, keyAuthorization); err != nil {
+			log.WithFields(log.Fields{
+				"Identifier": authz.Identifier.Value,
+			}).Warn("Unable to clean up ACME challenge: ", err)
+		}
+	}()
+
+	if _, err := a.post(ctx, chall.URL, struct{}{}, nil); err != nil {
+		return err
+	}
+
+	for authz.Status == "pending" {
+		if err := a.wait(ctx); err != nil {
+			return err
+		}
+		if _, err := a.post(ctx, authzURL, nil, &authz); err != nil {
+			return err
+		}
+	}
+
+	if authz.Status != "valid" {
+		for _, c := range authz.Challenges {
+			if c.Error != nil {
+				return c.Error
+			}
+		}
+		return fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	return nil
+}
+
+// solverFor picks the first solver for one of the authorization's challenges
+func (a *ACMEIssuer) solverFor(authz acmeAuthorization) (ACMESolver, acmeChallenge) {
+	for _, solver := range a.Solvers {
+		for _, chall := range authz.Challenges {
+			if chall.Type == solver.ChallengeType() {
+				return solver, chall
+			}
+		}
+	}
+	return nil, acmeChallenge{}
+}
+
+// pollOrder fetches the order until it is no longer in the given status
+func (a *ACMEIssuer) pollOrder(ctx context.Context, orderURL string, order *acmeOrder, status string) error {
+	for order.Status == status {
+		if err := a.wait(ctx); err != nil {
+			return err
+		}
+		if _, err := a.post(ctx, orderURL, nil, order); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wait sleeps for the poll interval, unless ctx is done first
+func (a *ACMEIssuer) wait(ctx context.Context) error {
+	interval := a.PollInterval
+	if interval <= 0 {
+		interval = DefaultACMEPollInterval
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(interval):
+		return nil
+	}
+}
+
+// acmeResponse is a response from the CA, which has been read in full
+type acmeResponse struct {
+	header http.Header
+	body   []byte
+}
+
+// post signs the payload with the account key and posts it, decoding the response into v if it isn't nil.
+// A nil payload is a POST-as-GET.
+func (a *ACMEIssuer) post(ctx context.Context, url string, payload interface{}, v interface{}) (acmeResponse, error) {
+	return a.postAs(ctx, url, payload, v, false)
+}
+
+// postAs is post, but registration signs with the account's jwk rather than its URL
+func (a *ACMEIssuer) postAs(ctx context.Context, url string, payload interface{}, v interface{}, useJWK bool) (acmeResponse, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return acmeResponse{}, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		nonce, err := a.nonce(ctx)
+		if err != nil {
+			return acmeResponse{}, err
+		}
+
+		header := acme.JWSHeader{Nonce: nonce, URL: url}
+		if useJWK {
+			jwk, err := acme.NewJSONWebKey(a.AccountKey.Public())
+			if err != nil {
+				return acmeResponse{}, err
+			}
+			header.JWK = &jwk
+		} else {
+			header.KID = a.kid
+		}
+
+		jws, err := acme.SignJWS(a.AccountKey, header, body)
+		if err != nil {
+			return acmeResponse{}, err
+		}
+		signed, err := json.Marshal(jws)
+		if err != nil {
+			return acmeResponse{}, err
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(signed))
+		if err != nil {
+			return acmeResponse{}, err
+		}
+		httpReq.Header.Set("Content-Type", "application/jose+json")
+
+		resp, err := a.do(httpReq)
+		var problem *ACMEError
+		if errors.As(err, &problem) && problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < maxACMENonceRetries {
+			continue
+		}
+		if err != nil {
+			return acmeResponse{}, err
+		}
+
+		if v != nil {
+			if err := json.Unmarshal(resp.body, v); err != nil {
+				return acmeResponse{}, fmt.Errorf("acme: response from %s is not valid JSON: %v", url, err)
+			}
+		}
+		return resp, nil
+	}
+}
+
+// nonce takes a nonce handed out by an earlier response, or gets a new one
+func (a *ACMEIssuer) nonce(ctx context.Context) (string, error) {
+	if nonce, ok := a.takeNonce(); ok {
+		return nonce, nil
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "HEAD", a.directory.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.do(httpReq); err != nil {
+		return "", err
+	}
+
+	if nonce, ok := a.takeNonce(); ok {
+		return nonce, nil
+	}
+	return "", errors.New("acme: no nonce was handed out")
+}
+
+func (a *ACMEIssuer) takeNonce() (string, bool) {
+	a.nonceMu.Lock()
+	defer a.nonceMu.Unlock()
+
+	n := len(a.nonces)
+	if n == 0 {
+		return "", false
+	}
+	nonce := a.nonces[n-1]
+	a.nonces = a.nonces[:n-1]
+	return nonce, true
+}
+
+// do makes a request to the CA, keeping the nonce it hands out.  Problem documents are returned as an *ACMEError.
+func (a *ACMEIssuer) do(httpReq *http.Request) (acmeResponse, error) {
+	client := a.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return acmeResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+		a.nonceMu.Lock()
+		a.nonces = append(a.nonces, nonce)
+		a.nonceMu.Unlock()
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxACMEResponseBytes))
+	if err != nil {
+		return acmeResponse{}, err
+	}
+
+	if resp.StatusCode >= 400 {
+		problem := &ACMEError{Status: resp.StatusCode}
+		if err := json.Unmarshal(body, problem); err != nil || problem.Type == "" {
+			return acmeResponse{}, fmt.Errorf("acme: %s %s responded with %s", httpReq.Method, httpReq.URL, resp.Status)
+		}
+		return acmeResponse{}, problem
+	}
+
+	return acmeResponse{header: resp.Header, body: body}, nil
+}
+
+// orderError describes why an order didn't become ready or valid
+func orderError(order acmeOrder) error {
+	if order.Error != nil {
+		return order.Error
+	}
+	return fmt.Errorf("acme: order is %s", order.Status)
+}
+
+// newNamesCSR creates a CSR for the names, which may be IP addresses.  The first name is also the common name.
+func newNamesCSR(names []string, key crypto.Signer) (*x509.CertificateRequest, error) {
+	if len(names) == 0 {
+		return nil, errors.New("certificate request has no names")
+	}
+
+	template := &x509.CertificateRequest{Subject: pkix.Name{CommonName: names[0]}}
+	template.DNSNames, template.IPAddresses = certsman.SplitNames(names)
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificateRequest(der)
+}
+
+// parseACMECertificate splits the PEM chain downloaded from the CA into the certificate and its intermediates, checking
+// the certificate is for the CSR
+func parseACMECertificate(hostname string, chain []byte, csr *x509.CertificateRequest) (certsman.Certificate, error) {
+	block, rest := pem.Decode(chain)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return certsman.Certificate{}, errors.New("acme: downloaded certificate is not PEM")
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+	if err := checkACMECertificate(leaf, csr); err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	return certsman.Certificate{
+		Hostname:         hostname,
+		CertificateBody:  string(pem.EncodeToMemory(block)),
+		CertificateChain: strings.TrimLeft(string(rest), "\n"),
+		NotBefore:        leaf.NotBefore,
+		NotAfter:         leaf.NotAfter,
+	}, nil
+}
+
+// checkACMECertificate checks the certificate the CA issued is for the CSR's key and exactly the CSR's names, so a CA
+// which gets an order wrong can't hand back a certificate the key can't be used with, or for names nobody asked for
+func checkACMECertificate(leaf *x509.Certificate, csr *x509.CertificateRequest) error {
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(csr.PublicKey) {
+		return errors.New("acme: downloaded certificate is not for the requested key")
+	}
+
+	leafNames := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		leafNames = append(leafNames, ip.String())
+	}
+	if !sameNames(leafNames, certsman.CSRNames(csr)) {
+		return fmt.Errorf("acme: downloaded certificate is for %s, not the requested %s", strings.Join(leafNames, ", "), strings.Join(certsman.CSRNames(csr), ", "))
+	}
+	return nil
+}
+
+// sameNames reports whether both lists hold the same names, in any order or spelling
+func sameNames(a []string, b []string) bool {
+	set := make(map[string]bool)
+	for _, name := range a {
+		set[certsman.NormalizeName(name)] = true
+	}
+
+	other := make(map[string]bool)
+	for _, name := range b {
+		name = certsman.NormalizeName(name)
+		if !set[name] {
+			return false
+		}
+		other[name] = true
+	}
+	return len(other) == len(set)
+}
+
+// LoadOrCreateACMEAccountKey loads the P-256 account key PEM encoded at path, generating and saving one if there isn't one
+func LoadOrCreateACMEAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("%s is not a P-256 key", path)
+	}
+	return key, nil
+}
+
+// HTTP01Solver solves http-01 challenges by serving their key authorizations.  The CA fetches them from
+// ACMEHTTP01Path on port 80 of each hostname, so it must be served there.  The zero value is ready to use.
+type HTTP01Solver struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+// ChallengeType is http-01
+func (h *HTTP01Solver) ChallengeType() string {
+	return acme.ChallengeHTTP01
+}
+
+// Present starts serving the key authorization for the token
+func (h *HTTP01Solver) Present(ctx context.Context, identifier string, token string, keyAuthorization string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tokens == nil {
+		h.tokens = make(map[string]string)
+	}
+	h.tokens[token] = keyAuthorization
+	return nil
+}
+
+// CleanUp stops serving the key authorization for the token
+func (h *HTTP01Solver) CleanUp(ctx context.Context, identifier string, token string, keyAuthorization string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.tokens, token)
+	return nil
+}
+
+// ServeHTTP responds to the CA's request for a token with its key authorization
+func (h *HTTP01Solver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, ACMEHTTP01Path)
+
+	h.mu.RLock()
+	keyAuthorization, ok := h.tokens[token]
+	h.mu.RUnlock()
+
+	if !ok || token == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write([]byte(keyAuthorization))
+}
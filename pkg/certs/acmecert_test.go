@@ -0,0 +1,292 @@
+package certs_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/devnulled/certsman/pkg/acme"
+	"github.com/devnulled/certsman/pkg/ca"
+	"github.com/devnulled/certsman/pkg/certs"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+)
+
+// upstreamCA is a stand-in for an upstream ACME CA, which is certsman's own ACME server validating http-01
+// challenges against a local responder
+type upstreamCA struct {
+	authority *ca.Authority
+	server    *httptest.Server
+	responder *httptest.Server
+	solver    *certs.HTTP01Solver
+	// Issues the CA's certificates, which tests can swap out
+	svc *certsman.CerfificateService
+}
+
+func newUpstreamCA(t *testing.T, cfg acme.Config) *upstreamCA {
+	authority, err := ca.LoadOrCreate(ca.Config{})
+	assert.Nil(t, err)
+
+	u := &upstreamCA{authority: authority, solver: &certs.HTTP01Solver{}}
+	u.responder = httptest.NewServer(u.solver)
+
+	if cfg.Validators == nil {
+		cfg.Validators = map[string]acme.Validator{
+			acme.ChallengeHTTP01: &acme.HTTP01Validator{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, u.responder.Listener.Addr().String())
+				},
+			},
+		}
+	}
+
+	u.svc = &certsman.CerfificateService{
+		Issuer:      certs.X509CertIssuer{Signer: authority, Validity: time.Hour},
+		Persistence: &storage.InMemStorage{Cache: gcache.New(10).Build()},
+	}
+	r := mux.NewRouter()
+	acme.NewServer(u.svc, &storage.InMemAccountStorage{}, cfg).RegisterRoutes(r)
+	u.server = httptest.NewServer(r)
+
+	return u
+}
+
+func (u *upstreamCA) Close() {
+	u.server.Close()
+	u.responder.Close()
+}
+
+func (u *upstreamCA) issuer() *certs.ACMEIssuer {
+	return &certs.ACMEIssuer{
+		DirectoryURL: u.server.URL + acme.DefaultPathPrefix + "/directory",
+		Solvers:      []certs.ACMESolver{u.solver},
+		Contact:      []string{"mailto:admin@fooyork.com"},
+		PollInterval: time.Millisecond * 10,
+	}
+}
+
+// verify checks the certificate chains up to the CA's root
+func (u *upstreamCA) verify(t *testing.T, cert certsman.Certificate, hostname string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(cert.CertificateBody))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(u.authority.Root())
+	intermediates := x509.NewCertPool()
+	assert.True(t, intermediates.AppendCertsFromPEM([]byte(cert.CertificateChain)), "The chain should be included")
+
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: hostname, Roots: roots, Intermediates: intermediates})
+	assert.Nil(t, err, "The certificate should verify up to the CA's root")
+	return leaf
+}
+
+func TestACMEIssueCertificate(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{})
+	defer upstream.Close()
+
+	issuer := upstream.issuer()
+	cert, err := issuer.IssueCertificate(certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"})
+	assert.Nil(t, err, "Issuing through the upstream CA shouldn't fail")
+	assert.Equal(t, "fooyork.com", cert.Hostname)
+
+	leaf := upstream.verify(t, cert, "fooyork.com")
+	assert.True(t, leaf.NotAfter.Equal(cert.NotAfter))
+
+	block, _ := pem.Decode([]byte(cert.PrivateKey))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	assert.Nil(t, err, "The generated key should be returned")
+	assert.Equal(t, key.(*ecdsa.PrivateKey).Public(), leaf.PublicKey, "The certificate should be for the generated key")
+
+	second, err := issuer.IssueCertificate(certsman.CertificateRequest{RequestID: "blah", Hostname: "www.fooyork.com"})
+	assert.Nil(t, err, "The account should be reused for the next certificate")
+	upstream.verify(t, second, "www.fooyork.com")
+
+	resp, _ := http.Get(upstream.responder.URL + certs.ACMEHTTP01Path + "anything")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Challenge responses should be cleaned up")
+}
+
+func TestACMEIssueCertificateForCSR(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{})
+	defer upstream.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "fooyork.com"},
+		DNSNames: []string{"fooyork.com", "www.fooyork.com"},
+	}, key)
+	csr, _ := x509.ParseCertificateRequest(der)
+
+	cert, err := upstream.issuer().IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", CSR: csr})
+	assert.Nil(t, err)
+	assert.Empty(t, cert.PrivateKey, "The requester holds the key")
+
+	leaf := upstream.verify(t, cert, "www.fooyork.com")
+	assert.Equal(t, key.Public(), leaf.PublicKey, "The certificate should be for the CSR's key")
+}
+
+// tamperingIssuer issues certificates for a changed CSR, like a CA which gets the order wrong
+type tamperingIssuer struct {
+	issuer certsman.CertificateIssuer
+	tamper func(csr *x509.CertificateRequest) *x509.CertificateRequest
+}
+
+func (i tamperingIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	req.CSR = i.tamper(req.CSR)
+	return i.issuer.IssueCertificate(req)
+}
+
+func TestACMEIssueCertificateMustMatchCSR(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{})
+	defer upstream.Close()
+	issuer := upstream.svc.Issuer
+
+	upstream.svc.Issuer = tamperingIssuer{issuer: issuer, tamper: func(csr *x509.CertificateRequest) *x509.CertificateRequest {
+		otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: csr.DNSNames}, otherKey)
+		other, _ := x509.ParseCertificateRequest(der)
+		return other
+	}}
+	_, err := upstream.issuer().IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "A certificate for another key should be rejected")
+
+	upstream.svc.Issuer = tamperingIssuer{issuer: issuer, tamper: func(csr *x509.CertificateRequest) *x509.CertificateRequest {
+		dropped := *csr
+		dropped.DNSNames = csr.DNSNames[:1]
+		return &dropped
+	}}
+	_, err = upstream.issuer().IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", Names: []string{"www.fooyork.com"}})
+	assert.NotNil(t, err, "A certificate missing a requested name should be rejected")
+
+	upstream.svc.Issuer = tamperingIssuer{issuer: issuer, tamper: func(csr *x509.CertificateRequest) *x509.CertificateRequest {
+		added := *csr
+		added.DNSNames = append(append([]string{}, csr.DNSNames...), "evil.com")
+		return &added
+	}}
+	_, err = upstream.issuer().IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "A certificate for names which weren't requested should be rejected")
+}
+
+func TestACMEIssueCertificateChallengeFails(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{
+		Validators: map[string]acme.Validator{
+			acme.ChallengeHTTP01: acme.ValidatorFunc(func(ctx context.Context, identifier acme.Identifier, token string, keyAuthorization string) error {
+				return &acme.Problem{Type: acme.ErrorIncorrectResponse, Detail: "wrong key authorization", Status: http.StatusForbidden}
+			}),
+		},
+	})
+	defer upstream.Close()
+
+	_, err := upstream.issuer().IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	acmeErr, ok := err.(*certs.ACMEError)
+	assert.True(t, ok, "The CA's problem should be returned")
+	if ok {
+		assert.Equal(t, acme.ErrorIncorrectResponse, acmeErr.Type)
+	}
+}
+
+// dnsSolver claims to solve dns-01 challenges, which the stand-in CA doesn't offer for plain names
+type dnsSolver struct{}
+
+func (dnsSolver) ChallengeType() string { return "dns-01" }
+
+func (dnsSolver) Present(ctx context.Context, identifier string, token string, keyAuthorization string) error {
+	return nil
+}
+
+func (dnsSolver) CleanUp(ctx context.Context, identifier string, token string, keyAuthorization string) error {
+	return nil
+}
+
+func TestACMEIssueCertificateNeedsSolver(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{})
+	defer upstream.Close()
+
+	issuer := upstream.issuer()
+	issuer.Solvers = []certs.ACMESolver{dnsSolver{}}
+
+	_, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "Issuing should fail without a solver for the offered challenges")
+}
+
+func TestACMEIssueCertificateTermsOfService(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{TermsOfService: "https://fooyork.com/tos"})
+	defer upstream.Close()
+
+	issuer := upstream.issuer()
+	_, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "The terms of service shouldn't be agreed to without being asked")
+
+	issuer.AgreeToTerms = true
+	_, err = issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.Nil(t, err)
+}
+
+func TestACMEIssueCertificateCancelled(t *testing.T) {
+	upstream := newUpstreamCA(t, acme.Config{})
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := upstream.issuer().IssueCertificateContext(ctx, certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "A cancelled request shouldn't be issued")
+}
+
+func TestHTTP01Solver(t *testing.T) {
+	solver := &certs.HTTP01Solver{}
+	assert.Equal(t, acme.ChallengeHTTP01, solver.ChallengeType())
+	assert.Nil(t, solver.Present(context.Background(), "fooyork.com", "token", "token.thumbprint"))
+
+	w := httptest.NewRecorder()
+	solver.ServeHTTP(w, httptest.NewRequest(http.MethodGet, certs.ACMEHTTP01Path+"token", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "token.thumbprint", w.Body.String())
+
+	w = httptest.NewRecorder()
+	solver.ServeHTTP(w, httptest.NewRequest(http.MethodGet, certs.ACMEHTTP01Path+"other", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "Unknown tokens shouldn't be served")
+
+	assert.Nil(t, solver.CleanUp(context.Background(), "fooyork.com", "token", "token.thumbprint"))
+	w = httptest.NewRecorder()
+	solver.ServeHTTP(w, httptest.NewRequest(http.MethodGet, certs.ACMEHTTP01Path+"token", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "Cleaned up tokens shouldn't be served")
+}
+
+func TestLoadOrCreateACMEAccountKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certsman-acme")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "account.key")
+	key, err := certs.LoadOrCreateACMEAccountKey(path)
+	assert.Nil(t, err, "A missing key should be generated")
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err, "The generated key should be saved")
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := certs.LoadOrCreateACMEAccountKey(path)
+	assert.Nil(t, err)
+	assert.Equal(t, key.D, loaded.D, "The saved key should be loaded")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("not a key"), 0600))
+	_, err = certs.LoadOrCreateACMEAccountKey(path)
+	assert.NotNil(t, err)
+}
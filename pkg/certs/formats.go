@@ -0,0 +1,150 @@
+/*
+Encodes certificates in the formats clients can ask for, and describes them for the JSON format.
+*/
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// ErrNotX509Certificate is returned when a certificate has to be X.509 to be encoded, but was made by an issuer which
+// doesn't issue X.509 certificates
+var ErrNotX509Certificate = errors.New("certificate is not an X.509 certificate")
+
+// ErrNoPrivateKey is returned when a certificate has to be encoded with its private key, but has none
+var ErrNoPrivateKey = errors.New("certificate has no private key")
+
+// CertificateInfo describes a certificate
+type CertificateInfo struct {
+	// Names the certificate is for
+	Names []string `json:"names"`
+	// Hex encoded serial number, empty if the certificate isn't X.509
+	SerialNumber string `json:"serialNumber,omitempty"`
+	// Distinguished names of the certificate's subject and issuer, empty if the certificate isn't X.509
+	Subject string `json:"subject,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+	// The certificate's validity period
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// One of certsman.KeyAlgorithms, empty if it isn't known
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
+	// Hex encoded fingerprints of the DER encoded certificate, empty if the certificate isn't X.509
+	Fingerprints *Fingerprints `json:"fingerprints,omitempty"`
+}
+
+// Fingerprints of a certificate
+type Fingerprints struct {
+	SHA256 string `json:"sha256"`
+	SHA1   string `json:"sha1"`
+}
+
+// DescribeCertificate describes a certificate.  Certificates which aren't X.509 are described by what certsman knows of
+// them, so only their hostname and validity period.
+func DescribeCertificate(cert certsman.Certificate) CertificateInfo {
+	info := CertificateInfo{
+		Names:        []string{cert.Hostname},
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		KeyAlgorithm: cert.KeyAlgorithm,
+	}
+
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return info
+	}
+
+	info.Names = append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		info.Names = append(info.Names, ip.String())
+	}
+	if len(info.Names) == 0 {
+		info.Names = []string{leaf.Subject.CommonName}
+	}
+	info.SerialNumber = hex.EncodeToString(leaf.SerialNumber.Bytes())
+	info.Subject = leaf.Subject.String()
+	info.Issuer = leaf.Issuer.String()
+	info.NotBefore = leaf.NotBefore
+	info.NotAfter = leaf.NotAfter
+	if info.KeyAlgorithm == "" {
+		info.KeyAlgorithm = certsman.KeyAlgorithmOf(leaf.PublicKey)
+	}
+
+	sha256Sum := sha256.Sum256(leaf.Raw)
+	sha1Sum := sha1.Sum(leaf.Raw)
+	info.Fingerprints = &Fingerprints{
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+		SHA1:   hex.EncodeToString(sha1Sum[:]),
+	}
+
+	return info
+}
+
+// EncodeDER returns the DER encoding of the certificate, without its chain
+func EncodeDER(cert certsman.Certificate) ([]byte, error) {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+	return leaf.Raw, nil
+}
+
+// EncodePKCS12 bundles the certificate, its chain and its private key into a PKCS#12 file encrypted with the password
+func EncodePKCS12(cert certsman.Certificate, password string) ([]byte, error) {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.PrivateKey == "" {
+		return nil, ErrNoPrivateKey
+	}
+	key, err := ParsePrivateKeyPEM([]byte(cert.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := parseCertificatesPEM([]byte(cert.CertificateChain))
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs12.Modern.WithRand(rand.Reader).Encode(key, leaf, chain, password)
+}
+
+// leafCertificate parses the certificate's body, which for X.509 certificates is the PEM encoded leaf
+func leafCertificate(cert certsman.Certificate) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(cert.CertificateBody))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, ErrNotX509Certificate
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseCertificatesPEM parses every PEM encoded certificate in data
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		data = rest
+	}
+}
@@ -0,0 +1,79 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+// issueTestCertificate issues an X.509 certificate for the names from a new local CA
+func issueTestCertificate(t *testing.T, names ...string) (certsman.Certificate, LocalCA) {
+	ca, err := GenerateLocalCA("certsman test CA", time.Hour)
+	assert.Nil(t, err)
+
+	cert, err := X509CertIssuer{Signer: ca}.IssueCertificate(certsman.CertificateRequest{Hostname: names[0], Names: names[1:]})
+	assert.Nil(t, err)
+	return cert, ca
+}
+
+func TestDescribeCertificate(t *testing.T) {
+	cert, ca := issueTestCertificate(t, "fooyork.com", "www.fooyork.com", "10.0.0.1")
+	leaf, _ := ParseCertificatePEM([]byte(cert.CertificateBody))
+
+	info := DescribeCertificate(cert)
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com", "10.0.0.1"}, info.Names)
+	assert.Equal(t, hex.EncodeToString(leaf.SerialNumber.Bytes()), info.SerialNumber)
+	assert.Equal(t, ca.Certificate.Subject.String(), info.Issuer)
+	assert.True(t, leaf.NotAfter.Equal(info.NotAfter))
+	assert.Equal(t, certsman.KeyAlgorithmECDSAP256, info.KeyAlgorithm)
+
+	sum := sha256.Sum256(leaf.Raw)
+	assert.Equal(t, hex.EncodeToString(sum[:]), info.Fingerprints.SHA256)
+	assert.Len(t, info.Fingerprints.SHA1, 40)
+
+	stringCert := certsman.Certificate{Hostname: "fooyork.com", CertificateBody: "foo-fooyork.com", NotAfter: leaf.NotAfter}
+	info = DescribeCertificate(stringCert)
+	assert.Equal(t, []string{"fooyork.com"}, info.Names, "Certificates which aren't X.509 should be described by their hostname")
+	assert.Empty(t, info.SerialNumber)
+	assert.Nil(t, info.Fingerprints)
+}
+
+func TestEncodeDER(t *testing.T) {
+	cert, _ := issueTestCertificate(t, "fooyork.com")
+	leaf, _ := ParseCertificatePEM([]byte(cert.CertificateBody))
+
+	der, err := EncodeDER(cert)
+	assert.Nil(t, err)
+	assert.Equal(t, leaf.Raw, der)
+
+	_, err = EncodeDER(certsman.Certificate{CertificateBody: "foo-fooyork.com"})
+	assert.Equal(t, ErrNotX509Certificate, err)
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	cert, ca := issueTestCertificate(t, "fooyork.com")
+	cert.CertificateChain = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw}))
+
+	pfx, err := EncodePKCS12(cert, "hunter2")
+	assert.Nil(t, err)
+
+	key, leaf, chain, err := pkcs12.DecodeChain(pfx, "hunter2")
+	assert.Nil(t, err, "The bundle should decode with its password")
+	assert.Equal(t, "fooyork.com", leaf.Subject.CommonName)
+	assert.Equal(t, leaf.PublicKey, key.(crypto.Signer).Public())
+	assert.Len(t, chain, 1, "The chain should be in the bundle")
+
+	_, _, _, err = pkcs12.DecodeChain(pfx, "hunter3")
+	assert.NotNil(t, err, "The bundle shouldn't decode with the wrong password")
+
+	cert.PrivateKey = ""
+	_, err = EncodePKCS12(cert, "hunter2")
+	assert.Equal(t, ErrNoPrivateKey, err)
+}
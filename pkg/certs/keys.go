@@ -0,0 +1,51 @@
+/*
+GenerateKey generates the private keys of certificates, in any of the key algorithms certsman supports.
+*/
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// DefaultKeyAlgorithm is the key algorithm used when neither the request nor the issuer picks one
+const DefaultKeyAlgorithm = certsman.KeyAlgorithmECDSAP256
+
+// GenerateKey generates a private key with one of certsman.KeyAlgorithms.  An empty algorithm is DefaultKeyAlgorithm.
+func GenerateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "", certsman.KeyAlgorithmECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case certsman.KeyAlgorithmECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case certsman.KeyAlgorithmRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case certsman.KeyAlgorithmRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case certsman.KeyAlgorithmRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case certsman.KeyAlgorithmEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+
+	return nil, fmt.Errorf("%w: %q", certsman.ErrUnknownKeyAlgorithm, alg)
+}
+
+// marshalPrivateKeyPEM PEM encodes a private key as PKCS#8
+func marshalPrivateKeyPEM(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
@@ -0,0 +1,30 @@
+package certs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, alg := range certsman.KeyAlgorithms {
+		key, err := GenerateKey(alg)
+		assert.Nil(t, err, "Generating a %s key shouldn't fail", alg)
+		assert.Equal(t, alg, certsman.KeyAlgorithmOf(key.Public()), "The key should be a %s key", alg)
+
+		keyPEM, err := marshalPrivateKeyPEM(key)
+		assert.Nil(t, err)
+		parsed, err := ParsePrivateKeyPEM([]byte(keyPEM))
+		assert.Nil(t, err, "A %s key should be PEM encoded", alg)
+		assert.Equal(t, key.Public(), parsed.Public())
+	}
+
+	key, err := GenerateKey("")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultKeyAlgorithm, certsman.KeyAlgorithmOf(key.Public()), "No algorithm should be the default")
+
+	_, err = GenerateKey("dsa1024")
+	assert.True(t, errors.Is(err, certsman.ErrUnknownKeyAlgorithm))
+}
@@ -0,0 +1,153 @@
+/*
+The LocalCA is a simple certificate authority, backed by a single CA certificate and key,
+which signs the certificates produced by the X509CertIssuer.
+*/
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// CertificateSigner provides a contract for anything which can sign a leaf certificate on behalf of an issuer.
+// It returns the DER encoded leaf along with the DER encoded chain of intermediates needed to verify it.
+type CertificateSigner interface {
+	SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, [][]byte, error)
+}
+
+// LocalCA is a CertificateSigner backed by a CA certificate and key which live on this machine
+type LocalCA struct {
+	// The certificate of the CA which signs issued certificates
+	Certificate *x509.Certificate
+	// The private key matching Certificate
+	PrivateKey crypto.Signer
+}
+
+// SignCertificate signs the template with the CA key and returns the DER encoded certificate.
+// The CA certificate is expected to be trusted directly, so no chain is returned.
+func (ca LocalCA) SignCertificate(template *x509.Certificate, pub crypto.PublicKey) ([]byte, [][]byte, error) {
+	if ca.Certificate == nil || ca.PrivateKey == nil {
+		return nil, nil, errors.New("local CA is missing its certificate or private key")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Certificate, pub, ca.PrivateKey)
+	return der, nil, err
+}
+
+// LoadLocalCA loads a PEM encoded CA certificate and private key from disk
+func LoadLocalCA(certFile string, keyFile string) (LocalCA, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	cert, err := ParseCertificatePEM(certPEM)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	return LocalCA{Certificate: cert, PrivateKey: key}, nil
+}
+
+// GenerateLocalCA creates a new self-signed CA, which is mostly useful for development and testing
+func GenerateLocalCA(commonName string, validity time.Duration) (LocalCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return LocalCA{}, err
+	}
+
+	return LocalCA{Certificate: cert, PrivateKey: key}, nil
+}
+
+// ParseCertificatePEM parses the first PEM encoded certificate found in data
+func ParseCertificatePEM(data []byte) (*x509.Certificate, error) {
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM encoded certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+		data = rest
+	}
+}
+
+// ParsePrivateKeyPEM parses the first PEM encoded PKCS#8, PKCS#1 or SEC 1 private key found in data
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM encoded private key found")
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("private key is not a supported signing key")
+			}
+			return signer, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+		data = rest
+	}
+}
+
+// randomSerialNumber generates a random 128 bit certificate serial number
+func randomSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
@@ -1,12 +1,11 @@
 /*
-
 The StringCertIssuer is a CertificateIssuer which provides a certificate based on
 a simple genenrated string.
-
 */
 package certs
 
 import (
+	"context"
 	"strings"
 	"time"
 
@@ -19,17 +18,50 @@ type StringCertIssuer struct {
 	StringPrefix      string
 	SleepEnabled      bool
 	SleepyTimeSeconds time.Duration
+	// How long issued certificates are valid for
+	Validity time.Duration
 }
 
 // IssueCertificate returns a string based certificate
 func (i StringCertIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return i.IssueCertificateContext(context.Background(), req)
+}
+
+// IssueCertificateContext returns a string based certificate, giving up on the artificial sleep once ctx is done
+func (i StringCertIssuer) IssueCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if req.CSR != nil {
+		return certsman.Certificate{}, certsman.ErrCSRNotSupported
+	}
+	if req.KeyAlgorithm != "" {
+		return certsman.Certificate{}, certsman.ErrKeyAlgorithmNotSupported
+	}
+
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+
 	var certBuilder strings.Builder
 	certBuilder.WriteString(i.StringPrefix)
 	certBuilder.WriteString(req.Hostname)
 
+	notBefore, notAfter := certsman.ValidityPeriod(i.Validity)
+
 	cert := certsman.Certificate{
 		Hostname:        req.Hostname,
 		CertificateBody: certBuilder.String(),
+		NotBefore:       notBefore,
+		NotAfter:        notAfter,
+	}
+
+	if i.SleepEnabled == true {
+		// Would run as a go-routine if possible, but that might be cheating?
+		if err := sleepyTime(ctx, i.SleepyTimeSeconds*time.Second, req.Hostname); err != nil {
+			log.WithFields(log.Fields{
+				"RequestID": req.RequestID,
+				"Hostname":  req.Hostname,
+			}).Info("String certificate issuance cancelled for ", req.Hostname)
+			return certsman.Certificate{}, err
+		}
 	}
 
 	log.WithFields(log.Fields{
@@ -37,26 +69,30 @@ func (i StringCertIssuer) IssueCertificate(req certsman.CertificateRequest) (cer
 		"Hostname":  req.Hostname,
 	}).Info("String certificate issued for ", req.Hostname)
 
-	if i.SleepEnabled == true {
-		// Would run as a go-routine if possible, but that might be cheating?
-		sleepyTime(i.SleepyTimeSeconds*time.Second, req.Hostname)
-	}
-
 	return cert, nil
 }
 
-// SleepyTime is an artifical time to sleep
-func sleepyTime(sleepTime time.Duration, hostname string) {
+// SleepyTime is an artifical time to sleep, which is cut short if ctx is done
+func sleepyTime(ctx context.Context, sleepTime time.Duration, hostname string) error {
 
 	log.WithFields(log.Fields{
 		"SleepTime": sleepTime,
 		"Hostname":  hostname,
 	}).Debug("String certificate sleeping")
 
-	time.Sleep(sleepTime)
+	timer := time.NewTimer(sleepTime)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	log.WithFields(log.Fields{
 		"SleepTime": sleepTime,
 		"Hostname":  hostname,
 	}).Debug("String certificate sleep complete")
+
+	return nil
 }
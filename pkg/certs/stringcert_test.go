@@ -1,7 +1,10 @@
 package certs
 
 import (
+	"context"
+	"crypto/x509"
 	"testing"
+	"time"
 
 	"github.com/devnulled/certsman/pkg/certsman"
 	"github.com/stretchr/testify/assert"
@@ -22,6 +25,7 @@ func TestIssueCertificate(t *testing.T) {
 	assert.Nil(t, err, "An error shouldn't have occurred")
 	assert.Equal(t, hostname, myCert.Hostname, "The expected hostname was not correct")
 	assert.Equal(t, expectedResult, expectedResult, "The expecvted certificate body was not correct")
+	assert.False(t, myCert.NeedsRenewal(time.Now(), 0), "A freshly issued certificate shouldn't be expired")
 }
 
 func BenchmarkIssueCertificate(b *testing.B) {
@@ -38,3 +42,30 @@ func BenchmarkIssueCertificate(b *testing.B) {
 		strCertType.IssueCertificate(req)
 	}
 }
+
+func TestIssueCertificateContextCancelsSleep(t *testing.T) {
+	var strCertType = StringCertIssuer{StringPrefix: "foo-", SleepEnabled: true, SleepyTimeSeconds: 10}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+	_, err := strCertType.IssueCertificateContext(ctx, certsman.CertificateRequest{Hostname: "myhostname", RequestID: "blah"})
+
+	assert.Equal(t, context.DeadlineExceeded, err, "The sleep should have been cut short")
+	assert.True(t, time.Since(start) < time.Second, "The issuer shouldn't have slept for the full duration")
+}
+
+func TestIssueCertificateWithCSR(t *testing.T) {
+	var strCertType = StringCertIssuer{StringPrefix: "foo-"}
+
+	_, err := strCertType.IssueCertificate(certsman.CertificateRequest{Hostname: "myhostname", CSR: &x509.CertificateRequest{}})
+	assert.Equal(t, certsman.ErrCSRNotSupported, err, "A string certificate can't be issued for a CSR's key")
+}
+
+func TestIssueCertificateWithKeyAlgorithm(t *testing.T) {
+	var strCertType = StringCertIssuer{StringPrefix: "foo-"}
+
+	_, err := strCertType.IssueCertificate(certsman.CertificateRequest{Hostname: "myhostname", KeyAlgorithm: certsman.KeyAlgorithmRSA2048})
+	assert.Equal(t, certsman.ErrKeyAlgorithmNotSupported, err, "A string certificate has no key to choose the algorithm of")
+}
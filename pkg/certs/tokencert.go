@@ -8,8 +8,10 @@ a unique, securely genenrated string.
 package certs
 
 import (
+	"context"
 	"crypto/rand"
 	"math/big"
+	"time"
 
 	"github.com/devnulled/certsman/pkg/certsman"
 )
@@ -17,17 +19,34 @@ import (
 // TokenCertIssuer provides a simple token based certificate generated from a securely generated string
 type TokenCertIssuer struct {
 	KeyLength int
+	// How long issued certificates are valid for
+	Validity time.Duration
 }
 
 // IssueCertificate Returns a generated token based certificate
 func (t TokenCertIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return t.IssueCertificateContext(context.Background(), req)
+}
+
+// IssueCertificateContext Returns a generated token based certificate, giving up once ctx is done
+func (t TokenCertIssuer) IssueCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if req.CSR != nil {
+		return certsman.Certificate{}, certsman.ErrCSRNotSupported
+	}
+	if req.KeyAlgorithm != "" {
+		return certsman.Certificate{}, certsman.ErrKeyAlgorithmNotSupported
+	}
 
-	certStr, err := cryptoGenerator(t.KeyLength)
+	certStr, err := cryptoGenerator(ctx, t.KeyLength)
 
 	if err == nil {
+		notBefore, notAfter := certsman.ValidityPeriod(t.Validity)
+
 		cert := certsman.Certificate{
 			Hostname:        req.Hostname,
 			CertificateBody: certStr,
+			NotBefore:       notBefore,
+			NotAfter:        notAfter,
 		}
 
 		return cert, nil
@@ -41,9 +60,13 @@ func (t TokenCertIssuer) IssueCertificate(req certsman.CertificateRequest) (cert
 // It reads random numbers from crypto/rand and searches for printable characters.
 // It will return an error if the system's secure random number generator fails to
 // function correctly, in which case the caller must not continue.
-func cryptoGenerator(length int) (string, error) {
+// Generation is abandoned with ctx.Err() once ctx is done.
+func cryptoGenerator(ctx context.Context, length int) (string, error) {
 	result := ""
 	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
 		if len(result) >= length {
 			return result, nil
 		}
@@ -55,7 +78,7 @@ func cryptoGenerator(length int) (string, error) {
 		// Make sure that the number/byte/letter is inside
 		// the range of printable ASCII characters (excluding space and DEL)
 		if n > 32 && n < 127 {
-			result += string(n)
+			result += string(rune(n))
 		}
 	}
 }
@@ -0,0 +1,144 @@
+/*
+The X509CertIssuer is a CertificateIssuer which provides a genuine X.509 leaf certificate,
+signed by a configurable local certificate authority.
+*/
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	log "github.com/sirupsen/logrus"
+)
+
+// X509CertIssuer provides an X.509 certificate and key pair signed by a CertificateSigner
+type X509CertIssuer struct {
+	// The certificate authority which signs the issued certificates
+	Signer CertificateSigner
+	// How long issued certificates are valid for
+	Validity time.Duration
+	// Algorithm of the keys generated for requests which don't ask for one.  Empty is DefaultKeyAlgorithm.
+	KeyAlgorithm string
+}
+
+// IssueCertificate generates a new key pair and returns a PEM encoded certificate for the requested hostname and names
+func (x X509CertIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	return x.IssueCertificateContext(context.Background(), req)
+}
+
+// IssueCertificateContext generates a new key pair and returns a PEM encoded certificate, unless ctx is done before signing.
+// If the request has a CSR, the certificate is instead issued for the CSR's key and names and has no private key.
+func (x X509CertIssuer) IssueCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if x.Signer == nil {
+		return certsman.Certificate{}, errors.New("no certificate signer configured")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	var key crypto.Signer
+	var pub crypto.PublicKey
+
+	if req.CSR != nil {
+		if err := req.CSR.CheckSignature(); err != nil {
+			return certsman.Certificate{}, err
+		}
+		pub = req.CSR.PublicKey
+	} else {
+		alg := req.KeyAlgorithm
+		if alg == "" {
+			alg = x.KeyAlgorithm
+		}
+
+		generated, err := GenerateKey(alg)
+		if err != nil {
+			return certsman.Certificate{}, err
+		}
+		key, pub = generated, generated.Public()
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	notBefore, notAfter := certsman.ValidityPeriod(x.Validity)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: req.Hostname},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	// RSA keys can also be used for RSA key exchange by older TLS clients
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	if req.CSR != nil {
+		template.DNSNames = req.CSR.DNSNames
+		template.IPAddresses = req.CSR.IPAddresses
+	} else {
+		template.DNSNames, template.IPAddresses = certsman.SplitNames(req.SubjectNames())
+	}
+
+	// Key generation can be slow, so check again before committing to a signature
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	der, chain, err := x.Signer.SignCertificate(template, pub)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Error("Unable to sign X.509 certificate for ", req.Hostname)
+		return certsman.Certificate{}, err
+	}
+
+	// The signer may have shortened the validity, so take the period from what was actually signed
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	var chainPEM strings.Builder
+	for _, c := range chain {
+		chainPEM.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c}))
+	}
+
+	cert := certsman.Certificate{
+		Hostname:         req.Hostname,
+		CertificateBody:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		CertificateChain: chainPEM.String(),
+		NotBefore:        leaf.NotBefore,
+		NotAfter:         leaf.NotAfter,
+		KeyAlgorithm:     certsman.KeyAlgorithmOf(pub),
+	}
+
+	if key != nil {
+		if cert.PrivateKey, err = marshalPrivateKeyPEM(key); err != nil {
+			return certsman.Certificate{}, err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+		"Serial":    serial.Text(16),
+		"Key":       cert.KeyAlgorithm,
+	}).Info("X.509 certificate issued for ", req.Hostname)
+
+	return cert, nil
+}
@@ -0,0 +1,147 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestX509IssueCertificate(t *testing.T) {
+	ca, err := GenerateLocalCA("certsman test CA", time.Hour)
+	assert.Nil(t, err, "Generating the CA shouldn't have failed")
+
+	issuer := X509CertIssuer{Signer: ca, Validity: time.Minute * 5}
+	req := certsman.CertificateRequest{Hostname: "fooyork.com", RequestID: "blah"}
+
+	myCert, err := issuer.IssueCertificate(req)
+	assert.Nil(t, err, "An error shouldn't have occurred")
+	assert.Equal(t, "fooyork.com", myCert.Hostname, "The expected hostname was not correct")
+
+	leaf, err := ParseCertificatePEM([]byte(myCert.CertificateBody))
+	assert.Nil(t, err, "The certificate body should be a PEM encoded certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "fooyork.com", Roots: roots})
+	assert.Nil(t, err, "The certificate should verify against the local CA")
+
+	key, err := ParsePrivateKeyPEM([]byte(myCert.PrivateKey))
+	assert.Nil(t, err, "The private key should be PEM encoded")
+	assert.Equal(t, leaf.PublicKey, key.Public(), "The private key should match the certificate")
+	assert.True(t, leaf.NotAfter.Equal(myCert.NotAfter), "The NotAfter should match the signed certificate")
+}
+
+func TestX509IssueCertificateIPAddress(t *testing.T) {
+	ca, _ := GenerateLocalCA("certsman test CA", time.Hour)
+	issuer := X509CertIssuer{Signer: ca}
+
+	myCert, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "127.0.0.1"})
+	assert.Nil(t, err, "An error shouldn't have occurred")
+
+	leaf, _ := ParseCertificatePEM([]byte(myCert.CertificateBody))
+	assert.Len(t, leaf.IPAddresses, 1, "The IP address should be in the certificate")
+	assert.Empty(t, leaf.DNSNames, "An IP address shouldn't be issued as a DNS name")
+}
+
+func TestX509IssueCertificateNames(t *testing.T) {
+	ca, _ := GenerateLocalCA("certsman test CA", time.Hour)
+	issuer := X509CertIssuer{Signer: ca}
+
+	req := certsman.CertificateRequest{Hostname: "fooyork.com", Names: []string{"*.fooyork.com", "10.0.0.1", "FooYork.com"}}
+	myCert, err := issuer.IssueCertificate(req)
+	assert.Nil(t, err, "An error shouldn't have occurred")
+
+	leaf, _ := ParseCertificatePEM([]byte(myCert.CertificateBody))
+	assert.Equal(t, "fooyork.com", leaf.Subject.CommonName)
+	assert.Equal(t, []string{"fooyork.com", "*.fooyork.com"}, leaf.DNSNames, "Every DNS name should be in the certificate once")
+	assert.Len(t, leaf.IPAddresses, 1, "The IP address should be in the certificate")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "www.fooyork.com", Roots: roots})
+	assert.Nil(t, err, "The wildcard should cover subdomains")
+}
+
+func TestX509IssueCertificateKeyAlgorithm(t *testing.T) {
+	ca, _ := GenerateLocalCA("certsman test CA", time.Hour)
+	issuer := X509CertIssuer{Signer: ca, KeyAlgorithm: certsman.KeyAlgorithmECDSAP384}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+
+	for _, alg := range []string{"", certsman.KeyAlgorithmRSA2048, certsman.KeyAlgorithmEd25519} {
+		myCert, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", KeyAlgorithm: alg})
+		assert.Nil(t, err, "Issuing with %q shouldn't fail", alg)
+
+		want := alg
+		if want == "" {
+			want = certsman.KeyAlgorithmECDSAP384
+		}
+		assert.Equal(t, want, myCert.KeyAlgorithm, "Requests without an algorithm should get the issuer's")
+
+		leaf, _ := ParseCertificatePEM([]byte(myCert.CertificateBody))
+		assert.Equal(t, want, certsman.KeyAlgorithmOf(leaf.PublicKey))
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "fooyork.com", Roots: roots})
+		assert.Nil(t, err, "A %s certificate should verify", want)
+
+		key, _ := ParsePrivateKeyPEM([]byte(myCert.PrivateKey))
+		assert.Equal(t, leaf.PublicKey, key.Public(), "The private key should match the certificate")
+	}
+
+	_, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", KeyAlgorithm: "dsa1024"})
+	assert.NotNil(t, err, "An unknown algorithm should be refused")
+}
+
+func TestX509IssueCertificateForCSR(t *testing.T) {
+	ca, _ := GenerateLocalCA("certsman test CA", time.Hour)
+	issuer := X509CertIssuer{Signer: ca}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "fooyork.com"},
+		DNSNames:    []string{"fooyork.com", "www.fooyork.com"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}, key)
+	csr, _ := x509.ParseCertificateRequest(csrDER)
+
+	myCert, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", CSR: csr})
+	assert.Nil(t, err, "An error shouldn't have occurred")
+	assert.Empty(t, myCert.PrivateKey, "The key belongs to whoever made the CSR")
+
+	leaf, _ := ParseCertificatePEM([]byte(myCert.CertificateBody))
+	assert.Equal(t, key.Public(), leaf.PublicKey, "The certificate should be for the CSR's key")
+	assert.Equal(t, []string{"fooyork.com", "www.fooyork.com"}, leaf.DNSNames)
+	assert.Len(t, leaf.IPAddresses, 1)
+
+	csr.Signature[0] ^= 0xff
+	_, err = issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", CSR: csr})
+	assert.NotNil(t, err, "A CSR with a bad signature should be rejected")
+}
+
+func TestX509IssueCertificateWithoutSigner(t *testing.T) {
+	issuer := X509CertIssuer{}
+
+	_, err := issuer.IssueCertificate(certsman.CertificateRequest{Hostname: "fooyork.com"})
+	assert.NotNil(t, err, "Issuing without a signer should fail")
+}
+
+func BenchmarkX509IssueCertificate(b *testing.B) {
+	ca, _ := GenerateLocalCA("certsman test CA", time.Hour)
+	issuer := X509CertIssuer{Signer: ca}
+
+	req := certsman.CertificateRequest{Hostname: "myhostname", RequestID: "blah"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		issuer.IssueCertificate(req)
+	}
+}
@@ -0,0 +1,32 @@
+package certsman
+
+import (
+	"time"
+)
+
+// Statuses an ACME account can have
+const (
+	AccountStatusValid       = "valid"
+	AccountStatusDeactivated = "deactivated"
+	AccountStatusRevoked     = "revoked"
+)
+
+// Account is a client registered with certsman's ACME server, identified by the key it signs its requests with
+type Account struct {
+	// Generated when the account is registered
+	ID string
+	// One of valid, deactivated or revoked
+	Status string
+	// URLs the CA can use to contact the account holder, e.g. mailto:admin@fooyork.com
+	Contact []string
+	// Whether the account holder agreed to the terms of service when registering
+	TermsOfServiceAgreed bool
+
+	// The account's public key, as a JSON Web Key
+	Key string
+	// RFC 7638 thumbprint of Key, which accounts are looked up by
+	KeyThumbprint string
+
+	// When the account was registered
+	CreatedAt time.Time
+}
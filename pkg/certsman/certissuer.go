@@ -2,29 +2,61 @@
 
 This is the main package for certsman, which mostly provides contracts.
 
+account.go - provides the accounts registered with the ACME server
 certissuer.go - provides contracts for clients or issuers which can produce a requested certificate
+coalesce.go - coalesces concurrent issuance for the same hostname
+context.go - helpers to call issuers and persistence through their context-aware variants when they have one
+csr.go - parses certificate signing requests and checks the names they request against policy
+keys.go - the key algorithms certificates can be issued with
+names.go - normalizes the names certificates are requested for, and derives the key they are stored under
 presistence.go - provides contracts for swappable persistence layers for cerificate issuers
 
 */
 package certsman
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrCertificateExpired is returned when a stored certificate has expired or is due for renewal
+var ErrCertificateExpired = errors.New("certificate has expired or is due for renewal")
+
+// ErrCertificateRevoked is returned when revoking a certificate which has already been revoked
+var ErrCertificateRevoked = errors.New("certificate has already been revoked")
+
+// ErrCSRNotSupported is returned by issuers which can't issue a certificate for a CSR's key
+var ErrCSRNotSupported = errors.New("issuer does not support certificate signing requests")
+
 // CertificateIssuer provides a contract for various types of certificates to be generated/issued from
 type CertificateIssuer interface {
 	IssueCertificate(req CertificateRequest) (Certificate, error)
 }
 
+// ContextCertificateIssuer is a CertificateIssuer whose issuance can be cancelled or given a deadline through a context
+type ContextCertificateIssuer interface {
+	CertificateIssuer
+	IssueCertificateContext(ctx context.Context, req CertificateRequest) (Certificate, error)
+}
+
 // CertificateRequest provides a contract for a request issued from a client to create/retrive a certificate for a given hostname
 type CertificateRequest struct {
 	// Generated on each request for tracing/debugging purposes
 	RequestID string
 	// The hostname being requested for a certificate
 	Hostname string
+	// Further DNS names, which may be wildcards such as *.example.com, and IP addresses the certificate is for
+	Names []string
+	// One of KeyAlgorithms to generate the certificate's key with.  Empty leaves it to the issuer.
+	KeyAlgorithm string
+	// An optional PKCS#10 request the certificate is issued for.  The certificate then uses the CSR's public key and
+	// names, so the private key stays with the requester.
+	CSR *x509.CertificateRequest
 }
 
 // CertificateResponse provides a contract to respond to a request for a Certificate
@@ -59,10 +91,73 @@ type Certificate struct {
 	Hostname string
 	// The body that represents the certificate
 	CertificateBody string
+	// PEM encoded intermediates needed to verify the certificate, if the issuer uses a CA hierarchy
+	CertificateChain string
+	// The PEM encoded private key for the certificate, if the issuer generated one.  Persistence must keep it with the
+	// certificate.  It is only handed out to authenticated clients, never along with the certificate body, and is left
+	// out when the certificate is formatted for logging.
+	PrivateKey string
+	// One of KeyAlgorithms, or empty if the certificate has no key or it is of another kind
+	KeyAlgorithm string
+
+	// When this certificate becomes valid
+	NotBefore time.Time
+	// When this certificate expires
+	NotAfter time.Time
+
+	// When this certificate was revoked, or zero if it hasn't been
+	RevokedAt time.Time
+	// The RFC 5280 CRLReason code the certificate was revoked for
+	RevocationReason int
+}
+
+// DefaultCertificateValidity is how long issuers make certificates valid for when no validity is configured
+const DefaultCertificateValidity = time.Minute * 10
+
+// How far NotBefore is backdated, so clients whose clocks are a little behind accept a certificate as soon as it is issued
+const certificateBackdate = time.Minute
+
+// ValidityPeriod returns the NotBefore and NotAfter for a certificate issued now which is valid for the given duration.
+// NotBefore is backdated by a minute.
+func ValidityPeriod(validity time.Duration) (time.Time, time.Time) {
+	if validity <= 0 {
+		validity = DefaultCertificateValidity
+	}
+
+	now := time.Now()
+	return now.Add(-certificateBackdate), now.Add(validity)
+}
 
-	// TODO: Should actually be a datetime
-	// How long until this certificate expires
-	Expiration time.Duration
+// IsRevoked reports whether the certificate has been revoked
+func (c Certificate) IsRevoked() bool {
+	return !c.RevokedAt.IsZero()
+}
+
+// String describes the certificate for logging.  The private key is redacted, so a certificate can be logged without
+// leaking it.
+func (c Certificate) String() string {
+	privateKey := ""
+	if c.PrivateKey != "" {
+		privateKey = "[redacted]"
+	}
+
+	return fmt.Sprintf("Certificate{Hostname: %q, KeyAlgorithm: %q, PrivateKey: %q, NotBefore: %s, NotAfter: %s, RevokedAt: %s}",
+		c.Hostname, c.KeyAlgorithm, privateKey, c.NotBefore.Format(time.RFC3339), c.NotAfter.Format(time.RFC3339), c.RevokedAt.Format(time.RFC3339))
+}
+
+// GoString is String, so that formatting with %#v doesn't leak the private key either
+func (c Certificate) GoString() string {
+	return c.String()
+}
+
+// NeedsRenewal reports whether the certificate has expired, or expires within the renewal window, at the given time.
+// A certificate without a NotAfter, or which has been revoked, is always considered to need renewal.
+func (c Certificate) NeedsRenewal(now time.Time, renewalWindow time.Duration) bool {
+	if c.NotAfter.IsZero() || c.IsRevoked() {
+		return true
+	}
+
+	return !now.Before(c.NotAfter.Add(-renewalWindow))
 }
 
 // CerfificateService provides a contract for a particular certificate implementation, and it's backing persistence implementation
@@ -70,77 +165,225 @@ type CerfificateService struct {
 	// The particular certificate Issuer
 	Issuer      CertificateIssuer
 	Persistence CertificatePersistenceProvider
+
+	// Stored certificates which expire within this window are treated as missing and issued again
+	RenewalWindow time.Duration
+
+	// Issuance currently in-flight, by storage key
+	inflight issuanceGroup
 }
 
-// GetOrCreateCertificate interacts with a CertificateService to either retrieve a stored certificate and respond with it, or generate a new one, store it, and respond with it
-func (svc CerfificateService) GetOrCreateCertificate(req CertificateRequest) CertificateResponse {
-	storedCert, retErr := svc.Persistence.RetrieveCertificate(req)
+// GetOrCreateCertificate interacts with a CertificateService to either retrieve a stored certificate and respond with it, or generate a new one, store it, and respond with it.
+// Concurrent requests for the same hostname are coalesced so that only one certificate is ever being issued for it at a time.
+func (svc *CerfificateService) GetOrCreateCertificate(req CertificateRequest) CertificateResponse {
+	return svc.GetOrCreateCertificateContext(context.Background(), req)
+}
 
-	if retErr != nil {
+// GetOrCreateCertificateContext is GetOrCreateCertificate, but stops waiting and responds with an error once ctx is done
+func (svc *CerfificateService) GetOrCreateCertificateContext(ctx context.Context, req CertificateRequest) CertificateResponse {
+	storedCert, retErr := svc.retrieveUsableCertificate(ctx, req)
 
+	if retErr == nil {
+		// Found the cert in persistence, lets return it
 		log.WithFields(log.Fields{
 			"RequestID": req.RequestID,
 			"Hostname":  req.Hostname,
-		}).Debug("No cert found in persistence.  Creating new one.")
-		// The certificate must not exist.  Create a new one and store.
-		newCert, createErr := svc.Issuer.IssueCertificate(req)
+		}).Debug("Cert found in persistence for ", req.Hostname)
+		resp := marshallCertificateResponse(req, storedCert, false, true)
+		return resp
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return marshallErrResponse(req, ctxErr)
+	}
+
+	resp, shared, waitErr := svc.inflight.do(ctx, req.StorageKey(), func(flightCtx context.Context) CertificateResponse {
+		return svc.issueAndStoreCertificate(flightCtx, req, false)
+	})
+
+	if waitErr != nil {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Debug("Gave up waiting on cert for ", req.Hostname)
+		return marshallErrResponse(req, waitErr)
+	}
+
+	if shared {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Debug("Used the cert from another paralell request for ", req.Hostname)
+
+		// The response was made for the request which did the issuing, so it has to be made this request's own
+		resp.RequestID = req.RequestID
+		resp.CertificateHostname = req.Hostname
+	}
+
+	return resp
+}
+
+// RenewCertificateContext issues a new certificate for the hostname even if a usable one is already stored, and swaps it into
+// persistence in a single write so readers keep getting the previous certificate until the new one is ready.
+// Renewal is coalesced with any other issuance in-flight for the same hostname.
+func (svc *CerfificateService) RenewCertificateContext(ctx context.Context, req CertificateRequest) CertificateResponse {
+	resp, shared, waitErr := svc.inflight.do(ctx, req.StorageKey(), func(flightCtx context.Context) CertificateResponse {
+		return svc.issueAndStoreCertificate(flightCtx, req, true)
+	})
+
+	if waitErr != nil {
+		return marshallErrResponse(req, waitErr)
+	}
+
+	if shared {
+		resp.RequestID = req.RequestID
+		resp.CertificateHostname = req.Hostname
+	}
+
+	return resp
+}
+
+// IssueCertificateContext issues a new certificate without looking in or storing it to persistence.  This is for requests
+// with a CSR, whose certificates belong to the requester rather than being shared by everyone asking for the hostname.
+func (svc *CerfificateService) IssueCertificateContext(ctx context.Context, req CertificateRequest) CertificateResponse {
+	cert, err := IssueWithContext(ctx, svc.Issuer, req)
 
-		if createErr != nil {
-			// Something bad happened.  Lets bail.
+	if err != nil {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Error("Unable to issue cert for ", req.Hostname)
+		return marshallErrResponse(req, err)
+	}
+
+	return marshallCertificateResponse(req, cert, true, false)
+}
+
+// RevokeCertificateContext marks the certificate stored for the hostname as revoked, but only if it is the certificate with
+// the given body, so that the next request for the hostname is issued a new certificate.  ErrCertificateNotFound is
+// returned if a different certificate, or none, is stored, and ErrCertificateRevoked if it was already revoked.
+func (svc *CerfificateService) RevokeCertificateContext(ctx context.Context, req CertificateRequest, certificateBody string, reason int) (Certificate, error) {
+	stored, err := RetrieveWithContext(ctx, svc.Persistence, req)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	if stored.CertificateBody != certificateBody {
+		return Certificate{}, ErrCertificateNotFound
+	}
+	if stored.IsRevoked() {
+		return stored, ErrCertificateRevoked
+	}
+
+	revoked := stored
+	revoked.RevokedAt = time.Now()
+	revoked.RevocationReason = reason
+
+	revoked, err = UpdateWithContext(ctx, svc.Persistence, req, stored, revoked)
+	if err == ErrCertificateConflict {
+		// It was replaced in the meantime, so the certificate being revoked is no longer handed out
+		return Certificate{}, ErrCertificateNotFound
+	}
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+		"Reason":    reason,
+	}).Info("Revoked stored cert for ", req.Hostname)
+	return revoked, nil
+}
+
+// issueAndStoreCertificate issues a new certificate and stores it.  It must only be called through the inflight group.
+// Unless renewing, a usable certificate stored by another request in the meantime is returned instead.
+func (svc *CerfificateService) issueAndStoreCertificate(ctx context.Context, req CertificateRequest, renew bool) CertificateResponse {
+	if !renew {
+		// Another request may have stored a cert between our lookup and joining the group
+		otherCert, otherCertErr := svc.retrieveUsableCertificate(ctx, req)
+
+		if otherCertErr == nil {
 			log.WithFields(log.Fields{
 				"RequestID": req.RequestID,
 				"Hostname":  req.Hostname,
-			}).Error("Unable to create cert for ", req.Hostname)
-			resp := marshallErrResponse(req, createErr)
+			}).Debug("Cert found in persistence from another paralell request for ", req.Hostname)
+			resp := marshallCertificateResponse(req, otherCert, false, true)
 			return resp
 		}
 
-		// Created new cert.  Lets make sure another process hasn't created and stored one.
-		// This is not the best implementation.. the requests should get queued uniquely by hostname so
-		// that they never get duplicated to begin with.
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Debug("No cert found in persistence.  Creating new one.")
+	} else {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Debug("Renewing cert ahead of its expiry.")
+	}
+
+	// The certificate must not exist.  Create a new one and store.
+	newCert, createErr := IssueWithContext(ctx, svc.Issuer, req)
 
-		otherCert, otherCertErr := svc.Persistence.RetrieveCertificate(req)
+	if createErr != nil {
+		// Something bad happened.  Lets bail.
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Error("Unable to create cert for ", req.Hostname)
+		resp := marshallErrResponse(req, createErr)
+		return resp
+	}
 
-		if otherCertErr != nil {
-			_, storeErr := svc.Persistence.CreateCertificate(req, newCert)
+	_, storeErr := CreateWithContext(ctx, svc.Persistence, req, newCert)
 
-			if storeErr != nil {
-				// Something bad happened.  Lets bail.
-				log.WithFields(log.Fields{
-					"RequestID": req.RequestID,
-					"Hostname":  req.Hostname,
-				}).Error("Unable to store cert for ", req.Hostname)
-				resp := marshallErrResponse(req, storeErr)
-				return resp
-			}
+	if storeErr != nil {
+		// Something bad happened.  Lets bail.
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Error("Unable to store cert for ", req.Hostname)
+		resp := marshallErrResponse(req, storeErr)
+		return resp
+	}
 
-			// Persistence was also successful! Lets return the cert now that it's been stored
-			resp := marshallCertificateResponse(req, newCert, true, false)
-			return resp
+	// Persistence was also successful! Lets return the cert now that it's been stored
+	resp := marshallCertificateResponse(req, newCert, true, false)
+	return resp
+}
 
-		}
+// retrieveUsableCertificate retrieves a stored certificate, treating one that has expired or is due for renewal as missing
+func (svc *CerfificateService) retrieveUsableCertificate(ctx context.Context, req CertificateRequest) (Certificate, error) {
+	cert, err := RetrieveWithContext(ctx, svc.Persistence, req)
+
+	if err != nil {
+		return Certificate{}, err
+	}
 
+	// Certificates are stored per key algorithm, but one stored before that, or by a provider keying them differently,
+	// mustn't be handed out for the wrong algorithm
+	if req.KeyAlgorithm != "" && cert.KeyAlgorithm != req.KeyAlgorithm {
+		return Certificate{}, ErrCertificateNotFound
+	}
+
+	if cert.NeedsRenewal(time.Now(), svc.RenewalWindow) {
 		log.WithFields(log.Fields{
 			"RequestID": req.RequestID,
 			"Hostname":  req.Hostname,
-		}).Debug("Cert found in persistence from another paralell request for ", req.Hostname)
-		// Another process already stored the certificate.  Lets return that one instead.
-		otherResp := marshallCertificateResponse(req, otherCert, true, false)
-		return otherResp
+			"NotAfter":  cert.NotAfter,
+		}).Debug("Stored cert has expired or is due for renewal")
+		return Certificate{}, ErrCertificateExpired
 	}
 
-	// Found the cert in persistence, lets return it
-	log.WithFields(log.Fields{
-		"RequestID": req.RequestID,
-		"Hostname":  req.Hostname,
-	}).Debug("Cert found in persistence for ", req.Hostname)
-	resp := marshallCertificateResponse(req, storedCert, true, false)
-	return resp
+	return cert, nil
 }
 
-// marshallCertificateResponse marshalls various data into a successful certificate response
+// marshallCertificateResponse marshalls various data into a successful certificate response.  wasCreated is whether the
+// certificate was issued for the request, and wasCached whether it was served from persistence instead.
 func marshallCertificateResponse(req CertificateRequest, cert Certificate, wasCreated bool, wasCached bool) CertificateResponse {
 	resp := CertificateResponse{
+		RequestID:           req.RequestID,
 		StatusCode:          200,
 		IsSuccess:           true,
 		Error:               nil,
@@ -154,8 +397,20 @@ func marshallCertificateResponse(req CertificateRequest, cert Certificate, wasCr
 
 // marshallErrResponse marshalls an error into an CertificateResponse
 func marshallErrResponse(req CertificateRequest, err error) CertificateResponse {
+	statusCode := 500
+
+	// Cancellation isn't really a server fault, so let the client know it can try again
+	if errors.Is(err, context.DeadlineExceeded) {
+		statusCode = 504
+	} else if errors.Is(err, context.Canceled) {
+		statusCode = 503
+	} else if errors.Is(err, ErrCSRNotSupported) || errors.Is(err, ErrKeyAlgorithmNotSupported) {
+		statusCode = 501
+	}
+
 	resp := CertificateResponse{
-		StatusCode:          500,
+		RequestID:           req.RequestID,
+		StatusCode:          statusCode,
 		IsSuccess:           false,
 		Error:               err,
 		CertificateHostname: req.Hostname,
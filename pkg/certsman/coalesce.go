@@ -0,0 +1,76 @@
+package certsman
+
+import (
+	"context"
+	"sync"
+)
+
+// issuanceGroup coalesces concurrent work for the same hostname so that only one call is ever in-flight,
+// and every caller waiting on it receives the same response
+type issuanceGroup struct {
+	mu      sync.Mutex
+	flights map[string]*issuance
+}
+
+// issuance is a single in-flight call which other callers can wait on
+type issuance struct {
+	done chan struct{}
+	resp CertificateResponse
+
+	// How many callers are still waiting on the call, and how to cancel it once they have all gone away
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn for the hostname unless a call for it is already in-flight, in which case it waits for that
+// call and returns its response instead.  The returned bool reports whether the call was shared with another caller.
+//
+// The call runs with its own context, which is only cancelled once every caller waiting on it has given up,
+// so one impatient client can't fail the issuance for everyone else.  A caller whose ctx is done stops
+// waiting and gets ctx.Err() back.
+func (g *issuanceGroup) do(ctx context.Context, hostname string, fn func(ctx context.Context) CertificateResponse) (CertificateResponse, bool, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*issuance)
+	}
+
+	flight, shared := g.flights[hostname]
+	if !shared {
+		flightCtx, cancel := context.WithCancel(context.Background())
+		flight = &issuance{done: make(chan struct{}), cancel: cancel}
+		g.flights[hostname] = flight
+
+		go func() {
+			flight.resp = fn(flightCtx)
+
+			g.mu.Lock()
+			// The flight is no longer in the map if every caller gave up, and a new one may have taken its place
+			if g.flights[hostname] == flight {
+				delete(g.flights, hostname)
+			}
+			g.mu.Unlock()
+
+			cancel()
+			close(flight.done)
+		}()
+	}
+	flight.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.resp, shared, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		flight.waiters--
+		if flight.waiters == 0 {
+			// Nobody wants the cancelled call any more, so the next caller has to start a fresh one rather than join it
+			flight.cancel()
+			if g.flights[hostname] == flight {
+				delete(g.flights, hostname)
+			}
+		}
+		g.mu.Unlock()
+		return CertificateResponse{}, shared, ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+package certsman
+
+import "context"
+
+// IssueWithContext issues a certificate with the issuer, using its context-aware variant when it has one.
+// Issuers without one can't be interrupted, so the context is only checked before issuing.
+func IssueWithContext(ctx context.Context, issuer CertificateIssuer, req CertificateRequest) (Certificate, error) {
+	if ctxIssuer, ok := issuer.(ContextCertificateIssuer); ok {
+		return ctxIssuer.IssueCertificateContext(ctx, req)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Certificate{}, err
+	}
+
+	return issuer.IssueCertificate(req)
+}
+
+// CreateWithContext stores a certificate, using the provider's context-aware variant when it has one
+func CreateWithContext(ctx context.Context, p CertificatePersistenceProvider, req CertificateRequest, cert Certificate) (bool, error) {
+	if ctxProvider, ok := p.(ContextCertificatePersistenceProvider); ok {
+		return ctxProvider.CreateCertificateContext(ctx, req, cert)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return p.CreateCertificate(req, cert)
+}
+
+// RetrieveWithContext retrieves a certificate, using the provider's context-aware variant when it has one
+func RetrieveWithContext(ctx context.Context, p CertificatePersistenceProvider, req CertificateRequest) (Certificate, error) {
+	if ctxProvider, ok := p.(ContextCertificatePersistenceProvider); ok {
+		return ctxProvider.RetrieveCertificateContext(ctx, req)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Certificate{}, err
+	}
+
+	return p.RetrieveCertificate(req)
+}
+
+// UpdateWithContext updates a certificate, using the provider's context-aware variant when it has one
+func UpdateWithContext(ctx context.Context, p CertificatePersistenceProvider, req CertificateRequest, prevCert Certificate, currentCert Certificate) (Certificate, error) {
+	if ctxProvider, ok := p.(ContextCertificatePersistenceProvider); ok {
+		return ctxProvider.UpdateCertificateContext(ctx, req, prevCert, currentCert)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return Certificate{}, err
+	}
+
+	return p.UpdateCertificate(req, prevCert, currentCert)
+}
+
+// DeleteWithContext deletes a certificate, using the provider's context-aware variant when it has one
+func DeleteWithContext(ctx context.Context, p CertificatePersistenceProvider, req CertificateRequest) (bool, error) {
+	if ctxProvider, ok := p.(ContextCertificatePersistenceProvider); ok {
+		return ctxProvider.DeleteCertificateContext(ctx, req)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	return p.DeleteCertificate(req)
+}
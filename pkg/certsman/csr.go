@@ -0,0 +1,148 @@
+package certsman
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrInvalidCSR is returned for certificate signing requests which can't be parsed or whose signature doesn't verify
+var ErrInvalidCSR = errors.New("invalid certificate signing request")
+
+// ErrInvalidName is returned when a certificate is requested for something which isn't a DNS name or IP address
+var ErrInvalidName = errors.New("invalid DNS name")
+
+// ErrNameNotAllowed is returned when a certificate is requested for a name the NamePolicy doesn't allow
+var ErrNameNotAllowed = errors.New("name is not allowed by policy")
+
+// DefaultMaxNames is the most names a single certificate can be requested for when no limit is configured
+const DefaultMaxNames = 100
+
+// NamePolicy decides which names certificates may be requested for
+type NamePolicy struct {
+	// Domains names must be, or be a subdomain of.  Empty allows any domain.
+	AllowedDomains []string
+	// Whether certificates may be requested for IP addresses
+	AllowIPAddresses bool
+	// Whether certificates may be requested for wildcard names such as *.example.com
+	AllowWildcards bool
+	// Most names a single certificate can be requested for
+	MaxNames int
+}
+
+// ParseCSR decodes a PKCS#10 certificate signing request, either PEM encoded or as raw DER, and checks it was signed
+// by the key it is for
+func ParseCSR(data []byte) (*x509.CertificateRequest, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+			return nil, fmt.Errorf("%w: PEM block is a %s", ErrInvalidCSR, block.Type)
+		}
+		der = block.Bytes
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: signature does not verify", ErrInvalidCSR)
+	}
+
+	return csr, nil
+}
+
+// CSRNames returns the DNS names and IP addresses a CSR requests, in that order
+func CSRNames(csr *x509.CertificateRequest) []string {
+	names := append([]string{}, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// CheckCSR checks every name a CSR requests is allowed.  The names have to be in its subject alternative names, so a
+// common name which isn't one of them is rejected rather than silently left out of the certificate.
+func (p NamePolicy) CheckCSR(csr *x509.CertificateRequest) error {
+	names := CSRNames(csr)
+	if len(names) == 0 {
+		return fmt.Errorf("%w: no DNS names or IP addresses were requested", ErrInvalidCSR)
+	}
+
+	if cn := csr.Subject.CommonName; cn != "" && !containsName(names, cn) {
+		return fmt.Errorf("%w: common name %q is not one of the requested names", ErrInvalidCSR, cn)
+	}
+
+	return p.CheckNames(names)
+}
+
+// CheckNames checks every name is allowed, whether it is a DNS name or an IP address
+func (p NamePolicy) CheckNames(names []string) error {
+	maxNames := p.MaxNames
+	if maxNames <= 0 {
+		maxNames = DefaultMaxNames
+	}
+	if len(names) > maxNames {
+		return fmt.Errorf("%w: at most %d names can be requested", ErrNameNotAllowed, maxNames)
+	}
+
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			if !p.AllowIPAddresses {
+				return fmt.Errorf("%w: certificates can't be requested for IP addresses", ErrNameNotAllowed)
+			}
+			continue
+		}
+
+		if err := p.checkDNSName(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkDNSName checks a DNS name is a hostname within one of the allowed domains.  A wildcard may only be the whole of
+// the leftmost label, and must cover a domain of at least two labels.
+func (p NamePolicy) checkDNSName(name string) error {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "*.") {
+		if !p.AllowWildcards {
+			return fmt.Errorf("%w: certificates can't be requested for wildcard names", ErrNameNotAllowed)
+		}
+		name = strings.TrimPrefix(name, "*.")
+		if !strings.Contains(name, ".") {
+			return fmt.Errorf("%w: wildcard *.%s covers too much", ErrNameNotAllowed, name)
+		}
+	}
+
+	if !ValidDNSName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	if len(p.AllowedDomains) == 0 {
+		return nil
+	}
+
+	for _, domain := range p.AllowedDomains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q is not within an allowed domain", ErrNameNotAllowed, name)
+}
+
+// containsName reports whether names contains name, ignoring case
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
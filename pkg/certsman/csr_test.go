@@ -0,0 +1,99 @@
+package certsman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCSR creates a DER encoded CSR for the names
+func newCSR(t *testing.T, commonName string, dnsNames []string, ips []net.IP) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+	}, key)
+	assert.Nil(t, err)
+	return der
+}
+
+func TestParseCSR(t *testing.T) {
+	der := newCSR(t, "fooyork.com", []string{"fooyork.com"}, nil)
+
+	csr, err := ParseCSR(der)
+	assert.Nil(t, err, "A DER CSR should be parsed")
+	assert.Equal(t, []string{"fooyork.com"}, csr.DNSNames)
+
+	csr, err = ParseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	assert.Nil(t, err, "A PEM CSR should be parsed")
+	assert.Equal(t, []string{"fooyork.com"}, csr.DNSNames)
+
+	_, err = ParseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	assert.True(t, errors.Is(err, ErrInvalidCSR), "A PEM block of another type should be rejected")
+
+	_, err = ParseCSR([]byte("not a csr"))
+	assert.True(t, errors.Is(err, ErrInvalidCSR))
+
+	// Flip a bit of the signature
+	tampered := append([]byte{}, der...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = ParseCSR(tampered)
+	assert.True(t, errors.Is(err, ErrInvalidCSR), "A CSR whose signature doesn't verify should be rejected")
+}
+
+func TestNamePolicyCheckCSR(t *testing.T) {
+	parse := func(commonName string, dnsNames []string, ips []net.IP) *x509.CertificateRequest {
+		csr, err := ParseCSR(newCSR(t, commonName, dnsNames, ips))
+		assert.Nil(t, err)
+		return csr
+	}
+
+	policy := NamePolicy{AllowedDomains: []string{"fooyork.com"}}
+	assert.Nil(t, policy.CheckCSR(parse("fooyork.com", []string{"fooyork.com", "www.FooYork.com"}, nil)))
+	assert.Nil(t, policy.CheckCSR(parse("", []string{"api.fooyork.com"}, nil)), "The common name is optional")
+
+	err := policy.CheckCSR(parse("fooyork.com", []string{"fooyork.com", "barlondon.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "Names outside the allowed domains should be rejected")
+	err = policy.CheckCSR(parse("", []string{"notfooyork.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "Only subdomains of an allowed domain should be allowed")
+
+	err = policy.CheckCSR(parse("fooyork.com", nil, nil))
+	assert.True(t, errors.Is(err, ErrInvalidCSR), "A CSR needs subject alternative names")
+	err = policy.CheckCSR(parse("www.fooyork.com", []string{"fooyork.com"}, nil))
+	assert.True(t, errors.Is(err, ErrInvalidCSR), "The common name must be one of the requested names")
+	err = policy.CheckCSR(parse("", []string{"*.fooyork.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "Wildcards should only be allowed when enabled")
+
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+	err = NamePolicy{}.CheckCSR(parse("", nil, ips))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "IP addresses should only be allowed when enabled")
+	assert.Nil(t, NamePolicy{AllowIPAddresses: true}.CheckCSR(parse("10.0.0.1", nil, ips)))
+
+	wildcards := NamePolicy{AllowedDomains: []string{"fooyork.com"}, AllowWildcards: true}
+	assert.Nil(t, wildcards.CheckCSR(parse("*.fooyork.com", []string{"*.fooyork.com", "fooyork.com"}, nil)))
+	err = wildcards.CheckCSR(parse("", []string{"*.barlondon.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "A wildcard's domain should be within the allowed domains")
+	err = NamePolicy{AllowWildcards: true}.CheckCSR(parse("", []string{"*.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "A wildcard shouldn't cover a whole top level domain")
+	err = NamePolicy{AllowWildcards: true}.CheckCSR(parse("", []string{"www.*.fooyork.com"}, nil))
+	assert.True(t, errors.Is(err, ErrInvalidName), "A wildcard should only be the leftmost label")
+
+	for _, name := range []string{"b.com,c.com", "a.com#ecdsa-p384", "a.com:443", "foo_bar.com", "-foo.com", "foo..com", "f\u00f6o.com"} {
+		err = NamePolicy{}.CheckNames([]string{name})
+		assert.True(t, errors.Is(err, ErrInvalidName), "%q should only be letters, digits and hyphens", name)
+	}
+
+	err = NamePolicy{MaxNames: 1}.CheckCSR(parse("", []string{"fooyork.com", "www.fooyork.com"}, nil))
+	assert.True(t, errors.Is(err, ErrNameNotAllowed), "More names than allowed should be rejected")
+}
@@ -0,0 +1,71 @@
+package certsman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+)
+
+// Key algorithms issuers can generate certificates' keys with
+const (
+	KeyAlgorithmRSA2048   = "rsa2048"
+	KeyAlgorithmRSA3072   = "rsa3072"
+	KeyAlgorithmRSA4096   = "rsa4096"
+	KeyAlgorithmECDSAP256 = "ecdsa-p256"
+	KeyAlgorithmECDSAP384 = "ecdsa-p384"
+	KeyAlgorithmEd25519   = "ed25519"
+)
+
+// KeyAlgorithms lists every key algorithm, from the most to the least widely supported by clients
+var KeyAlgorithms = []string{
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA3072,
+	KeyAlgorithmRSA4096,
+	KeyAlgorithmECDSAP384,
+	KeyAlgorithmEd25519,
+}
+
+// ErrUnknownKeyAlgorithm is returned when a certificate is requested with a key algorithm which isn't one of KeyAlgorithms
+var ErrUnknownKeyAlgorithm = errors.New("unknown key algorithm")
+
+// ErrKeyAlgorithmNotSupported is returned by issuers which don't generate keys, when a request asks for a key algorithm
+var ErrKeyAlgorithmNotSupported = errors.New("issuer does not support choosing a key algorithm")
+
+// ValidKeyAlgorithm reports whether alg is one of KeyAlgorithms
+func ValidKeyAlgorithm(alg string) bool {
+	for _, known := range KeyAlgorithms {
+		if alg == known {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyAlgorithmOf returns the key algorithm of a public key, or "" if it isn't one of KeyAlgorithms
+func KeyAlgorithmOf(pub crypto.PublicKey) string {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyAlgorithmRSA2048
+		case 3072:
+			return KeyAlgorithmRSA3072
+		case 4096:
+			return KeyAlgorithmRSA4096
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyAlgorithmECDSAP256
+		case elliptic.P384():
+			return KeyAlgorithmECDSAP384
+		}
+	case ed25519.PublicKey:
+		return KeyAlgorithmEd25519
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+package certsman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidKeyAlgorithm(t *testing.T) {
+	for _, alg := range KeyAlgorithms {
+		assert.True(t, ValidKeyAlgorithm(alg), "%s should be valid", alg)
+	}
+	assert.False(t, ValidKeyAlgorithm(""))
+	assert.False(t, ValidKeyAlgorithm("RSA2048"), "Algorithms are case sensitive")
+}
+
+func TestKeyAlgorithmOf(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.Equal(t, KeyAlgorithmECDSAP384, KeyAlgorithmOf(key.Public()))
+
+	key, _ = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	assert.Equal(t, "", KeyAlgorithmOf(key.Public()), "Curves which can't be requested don't have an algorithm")
+	assert.Equal(t, "", KeyAlgorithmOf(nil))
+}
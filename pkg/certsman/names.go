@@ -0,0 +1,98 @@
+package certsman
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Characters a plain storage key can't contain, as the encoded keys are built with them
+const storageKeySeparators = ":#"
+
+// NormalizeName lower-cases a DNS name and drops any trailing dot, or formats an IP address canonically, so that
+// different spellings of the same name compare equal
+func NormalizeName(name string) string {
+	name = strings.TrimSpace(name)
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String()
+	}
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// SubjectNames returns every name the certificate is requested for, normalized and without duplicates.  The hostname
+// comes first, followed by the other names in the order they were requested.
+func (req CertificateRequest) SubjectNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+
+	for _, name := range append([]string{req.Hostname}, req.Names...) {
+		name = NormalizeName(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// StorageKey is what the certificate for the request is stored and coalesced under.  It is derived from the sorted set
+// of names, so requests for the same names share a certificate whichever order they list them in, while a request for
+// a single name is keyed by just that name.  Otherwise each name is prefixed with its length, and a requested key
+// algorithm is added the same way after a "#", so no two different requests can ever share a key whatever their names
+// contain.
+func (req CertificateRequest) StorageKey() string {
+	names := req.SubjectNames()
+	sort.Strings(names)
+
+	if len(names) == 1 && req.KeyAlgorithm == "" && !strings.ContainsAny(names[0], storageKeySeparators) {
+		return names[0]
+	}
+
+	var key strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&key, "%d:%s", len(name), name)
+	}
+	if req.KeyAlgorithm != "" {
+		fmt.Fprintf(&key, "#%d:%s", len(req.KeyAlgorithm), req.KeyAlgorithm)
+	}
+	return key.String()
+}
+
+// ValidDNSName reports whether name is a DNS name made of letter, digit and hyphen labels, optionally with a leading
+// "*." wildcard label.  No label may start or end with a hyphen.
+func ValidDNSName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SplitNames separates names into the DNS names and IP addresses to put in a certificate's subject alternative names
+func SplitNames(names []string) ([]string, []net.IP) {
+	var dnsNames []string
+	var ips []net.IP
+
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, name)
+		}
+	}
+
+	return dnsNames, ips
+}
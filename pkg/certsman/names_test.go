@@ -0,0 +1,46 @@
+package certsman
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeName(t *testing.T) {
+	assert.Equal(t, "fooyork.com", NormalizeName(" FooYork.COM. "))
+	assert.Equal(t, "*.fooyork.com", NormalizeName("*.FooYork.com"))
+	assert.Equal(t, "2001:db8::1", NormalizeName("2001:DB8:0::1"), "IP addresses should be formatted canonically")
+}
+
+func TestSubjectNames(t *testing.T) {
+	req := CertificateRequest{Hostname: "www.fooyork.com", Names: []string{"FooYork.com", "10.0.0.1", "www.fooyork.com.", ""}}
+	assert.Equal(t, []string{"www.fooyork.com", "fooyork.com", "10.0.0.1"}, req.SubjectNames(), "The hostname should come first, without duplicates")
+
+	dnsNames, ips := SplitNames(req.SubjectNames())
+	assert.Equal(t, []string{"www.fooyork.com", "fooyork.com"}, dnsNames)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ips)
+}
+
+func TestStorageKey(t *testing.T) {
+	assert.Equal(t, "fooyork.com", CertificateRequest{Hostname: "fooyork.com"}.StorageKey(), "A single name should be its own key")
+
+	a := CertificateRequest{Hostname: "fooyork.com", Names: []string{"www.fooyork.com", "*.fooyork.com"}}
+	b := CertificateRequest{Hostname: "*.fooyork.com", Names: []string{"WWW.fooyork.com", "fooyork.com", "fooyork.com"}}
+	assert.Equal(t, a.StorageKey(), b.StorageKey(), "The same set of names should have the same key")
+
+	c := CertificateRequest{Hostname: "fooyork.com", Names: []string{"www.fooyork.com"}}
+	assert.NotEqual(t, a.StorageKey(), c.StorageKey(), "Different sets of names shouldn't collide")
+	assert.NotEqual(t, "fooyork.com", c.StorageKey())
+
+	// Even names the policy would refuse mustn't be able to pass for another request
+	pairs := [][2]CertificateRequest{
+		{{Hostname: "b.com,c.com"}, {Hostname: "b.com", Names: []string{"c.com"}}},
+		{{Hostname: "a.com#ecdsa-p384"}, {Hostname: "a.com", KeyAlgorithm: "ecdsa-p384"}},
+		{{Hostname: "a.com", Names: []string{"b.com#rsa2048"}}, {Hostname: "a.com", Names: []string{"b.com"}, KeyAlgorithm: "rsa2048"}},
+		{{Hostname: "1:a"}, {Hostname: "a"}},
+	}
+	for _, pair := range pairs {
+		assert.NotEqual(t, pair[0].StorageKey(), pair[1].StorageKey(), "%v and %v shouldn't share a key", pair[0], pair[1])
+	}
+}
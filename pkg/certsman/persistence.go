@@ -1,9 +1,49 @@
 package certsman
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrCertificateNotFound is returned by persistence when no certificate is stored for the request
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// ErrCertificateConflict is returned by persistence when an update's previous certificate no longer matches what is stored
+var ErrCertificateConflict = errors.New("stored certificate has changed")
+
+// ErrAccountNotFound is returned by account persistence when no account is stored for the ID or key
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrAccountKeyInUse is returned by account persistence when another account is already registered with the key
+var ErrAccountKeyInUse = errors.New("account key is already in use")
+
+// ErrAccountConflict is returned by account persistence when an update's previous account no longer matches what is stored
+var ErrAccountConflict = errors.New("stored account has changed")
+
 // CertificatePersistenceProvider provides a simple contract to use for anything that persists Certificates to memory, databases, cache, disk, etc.
+// Certificates are stored under the request's StorageKey, so that each distinct set of names has its own certificate.
+// The certificate's PrivateKey is stored along with it, and should be kept where only certsman can read it.
 type CertificatePersistenceProvider interface {
 	CreateCertificate(req CertificateRequest, cert Certificate) (bool, error)
 	RetrieveCertificate(req CertificateRequest) (Certificate, error)
 	UpdateCertificate(req CertificateRequest, prevCert Certificate, currentCert Certificate) (Certificate, error)
 	DeleteCertificate(req CertificateRequest) (bool, error)
 }
+
+// ContextCertificatePersistenceProvider is a CertificatePersistenceProvider whose calls can be cancelled or given a deadline through a context
+type ContextCertificatePersistenceProvider interface {
+	CertificatePersistenceProvider
+	CreateCertificateContext(ctx context.Context, req CertificateRequest, cert Certificate) (bool, error)
+	RetrieveCertificateContext(ctx context.Context, req CertificateRequest) (Certificate, error)
+	UpdateCertificateContext(ctx context.Context, req CertificateRequest, prevCert Certificate, currentCert Certificate) (Certificate, error)
+	DeleteCertificateContext(ctx context.Context, req CertificateRequest) (bool, error)
+}
+
+// AccountPersistenceProvider provides a contract for anything that persists the accounts registered with the ACME server.
+// An account's key must be unique, as it is how a signed request is matched to its account.
+type AccountPersistenceProvider interface {
+	CreateAccount(acct Account) error
+	RetrieveAccount(id string) (Account, error)
+	RetrieveAccountByKey(thumbprint string) (Account, error)
+	UpdateAccount(prevAcct Account, currentAcct Account) (Account, error)
+}
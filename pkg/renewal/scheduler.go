@@ -0,0 +1,256 @@
+/*
+The renewal package keeps managed certificates renewed ahead of their expiry.
+
+scheduler.go - tracks each managed certificate's NotAfter and renews it in the background, retrying with backoff
+
+*/
+package renewal
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default fraction of a certificate's lifetime, counted back from NotAfter, at which it gets renewed
+const DefaultRenewBeforeFraction = 1.0 / 3.0
+
+// Default fraction of the renewal lead time which is randomly added to spread renewals out
+const DefaultJitterFraction = 0.1
+
+// Default delay before retrying a failed renewal
+const DefaultMinRetryBackoff = time.Second
+
+// Default cap on the delay between retries of a failed renewal
+const DefaultMaxRetryBackoff = time.Minute
+
+// Config provides the settings for a Scheduler
+type Config struct {
+	// Renew when this fraction of the certificate's lifetime remains, e.g. 0.33 renews a 10 minute cert ~3.3 minutes early
+	RenewBeforeFraction float64
+	// Up to this fraction of the renewal lead time is added at random, so certificates issued together don't renew together.
+	// Zero is DefaultJitterFraction, and a negative fraction turns jitter off.
+	JitterFraction float64
+
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// Scheduler renews every certificate it manages ahead of its NotAfter, through a CerfificateService
+type Scheduler struct {
+	service *certsman.CerfificateService
+	config  Config
+
+	mu      sync.Mutex
+	ctx     context.Context
+	managed map[string]*managedCert
+}
+
+// managedCert is the renewal state of a single hostname
+type managedCert struct {
+	cancel context.CancelFunc
+
+	// When the current certificate expires, and when it is due to be renewed
+	notAfter  time.Time
+	renewAt   time.Time
+	failCount int
+}
+
+// NewScheduler creates a Scheduler which renews certificates through the service.  Nothing is renewed until Run is called.
+func NewScheduler(service *certsman.CerfificateService, cfg Config) *Scheduler {
+	if cfg.RenewBeforeFraction <= 0 || cfg.RenewBeforeFraction >= 1 {
+		cfg.RenewBeforeFraction = DefaultRenewBeforeFraction
+	}
+	if cfg.JitterFraction == 0 {
+		cfg.JitterFraction = DefaultJitterFraction
+	} else if cfg.JitterFraction < 0 {
+		cfg.JitterFraction = 0
+	}
+	if cfg.MinRetryBackoff <= 0 {
+		cfg.MinRetryBackoff = DefaultMinRetryBackoff
+	}
+	if cfg.MaxRetryBackoff < cfg.MinRetryBackoff {
+		cfg.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+
+	return &Scheduler{
+		service: service,
+		config:  cfg,
+		managed: make(map[string]*managedCert),
+	}
+}
+
+// Run starts renewing every managed certificate and blocks until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.ctx = ctx
+	for hostname, m := range s.managed {
+		s.start(hostname, m)
+	}
+	s.mu.Unlock()
+
+	<-ctx.Done()
+
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+}
+
+// Manage starts keeping the hostname's certificate renewed.  Managing a hostname twice has no effect.
+func (s *Scheduler) Manage(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.managed[hostname]; ok {
+		return
+	}
+
+	m := &managedCert{}
+	s.managed[hostname] = m
+
+	if s.ctx != nil {
+		s.start(hostname, m)
+	}
+}
+
+// Unmanage stops renewing the hostname's certificate.  The stored certificate is left as is.
+func (s *Scheduler) Unmanage(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.managed[hostname]; ok {
+		if m.cancel != nil {
+			m.cancel()
+		}
+		delete(s.managed, hostname)
+	}
+}
+
+// NextRenewal returns when the hostname's certificate expires and when it is next due to be renewed
+func (s *Scheduler) NextRenewal(hostname string) (notAfter time.Time, renewAt time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.managed[hostname]
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return m.notAfter, m.renewAt, true
+}
+
+// start runs the renewal loop for a hostname.  s.mu must be held.
+func (s *Scheduler) start(hostname string, m *managedCert) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	m.cancel = cancel
+	go s.renewLoop(ctx, hostname, m)
+}
+
+// renewLoop makes sure the hostname has a certificate, then renews it each time it comes due until ctx is done
+func (s *Scheduler) renewLoop(ctx context.Context, hostname string, m *managedCert) {
+	renew := false
+
+	for {
+		req := certsman.CertificateRequest{
+			RequestID: uuid.NewV4().String(),
+			Hostname:  hostname,
+		}
+
+		var resp certsman.CertificateResponse
+		if renew {
+			resp = s.service.RenewCertificateContext(ctx, req)
+		} else {
+			resp = s.service.GetOrCreateCertificateContext(ctx, req)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		var wait time.Duration
+		if resp.IsSuccess {
+			wait = s.scheduled(hostname, m, resp.Certificate)
+			renew = true
+		} else {
+			wait = s.failed(hostname, m, resp.Error)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// scheduled records a successfully issued or retrieved certificate and returns how long until it should be renewed
+func (s *Scheduler) scheduled(hostname string, m *managedCert, cert certsman.Certificate) time.Duration {
+	renewAt := s.renewalTime(cert, time.Now())
+
+	s.mu.Lock()
+	m.notAfter = cert.NotAfter
+	m.renewAt = renewAt
+	m.failCount = 0
+	s.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"Hostname": hostname,
+		"NotAfter": cert.NotAfter,
+		"RenewAt":  renewAt,
+	}).Debug("Scheduled certificate renewal")
+
+	return time.Until(renewAt)
+}
+
+// failed records a failed renewal and returns how long to back off before retrying
+func (s *Scheduler) failed(hostname string, m *managedCert, err error) time.Duration {
+	s.mu.Lock()
+	m.failCount++
+	failCount := m.failCount
+	s.mu.Unlock()
+
+	backoff := s.config.MinRetryBackoff
+	for i := 1; i < failCount && backoff < s.config.MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.config.MaxRetryBackoff {
+		backoff = s.config.MaxRetryBackoff
+	}
+
+	log.WithFields(log.Fields{
+		"Hostname":  hostname,
+		"FailCount": failCount,
+		"Backoff":   backoff,
+	}).Warn("Certificate renewal failed: ", err)
+
+	return backoff
+}
+
+// renewalTime works out when a certificate should be renewed.  Jitter only ever makes renewal earlier,
+// and a certificate which is already due is renewed right away.
+func (s *Scheduler) renewalTime(cert certsman.Certificate, now time.Time) time.Time {
+	notBefore := cert.NotBefore
+	if notBefore.IsZero() || notBefore.After(now) {
+		notBefore = now
+	}
+
+	lifetime := cert.NotAfter.Sub(notBefore)
+	if lifetime <= 0 {
+		return now
+	}
+
+	lead := time.Duration(float64(lifetime) * s.config.RenewBeforeFraction)
+	jitter := time.Duration(rand.Float64() * s.config.JitterFraction * float64(lead))
+
+	renewAt := cert.NotAfter.Add(-lead - jitter)
+	if renewAt.Before(now) {
+		return now
+	}
+	return renewAt
+}
@@ -0,0 +1,126 @@
+package renewal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/devnulled/certsman/pkg/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyIssuer issues short lived certificates, failing the first few attempts
+type flakyIssuer struct {
+	mu       sync.Mutex
+	issued   int
+	failures int
+	validity time.Duration
+}
+
+func (f *flakyIssuer) IssueCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures > 0 {
+		f.failures--
+		return certsman.Certificate{}, errors.New("issuer is having a bad day")
+	}
+
+	f.issued++
+	notBefore, notAfter := certsman.ValidityPeriod(f.validity)
+	return certsman.Certificate{Hostname: req.Hostname, CertificateBody: "cert", NotBefore: notBefore, NotAfter: notAfter}, nil
+}
+
+func (f *flakyIssuer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func newTestService(issuer certsman.CertificateIssuer) *certsman.CerfificateService {
+	return &certsman.CerfificateService{
+		Issuer:      issuer,
+		Persistence: &storage.InMemStorage{Cache: gcache.New(100).ARC().Build()},
+	}
+}
+
+func TestSchedulerRenewsBeforeExpiry(t *testing.T) {
+	issuer := &flakyIssuer{validity: time.Millisecond * 400}
+	svc := newTestService(issuer)
+
+	scheduler := NewScheduler(svc, Config{RenewBeforeFraction: 0.5})
+	scheduler.Manage("fooyork.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	// Readers should never find the persistence without a valid cert once the first one has been issued
+	time.Sleep(time.Millisecond * 50)
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	deadline := time.Now().Add(time.Millisecond * 1200)
+	for time.Now().Before(deadline) {
+		cert, err := svc.Persistence.RetrieveCertificate(req)
+		assert.Nil(t, err, "The cert should always be in persistence")
+		assert.False(t, cert.NeedsRenewal(time.Now(), 0), "The stored cert should never be expired")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	assert.True(t, issuer.count() >= 3, "The cert should have been renewed several times")
+
+	notAfter, renewAt, ok := scheduler.NextRenewal("fooyork.com")
+	assert.True(t, ok, "The hostname should be managed")
+	assert.True(t, renewAt.Before(notAfter), "Renewal should be scheduled before expiry")
+}
+
+func TestSchedulerRetriesWithBackoff(t *testing.T) {
+	issuer := &flakyIssuer{validity: time.Hour, failures: 3}
+	svc := newTestService(issuer)
+
+	scheduler := NewScheduler(svc, Config{MinRetryBackoff: time.Millisecond * 10, MaxRetryBackoff: time.Millisecond * 40})
+	scheduler.Manage("fooyork.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	time.Sleep(time.Millisecond * 300)
+
+	assert.Equal(t, 1, issuer.count(), "The cert should have been issued once the issuer recovered")
+	_, renewAt, _ := scheduler.NextRenewal("fooyork.com")
+	assert.True(t, renewAt.After(time.Now().Add(time.Minute*30)), "The next renewal should be based on the new cert")
+}
+
+func TestSchedulerUnmanage(t *testing.T) {
+	scheduler := NewScheduler(newTestService(&flakyIssuer{validity: time.Hour}), Config{})
+	scheduler.Manage("fooyork.com")
+	scheduler.Unmanage("fooyork.com")
+
+	_, _, ok := scheduler.NextRenewal("fooyork.com")
+	assert.False(t, ok, "The hostname should no longer be managed")
+}
+
+func TestRenewalTime(t *testing.T) {
+	scheduler := NewScheduler(nil, Config{RenewBeforeFraction: 0.25, JitterFraction: 0.5})
+	now := time.Now()
+	cert := certsman.Certificate{NotBefore: now, NotAfter: now.Add(time.Minute * 100)}
+
+	for i := 0; i < 100; i++ {
+		renewAt := scheduler.renewalTime(cert, now)
+		assert.False(t, renewAt.After(now.Add(time.Minute*75)), "Jitter should never push renewal later")
+		assert.False(t, renewAt.Before(now.Add(time.Minute*62)), "Jitter should be bounded")
+	}
+
+	expired := certsman.Certificate{NotBefore: now.Add(-time.Hour), NotAfter: now.Add(-time.Minute)}
+	assert.Equal(t, now, scheduler.renewalTime(expired, now), "An expired cert should be renewed right away")
+}
+
+func TestNewSchedulerJitterFraction(t *testing.T) {
+	assert.Equal(t, DefaultJitterFraction, NewScheduler(nil, Config{}).config.JitterFraction, "Renewals should be jittered by default")
+	assert.Equal(t, 0.0, NewScheduler(nil, Config{JitterFraction: -1}).config.JitterFraction, "A negative fraction should turn jitter off")
+	assert.Equal(t, 0.5, NewScheduler(nil, Config{JitterFraction: 0.5}).config.JitterFraction)
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+// persistenceFactory creates an empty provider for a conformance test, returning a func to clean it up
+type persistenceFactory func(t *testing.T) (certsman.ContextCertificatePersistenceProvider, func())
+
+// TestInMemStorageConformance runs the persistence conformance suite against InMemStorage
+func TestInMemStorageConformance(t *testing.T) {
+	runPersistenceConformance(t, func(t *testing.T) (certsman.ContextCertificatePersistenceProvider, func()) {
+		return &InMemStorage{Cache: gcache.New(100).ARC().Build()}, func() {}
+	})
+}
+
+// TestFileStorageConformance runs the persistence conformance suite against FileStorage
+func TestFileStorageConformance(t *testing.T) {
+	runPersistenceConformance(t, func(t *testing.T) (certsman.ContextCertificatePersistenceProvider, func()) {
+		store, _, cleanup := newTestFileStorage(t)
+		return store, cleanup
+	})
+}
+
+// runPersistenceConformance checks the behaviour every CertificatePersistenceProvider must have.
+// New providers should add a test which runs it.
+func runPersistenceConformance(t *testing.T, newProvider persistenceFactory) {
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	first := testCertificate("fooyork.com", "first")
+	second := testCertificate("fooyork.com", "second")
+
+	t.Run("CreateThenRetrieve", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		ok, err := store.CreateCertificate(req, first)
+		assert.True(t, ok)
+		assert.Nil(t, err, "Storing a certificate shouldn't fail")
+
+		stored, err := store.RetrieveCertificate(req)
+		assert.Nil(t, err, "The stored certificate should be found")
+		assert.Equal(t, first.CertificateBody, stored.CertificateBody)
+		assert.Equal(t, first.CertificateChain, stored.CertificateChain)
+		assert.Equal(t, first.PrivateKey, stored.PrivateKey, "The private key should be kept with the certificate")
+		assert.True(t, first.NotAfter.Equal(stored.NotAfter), "The NotAfter should be kept")
+	})
+
+	t.Run("UpdateKeepsRevocation", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		revoked := first
+		revoked.RevokedAt = time.Now()
+		revoked.RevocationReason = 1
+		_, err := store.UpdateCertificate(req, first, revoked)
+		assert.Nil(t, err)
+
+		stored, _ := store.RetrieveCertificate(req)
+		assert.True(t, stored.IsRevoked(), "The revocation should be kept")
+		assert.Equal(t, 1, stored.RevocationReason)
+
+		_, err = store.UpdateCertificate(req, first, second)
+		assert.Equal(t, certsman.ErrCertificateConflict, err, "The unrevoked certificate is no longer the stored one")
+	})
+
+	t.Run("CreateReplaces", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+		store.CreateCertificate(req, second)
+
+		stored, err := store.RetrieveCertificate(req)
+		assert.Nil(t, err)
+		assert.Equal(t, "second", stored.CertificateBody, "Creating again should replace the stored certificate")
+	})
+
+	t.Run("RetrieveMissing", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		_, err := store.RetrieveCertificate(req)
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "A missing certificate should be ErrCertificateNotFound")
+	})
+
+	t.Run("UpdateMatching", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		updated, err := store.UpdateCertificate(req, first, second)
+		assert.Nil(t, err, "Updating from the stored certificate should succeed")
+		assert.Equal(t, "second", updated.CertificateBody)
+
+		stored, _ := store.RetrieveCertificate(req)
+		assert.Equal(t, "second", stored.CertificateBody, "The update should have been stored")
+	})
+
+	t.Run("UpdateConflict", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		current, err := store.UpdateCertificate(req, second, second)
+		assert.Equal(t, certsman.ErrCertificateConflict, err, "Updating from a certificate that isn't stored should conflict")
+		assert.Equal(t, "first", current.CertificateBody, "A conflict should return what is actually stored")
+
+		stored, _ := store.RetrieveCertificate(req)
+		assert.Equal(t, "first", stored.CertificateBody, "A conflicting update shouldn't be stored")
+	})
+
+	t.Run("UpdateMissing", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		_, err := store.UpdateCertificate(req, first, second)
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "Updating a missing certificate should be ErrCertificateNotFound")
+
+		_, err = store.RetrieveCertificate(req)
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "Updating a missing certificate shouldn't create it")
+	})
+
+	t.Run("ConcurrentUpdatesOnlyOneWins", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		wins := 0
+
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				next := testCertificate("fooyork.com", "update-"+string(rune('a'+i)))
+				if _, err := store.UpdateCertificate(req, first, next); err == nil {
+					mu.Lock()
+					wins++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, 1, wins, "Only one update from the same previous certificate should succeed")
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		ok, err := store.DeleteCertificate(req)
+		assert.True(t, ok)
+		assert.Nil(t, err, "Deleting a stored certificate shouldn't fail")
+
+		_, err = store.RetrieveCertificate(req)
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "The certificate should be gone")
+	})
+
+	t.Run("DeleteMissing", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		ok, err := store.DeleteCertificate(req)
+		assert.False(t, ok)
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "Deleting a missing certificate should be ErrCertificateNotFound")
+	})
+
+	t.Run("HostnamesAreSeparate", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		other := certsman.CertificateRequest{RequestID: "blah", Hostname: "barmont.com"}
+		store.CreateCertificate(req, first)
+		store.CreateCertificate(other, testCertificate("barmont.com", "other"))
+		store.DeleteCertificate(other)
+
+		stored, err := store.RetrieveCertificate(req)
+		assert.Nil(t, err, "Deleting one hostname shouldn't affect another")
+		assert.Equal(t, "first", stored.CertificateBody)
+	})
+
+	t.Run("NameSetsAreSeparate", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		multi := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com", Names: []string{"www.fooyork.com", "10.0.0.1"}}
+		store.CreateCertificate(req, first)
+		store.CreateCertificate(multi, testCertificate("fooyork.com", "multi"))
+
+		stored, err := store.RetrieveCertificate(req)
+		assert.Nil(t, err)
+		assert.Equal(t, "first", stored.CertificateBody, "A certificate for more names shouldn't replace the hostname's own")
+
+		reordered := certsman.CertificateRequest{Hostname: "WWW.FooYork.com.", Names: []string{"10.0.0.1", "fooyork.com"}}
+		stored, err = store.RetrieveCertificate(reordered)
+		assert.Nil(t, err, "The same names in another order or case should find the certificate")
+		assert.Equal(t, "multi", stored.CertificateBody)
+		assert.Equal(t, "fooyork.com", stored.Hostname)
+
+		_, err = store.RetrieveCertificate(certsman.CertificateRequest{Hostname: "fooyork.com", Names: []string{"www.fooyork.com"}})
+		assert.Equal(t, certsman.ErrCertificateNotFound, err, "A subset of the names shouldn't find the certificate")
+
+		wildcard := certsman.CertificateRequest{Hostname: "*.fooyork.com"}
+		store.CreateCertificate(wildcard, testCertificate("*.fooyork.com", "wildcard"))
+		stored, err = store.RetrieveCertificate(wildcard)
+		assert.Nil(t, err, "Wildcard certificates should be stored")
+		assert.Equal(t, "wildcard", stored.CertificateBody)
+	})
+
+	t.Run("KeyAlgorithmsAreSeparate", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		rsaReq := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com", KeyAlgorithm: certsman.KeyAlgorithmRSA2048}
+		rsaCert := testCertificate("fooyork.com", "rsa")
+		rsaCert.KeyAlgorithm = certsman.KeyAlgorithmRSA2048
+
+		store.CreateCertificate(req, first)
+		store.CreateCertificate(rsaReq, rsaCert)
+
+		stored, err := store.RetrieveCertificate(rsaReq)
+		assert.Nil(t, err)
+		assert.Equal(t, "rsa", stored.CertificateBody)
+		assert.Equal(t, certsman.KeyAlgorithmRSA2048, stored.KeyAlgorithm, "The key algorithm should be kept")
+
+		stored, _ = store.RetrieveCertificate(req)
+		assert.Equal(t, "first", stored.CertificateBody, "Certificates with another key algorithm shouldn't replace each other")
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		store, cleanup := newProvider(t)
+		defer cleanup()
+
+		store.CreateCertificate(req, first)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := store.CreateCertificateContext(ctx, req, second)
+		assert.Equal(t, context.Canceled, err)
+		_, err = store.RetrieveCertificateContext(ctx, req)
+		assert.Equal(t, context.Canceled, err)
+		_, err = store.UpdateCertificateContext(ctx, req, first, second)
+		assert.Equal(t, context.Canceled, err)
+		_, err = store.DeleteCertificateContext(ctx, req)
+		assert.Equal(t, context.Canceled, err)
+
+		stored, _ := store.RetrieveCertificate(req)
+		assert.Equal(t, "first", stored.CertificateBody, "Nothing should change once the context is done")
+	})
+}
@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// File names used inside each generation of a stored certificate
+const (
+	fileCertificate = "cert.pem"
+	fileChain       = "chain.pem"
+	filePrivateKey  = "key.pem"
+	fileMetadata    = "meta.json"
+
+	// Names the generation directory which holds the current certificate
+	fileCurrent = "current"
+)
+
+// Longest storage key which is used as a directory name as-is
+const maxPlainDirName = 200
+
+// Storage keys which are safe to use as a directory name as-is.  Upper case is excluded so that
+// case-insensitive file systems can't fold two keys into one directory.
+var plainDirName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+// FileStorage is a type of persistence which stores each certificate and its key as files under a directory,
+// so that certificates survive a restart.
+//
+// Every write goes into a new generation directory, and only becomes visible once the hostname's "current"
+// file is atomically replaced to point at it, so readers never see a half written certificate.
+type FileStorage struct {
+	dir string
+
+	// Serializes writes so that compare-and-swap updates are atomic within this process
+	mu sync.Mutex
+}
+
+// fileMetadataRecord is what gets stored in meta.json alongside the PEM files
+type fileMetadataRecord struct {
+	Hostname string `json:"hostname"`
+	// The storage key, when it isn't just the hostname
+	Key string `json:"key,omitempty"`
+
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
+
+	RevokedAt        time.Time `json:"revokedAt"`
+	RevocationReason int       `json:"revocationReason"`
+}
+
+// NewFileStorage creates a FileStorage which keeps certificates under dir, creating it if needed
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{dir: dir}, nil
+}
+
+// CreateCertificate stores a certificate on disk, replacing any certificate already stored for the hostname
+func (f *FileStorage) CreateCertificate(req certsman.CertificateRequest, cert certsman.Certificate) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+	}).Trace("Storing certificate on disk")
+
+	if err := f.write(req.StorageKey(), cert); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RetrieveCertificate retrieves a stored certificate from disk
+func (f *FileStorage) RetrieveCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	cert, err := f.read(req.StorageKey())
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Trace("Unable to find certificate on disk")
+		return certsman.Certificate{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"RequestID": req.RequestID,
+		"Hostname":  req.Hostname,
+	}).Trace("Found certificate on disk")
+	return cert, nil
+}
+
+// UpdateCertificate replaces the stored certificate with currentCert, but only if the stored certificate is still prevCert
+func (f *FileStorage) UpdateCertificate(req certsman.CertificateRequest, prevCert certsman.Certificate, currentCert certsman.Certificate) (certsman.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stored, err := f.read(req.StorageKey())
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	if !sameCertificate(stored, prevCert) {
+		return stored, certsman.ErrCertificateConflict
+	}
+
+	if err := f.write(req.StorageKey(), currentCert); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return currentCert, nil
+}
+
+// DeleteCertificate removes a stored certificate and its key from disk
+func (f *FileStorage) DeleteCertificate(req certsman.CertificateRequest) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	hostDir := f.hostDir(req.StorageKey())
+	if _, err := os.Stat(filepath.Join(hostDir, fileCurrent)); os.IsNotExist(err) {
+		return false, certsman.ErrCertificateNotFound
+	}
+
+	// Remove the pointer first, so readers see the certificate as gone before its files are
+	if err := os.Remove(filepath.Join(hostDir, fileCurrent)); err != nil {
+		return false, err
+	}
+	return true, os.RemoveAll(hostDir)
+}
+
+// CreateCertificateContext stores a certificate on disk, unless ctx is already done
+func (f *FileStorage) CreateCertificateContext(ctx context.Context, req certsman.CertificateRequest, cert certsman.Certificate) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return f.CreateCertificate(req, cert)
+}
+
+// RetrieveCertificateContext retrieves a stored certificate from disk, unless ctx is already done
+func (f *FileStorage) RetrieveCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return f.RetrieveCertificate(req)
+}
+
+// UpdateCertificateContext updates a stored certificate on disk, unless ctx is already done
+func (f *FileStorage) UpdateCertificateContext(ctx context.Context, req certsman.CertificateRequest, prevCert certsman.Certificate, currentCert certsman.Certificate) (certsman.Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return f.UpdateCertificate(req, prevCert, currentCert)
+}
+
+// DeleteCertificateContext removes a stored certificate from disk, unless ctx is already done
+func (f *FileStorage) DeleteCertificateContext(ctx context.Context, req certsman.CertificateRequest) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return f.DeleteCertificate(req)
+}
+
+// hostDir returns the directory the certificates stored under a key are kept in.  Keys which aren't safe to use as
+// a file name (path separators, "..", upper case, wildcards, several names, very long names, etc) are hashed instead.
+func (f *FileStorage) hostDir(key string) string {
+	if len(key) <= maxPlainDirName && plainDirName.MatchString(key) {
+		return filepath.Join(f.dir, key)
+	}
+
+	// Hashed names start with "_", which a plain name never can, so the two can't collide
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.dir, "_"+hex.EncodeToString(sum[:]))
+}
+
+// read loads the current generation of the certificate stored under a key
+func (f *FileStorage) read(key string) (certsman.Certificate, error) {
+	hostDir := f.hostDir(key)
+
+	current, err := ioutil.ReadFile(filepath.Join(hostDir, fileCurrent))
+	if os.IsNotExist(err) {
+		return certsman.Certificate{}, certsman.ErrCertificateNotFound
+	}
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	genDir := filepath.Join(hostDir, strings.TrimSpace(string(current)))
+
+	metaJSON, err := ioutil.ReadFile(filepath.Join(genDir, fileMetadata))
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	var meta fileMetadataRecord
+	if err := json.Unmarshal(metaJSON, &meta); err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	// Guards against two keys ever hashing to the same directory.  Records written before keys covered several
+	// names don't have one, as their key was the hostname.
+	storedKey := meta.Key
+	if storedKey == "" {
+		storedKey = meta.Hostname
+	}
+	if storedKey != key {
+		return certsman.Certificate{}, certsman.ErrCertificateNotFound
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(genDir, fileCertificate))
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	chain, err := readOptionalFile(filepath.Join(genDir, fileChain))
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	privateKey, err := readOptionalFile(filepath.Join(genDir, filePrivateKey))
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	return certsman.Certificate{
+		Hostname:         meta.Hostname,
+		CertificateBody:  string(body),
+		CertificateChain: string(chain),
+		PrivateKey:       string(privateKey),
+		NotBefore:        meta.NotBefore,
+		NotAfter:         meta.NotAfter,
+		KeyAlgorithm:     meta.KeyAlgorithm,
+		RevokedAt:        meta.RevokedAt,
+		RevocationReason: meta.RevocationReason,
+	}, nil
+}
+
+// write stores the certificate under a key as a new generation and then atomically makes it the current one.
+// f.mu must be held.
+func (f *FileStorage) write(key string, cert certsman.Certificate) error {
+	hostDir := f.hostDir(key)
+	if err := os.MkdirAll(hostDir, 0700); err != nil {
+		return err
+	}
+
+	generation := strconv.FormatInt(time.Now().UnixNano(), 16)
+	genDir, err := ioutil.TempDir(hostDir, generation+"-")
+	if err != nil {
+		return err
+	}
+
+	record := fileMetadataRecord{
+		Hostname:  cert.Hostname,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+
+		KeyAlgorithm: cert.KeyAlgorithm,
+
+		RevokedAt:        cert.RevokedAt,
+		RevocationReason: cert.RevocationReason,
+	}
+	if key != cert.Hostname {
+		record.Key = key
+	}
+
+	meta, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data string
+		perm os.FileMode
+	}{
+		{fileCertificate, cert.CertificateBody, 0644},
+		{fileChain, cert.CertificateChain, 0644},
+		{filePrivateKey, cert.PrivateKey, 0600},
+		{fileMetadata, string(meta), 0644},
+	}
+
+	for _, file := range files {
+		if file.data == "" && file.name != fileCertificate {
+			continue
+		}
+		if err := writeFileAtomic(filepath.Join(genDir, file.name), []byte(file.data), file.perm); err != nil {
+			os.RemoveAll(genDir)
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(hostDir, fileCurrent), []byte(filepath.Base(genDir)+"\n"), 0644); err != nil {
+		os.RemoveAll(genDir)
+		return err
+	}
+
+	f.pruneGenerations(hostDir, filepath.Base(genDir))
+	return nil
+}
+
+// pruneGenerations removes old generations, keeping the current one and the one before it so that
+// readers which looked up the previous generation just before the swap can still finish reading it
+func (f *FileStorage) pruneGenerations(hostDir string, current string) {
+	entries, err := ioutil.ReadDir(hostDir)
+	if err != nil {
+		return
+	}
+
+	var generations []string
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != current {
+			generations = append(generations, entry.Name())
+		}
+	}
+
+	// Generation names start with a fixed width hex timestamp, so they sort oldest first
+	sort.Strings(generations)
+	for i := 0; i < len(generations)-1; i++ {
+		os.RemoveAll(filepath.Join(hostDir, generations[i]))
+	}
+}
+
+// writeFileAtomic writes data to a temp file next to path, syncs it, and renames it over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+
+	// Remove the temp file if anything goes wrong before the rename
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// readOptionalFile reads a file, treating a missing file as empty
+func readOptionalFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
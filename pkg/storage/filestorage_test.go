@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFileStorage creates a FileStorage in a temp dir, returning a func to clean it up
+func newTestFileStorage(t *testing.T) (*FileStorage, string, func()) {
+	dir, err := ioutil.TempDir("", "certsman-storage")
+	assert.Nil(t, err)
+
+	store, err := NewFileStorage(dir)
+	assert.Nil(t, err, "Creating the file storage shouldn't fail")
+
+	return store, dir, func() { os.RemoveAll(dir) }
+}
+
+func testCertificate(hostname string, body string) certsman.Certificate {
+	notBefore, notAfter := certsman.ValidityPeriod(time.Hour)
+	return certsman.Certificate{
+		Hostname:         hostname,
+		CertificateBody:  body,
+		CertificateChain: "chain-" + body,
+		PrivateKey:       "key-" + body,
+		NotBefore:        notBefore,
+		NotAfter:         notAfter,
+	}
+}
+
+func TestFileStorageSurvivesRestart(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	cert := testCertificate("fooyork.com", "foo-fooyork.com")
+	_, err := store.CreateCertificate(req, cert)
+	assert.Nil(t, err, "Storing the certificate shouldn't fail")
+
+	restarted, _ := NewFileStorage(dir)
+	stored, err := restarted.RetrieveCertificate(req)
+	assert.Nil(t, err, "The certificate should be found after a restart")
+	assert.Equal(t, cert.CertificateBody, stored.CertificateBody)
+	assert.Equal(t, cert.CertificateChain, stored.CertificateChain)
+	assert.Equal(t, cert.PrivateKey, stored.PrivateKey)
+	assert.True(t, cert.NotAfter.Equal(stored.NotAfter))
+}
+
+func TestFileStoragePermissions(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	store.CreateCertificate(req, testCertificate("fooyork.com", "body"))
+
+	keys, _ := filepath.Glob(filepath.Join(dir, "fooyork.com", "*", filePrivateKey))
+	assert.Len(t, keys, 1, "The key should have been written")
+
+	info, err := os.Stat(keys[0])
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "The key should only be readable by its owner")
+
+	info, _ = os.Stat(filepath.Join(dir, "fooyork.com"))
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "The hostname directory should only be accessible by its owner")
+}
+
+func TestFileStorageUnsafeHostnames(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	hostnames := []string{"../../etc/passwd", "a/b", "..", "*.fooyork.com", "foo\x00york", strings.Repeat("a", 300), "fooyork.com"}
+
+	for _, hostname := range hostnames {
+		_, err := store.CreateCertificate(certsman.CertificateRequest{Hostname: hostname}, testCertificate(hostname, "cert-"+hostname))
+		assert.Nil(t, err, "Storing %q shouldn't fail", hostname)
+	}
+
+	for _, hostname := range hostnames {
+		stored, err := store.RetrieveCertificate(certsman.CertificateRequest{Hostname: hostname})
+		assert.Nil(t, err, "%q should be found", hostname)
+		assert.Equal(t, "cert-"+hostname, stored.CertificateBody, "%q shouldn't collide with another hostname", hostname)
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	assert.Len(t, entries, len(hostnames), "Every hostname should have its own directory inside the storage dir")
+}
+
+func TestFileStorageKeepsFewGenerations(t *testing.T) {
+	store, dir, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	req := certsman.CertificateRequest{Hostname: "fooyork.com"}
+	for i := 0; i < 10; i++ {
+		store.CreateCertificate(req, testCertificate("fooyork.com", "body"))
+	}
+
+	generations, _ := filepath.Glob(filepath.Join(dir, "fooyork.com", "*", fileMetadata))
+	assert.Len(t, generations, 2, "Only the current and previous generations should be kept")
+}
+
+func TestFileStorageUpdateAndDelete(t *testing.T) {
+	store, _, cleanup := newTestFileStorage(t)
+	defer cleanup()
+
+	req := certsman.CertificateRequest{Hostname: "fooyork.com"}
+	first := testCertificate("fooyork.com", "first")
+	second := testCertificate("fooyork.com", "second")
+	store.CreateCertificate(req, first)
+
+	_, err := store.UpdateCertificate(req, second, first)
+	assert.Equal(t, certsman.ErrCertificateConflict, err, "Updating from a cert that isn't stored should conflict")
+
+	updated, err := store.UpdateCertificate(req, first, second)
+	assert.Nil(t, err, "Updating from the stored cert should succeed")
+	assert.Equal(t, "second", updated.CertificateBody)
+
+	ok, err := store.DeleteCertificate(req)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	_, err = store.RetrieveCertificate(req)
+	assert.Equal(t, certsman.ErrCertificateNotFound, err, "The cert should be gone")
+
+	_, err = store.DeleteCertificate(req)
+	assert.Equal(t, certsman.ErrCertificateNotFound, err, "Deleting a missing cert should say so")
+}
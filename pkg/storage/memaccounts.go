@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+)
+
+// InMemAccountStorage is a type of account persistence which keeps accounts in machine local memory.  Not durable.
+// The zero value is ready to use.
+type InMemAccountStorage struct {
+	mu sync.RWMutex
+	// Accounts by ID
+	accounts map[string]certsman.Account
+	// Account IDs by key thumbprint
+	byKey map[string]string
+}
+
+// CreateAccount stores a new account, unless another account already has its key
+func (m *InMemAccountStorage) CreateAccount(acct certsman.Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.accounts == nil {
+		m.accounts = make(map[string]certsman.Account)
+		m.byKey = make(map[string]string)
+	}
+
+	if _, ok := m.byKey[acct.KeyThumbprint]; ok {
+		return certsman.ErrAccountKeyInUse
+	}
+
+	log.WithFields(log.Fields{
+		"AccountID": acct.ID,
+	}).Trace("Storing account")
+
+	m.accounts[acct.ID] = copyAccount(acct)
+	m.byKey[acct.KeyThumbprint] = acct.ID
+	return nil
+}
+
+// RetrieveAccount retrieves an account by its ID
+func (m *InMemAccountStorage) RetrieveAccount(id string) (certsman.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	acct, ok := m.accounts[id]
+	if !ok {
+		return certsman.Account{}, certsman.ErrAccountNotFound
+	}
+	return copyAccount(acct), nil
+}
+
+// RetrieveAccountByKey retrieves the account registered with the key which has the thumbprint
+func (m *InMemAccountStorage) RetrieveAccountByKey(thumbprint string) (certsman.Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.byKey[thumbprint]
+	if !ok {
+		return certsman.Account{}, certsman.ErrAccountNotFound
+	}
+	return copyAccount(m.accounts[id]), nil
+}
+
+// UpdateAccount replaces the stored account with currentAcct, but only if the stored account is still prevAcct.
+// If it has changed, the stored account is returned along with ErrAccountConflict.
+func (m *InMemAccountStorage) UpdateAccount(prevAcct certsman.Account, currentAcct certsman.Account) (certsman.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.accounts[prevAcct.ID]
+	if !ok || currentAcct.ID != prevAcct.ID {
+		return certsman.Account{}, certsman.ErrAccountNotFound
+	}
+
+	if !sameAccount(stored, prevAcct) {
+		return copyAccount(stored), certsman.ErrAccountConflict
+	}
+
+	if currentAcct.KeyThumbprint != stored.KeyThumbprint {
+		if _, ok := m.byKey[currentAcct.KeyThumbprint]; ok {
+			return copyAccount(stored), certsman.ErrAccountKeyInUse
+		}
+		delete(m.byKey, stored.KeyThumbprint)
+		m.byKey[currentAcct.KeyThumbprint] = currentAcct.ID
+	}
+
+	m.accounts[currentAcct.ID] = copyAccount(currentAcct)
+	return copyAccount(currentAcct), nil
+}
+
+// copyAccount copies an account so callers can't modify the stored contacts
+func copyAccount(acct certsman.Account) certsman.Account {
+	acct.Contact = append([]string(nil), acct.Contact...)
+	return acct
+}
+
+// sameAccount reports whether two accounts are the same version of one account, for compare-and-swap updates
+func sameAccount(a certsman.Account, b certsman.Account) bool {
+	if a.ID != b.ID || a.Status != b.Status || a.KeyThumbprint != b.KeyThumbprint ||
+		a.TermsOfServiceAgreed != b.TermsOfServiceAgreed || len(a.Contact) != len(b.Contact) {
+		return false
+	}
+
+	for i := range a.Contact {
+		if a.Contact[i] != b.Contact[i] {
+			return false
+		}
+	}
+	return true
+}
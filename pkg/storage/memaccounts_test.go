@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/devnulled/certsman/pkg/certsman"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAccount(id string, thumbprint string) certsman.Account {
+	return certsman.Account{
+		ID:            id,
+		Status:        certsman.AccountStatusValid,
+		Contact:       []string{"mailto:admin@fooyork.com"},
+		Key:           "{}",
+		KeyThumbprint: thumbprint,
+	}
+}
+
+func TestInMemAccountStorageCreateAndRetrieve(t *testing.T) {
+	store := &InMemAccountStorage{}
+
+	_, err := store.RetrieveAccount("acct1")
+	assert.Equal(t, certsman.ErrAccountNotFound, err, "A missing account should be ErrAccountNotFound")
+
+	assert.Nil(t, store.CreateAccount(testAccount("acct1", "key1")))
+	assert.Equal(t, certsman.ErrAccountKeyInUse, store.CreateAccount(testAccount("acct2", "key1")), "Keys should be unique")
+
+	byID, err := store.RetrieveAccount("acct1")
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", byID.KeyThumbprint)
+
+	byKey, err := store.RetrieveAccountByKey("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "acct1", byKey.ID)
+
+	byID.Contact[0] = "mailto:someone@else.com"
+	again, _ := store.RetrieveAccount("acct1")
+	assert.Equal(t, "mailto:admin@fooyork.com", again.Contact[0], "Callers shouldn't be able to modify the stored account")
+}
+
+func TestInMemAccountStorageUpdate(t *testing.T) {
+	store := &InMemAccountStorage{}
+	first := testAccount("acct1", "key1")
+	store.CreateAccount(first)
+	store.CreateAccount(testAccount("acct2", "key2"))
+
+	second := testAccount("acct1", "key3")
+	second.Contact = []string{"mailto:ops@fooyork.com"}
+
+	updated, err := store.UpdateAccount(first, second)
+	assert.Nil(t, err, "Updating from the stored account should succeed")
+	assert.Equal(t, "key3", updated.KeyThumbprint)
+
+	_, err = store.RetrieveAccountByKey("key1")
+	assert.Equal(t, certsman.ErrAccountNotFound, err, "The old key shouldn't find the account anymore")
+	byKey, _ := store.RetrieveAccountByKey("key3")
+	assert.Equal(t, "acct1", byKey.ID, "The new key should find the account")
+
+	_, err = store.UpdateAccount(first, second)
+	assert.Equal(t, certsman.ErrAccountConflict, err, "Updating from an account that isn't stored should conflict")
+
+	_, err = store.UpdateAccount(second, testAccount("acct1", "key2"))
+	assert.Equal(t, certsman.ErrAccountKeyInUse, err, "An update can't take another account's key")
+
+	_, err = store.UpdateAccount(testAccount("missing", "key4"), testAccount("missing", "key4"))
+	assert.Equal(t, certsman.ErrAccountNotFound, err)
+}
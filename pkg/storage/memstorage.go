@@ -3,11 +3,17 @@
 The storage package provides implementations of persistence
 
 memstorage.go - In-Memory storage for one instance of certsman.  Not durable.
+memaccounts.go - In-Memory storage for the accounts registered with the ACME server.  Not durable.
+filestorage.go - File-system storage which keeps certificates and their keys under a directory.  Durable.
 
 */
 package storage
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/bluele/gcache"
 	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
@@ -18,25 +24,30 @@ import (
 // InMemStorage in a type of persistence which is a machine local memory cache
 type InMemStorage struct {
 	Cache gcache.Cache
+
+	// Serializes writes so that compare-and-swap updates are atomic
+	mu sync.Mutex
 }
 
 // CreateCertificate creates a cached certificate record in memory
-func (i InMemStorage) CreateCertificate(req certsman.CertificateRequest, cert certsman.Certificate) (bool, error) {
+func (i *InMemStorage) CreateCertificate(req certsman.CertificateRequest, cert certsman.Certificate) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 
 	log.WithFields(log.Fields{
 		"RequestID": req.RequestID,
 		"Hostname":  req.Hostname,
 	}).Trace("Storing certificate")
 
-	i.Cache.Set(req.Hostname, cert)
+	if err := i.set(req.StorageKey(), cert); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
 // RetrieveCertificate retrives a cached certificate record from memory
-func (i InMemStorage) RetrieveCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
-
-	var cert certsman.Certificate
-	cachedCert, err := i.Cache.Get(req.Hostname)
+func (i *InMemStorage) RetrieveCertificate(req certsman.CertificateRequest) (certsman.Certificate, error) {
+	cert, err := i.get(req.StorageKey())
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -46,8 +57,6 @@ func (i InMemStorage) RetrieveCertificate(req certsman.CertificateRequest) (cert
 		return certsman.Certificate{}, err
 	}
 
-	mapstructure.Decode(cachedCert, &cert)
-
 	log.WithFields(log.Fields{
 		"RequestID": req.RequestID,
 		"Hostname":  req.Hostname,
@@ -55,12 +64,106 @@ func (i InMemStorage) RetrieveCertificate(req certsman.CertificateRequest) (cert
 	return cert, nil
 }
 
-// UpdateCertificate updates a cached certificate record from memory but is currently not implemented
-func (i InMemStorage) UpdateCertificate(req certsman.CertificateRequest, prevCert certsman.Certificate, currentCert certsman.Certificate) (certsman.Certificate, error) {
-	return certsman.Certificate{}, nil
+// UpdateCertificate replaces the cached certificate with currentCert, but only if the cached certificate is still prevCert.
+// If it has changed, the cached certificate is returned along with ErrCertificateConflict.
+func (i *InMemStorage) UpdateCertificate(req certsman.CertificateRequest, prevCert certsman.Certificate, currentCert certsman.Certificate) (certsman.Certificate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	stored, err := i.get(req.StorageKey())
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	if !sameCertificate(stored, prevCert) {
+		log.WithFields(log.Fields{
+			"RequestID": req.RequestID,
+			"Hostname":  req.Hostname,
+		}).Debug("Cached certificate changed before it could be updated")
+		return stored, certsman.ErrCertificateConflict
+	}
+
+	if err := i.set(req.StorageKey(), currentCert); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return currentCert, nil
 }
 
-// DeleteCertificate removes a cached certificate record from memory but is currently not implemented
-func (i InMemStorage) DeleteCertificate(req certsman.CertificateRequest) (bool, error) {
+// DeleteCertificate removes a cached certificate record from memory
+func (i *InMemStorage) DeleteCertificate(req certsman.CertificateRequest) (bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Expired entries are still in the cache until they are accessed, so check first
+	if _, err := i.get(req.StorageKey()); err != nil {
+		return false, err
+	}
+
+	i.Cache.Remove(req.StorageKey())
 	return true, nil
 }
+
+// get looks up a cached certificate, returning ErrCertificateNotFound if there isn't one
+func (i *InMemStorage) get(key string) (certsman.Certificate, error) {
+	var cert certsman.Certificate
+	cachedCert, err := i.Cache.Get(key)
+
+	if err == gcache.KeyNotFoundError {
+		return certsman.Certificate{}, certsman.ErrCertificateNotFound
+	}
+	if err != nil {
+		return certsman.Certificate{}, err
+	}
+
+	mapstructure.Decode(cachedCert, &cert)
+	return cert, nil
+}
+
+// set caches a certificate, letting the cache expire the entry when the certificate itself expires
+func (i *InMemStorage) set(key string, cert certsman.Certificate) error {
+	if cert.NotAfter.IsZero() {
+		return i.Cache.Set(key, cert)
+	}
+
+	return i.Cache.SetWithExpire(key, cert, time.Until(cert.NotAfter))
+}
+
+// CreateCertificateContext creates a cached certificate record in memory, unless ctx is already done
+func (i *InMemStorage) CreateCertificateContext(ctx context.Context, req certsman.CertificateRequest, cert certsman.Certificate) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return i.CreateCertificate(req, cert)
+}
+
+// RetrieveCertificateContext retrives a cached certificate record from memory, unless ctx is already done
+func (i *InMemStorage) RetrieveCertificateContext(ctx context.Context, req certsman.CertificateRequest) (certsman.Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return i.RetrieveCertificate(req)
+}
+
+// UpdateCertificateContext updates a cached certificate record in memory, unless ctx is already done
+func (i *InMemStorage) UpdateCertificateContext(ctx context.Context, req certsman.CertificateRequest, prevCert certsman.Certificate, currentCert certsman.Certificate) (certsman.Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return certsman.Certificate{}, err
+	}
+	return i.UpdateCertificate(req, prevCert, currentCert)
+}
+
+// DeleteCertificateContext removes a cached certificate record from memory, unless ctx is already done
+func (i *InMemStorage) DeleteCertificateContext(ctx context.Context, req certsman.CertificateRequest) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return i.DeleteCertificate(req)
+}
+
+// sameCertificate reports whether two certificates are the same one, for compare-and-swap updates
+func sameCertificate(a certsman.Certificate, b certsman.Certificate) bool {
+	return a.Hostname == b.Hostname &&
+		a.CertificateBody == b.CertificateBody &&
+		a.NotAfter.Equal(b.NotAfter) &&
+		a.RevokedAt.Equal(b.RevokedAt)
+}
@@ -1,23 +1,110 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/bluele/gcache"
+	"github.com/devnulled/certsman/pkg/certsman"
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestInMemStorage() *InMemStorage {
+	return &InMemStorage{Cache: gcache.New(100).ARC().Build()}
+}
+
 func TestCreateCertificate(t *testing.T) {
-	assert.Nil(t, nil, "This should be nil")
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+
+	ok, err := store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", NotAfter: time.Now().Add(time.Hour)})
+	assert.Nil(t, err, "Storing a certificate shouldn't fail")
+	assert.True(t, ok)
+}
+
+func TestCreateCertificateFailure(t *testing.T) {
+	store := &InMemStorage{Cache: gcache.New(100).SerializeFunc(func(key interface{}, value interface{}) (interface{}, error) {
+		return nil, errors.New("cache is broken")
+	}).Build()}
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+
+	ok, err := store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", NotAfter: time.Now().Add(time.Hour)})
+	assert.NotNil(t, err)
+	assert.False(t, ok, "A certificate which couldn't be stored shouldn't be reported as created")
 }
 
 func TestRetrieveCertificate(t *testing.T) {
-	assert.Nil(t, nil, "This should be nil")
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	notAfter := time.Now().Add(time.Hour)
+
+	_, err := store.RetrieveCertificate(req)
+	assert.NotNil(t, err, "A missing certificate should return an error")
+
+	store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", CertificateBody: "foo-fooyork.com", NotAfter: notAfter})
+
+	cert, err := store.RetrieveCertificate(req)
+	assert.Nil(t, err, "The stored certificate should be found")
+	assert.Equal(t, "foo-fooyork.com", cert.CertificateBody)
+	assert.True(t, notAfter.Equal(cert.NotAfter), "The NotAfter should survive the cache")
+}
+
+func TestRetrieveCertificateExpiresAtNotAfter(t *testing.T) {
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+
+	store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", NotAfter: time.Now().Add(time.Millisecond * 50)})
+	time.Sleep(time.Millisecond * 100)
+
+	_, err := store.RetrieveCertificate(req)
+	assert.NotNil(t, err, "The certificate should have been expired from the cache")
 }
 
 func TestUpdateCertificate(t *testing.T) {
-	assert.Nil(t, nil, "This should be nil")
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	first := certsman.Certificate{Hostname: "fooyork.com", CertificateBody: "first", NotAfter: time.Now().Add(time.Hour)}
+	second := certsman.Certificate{Hostname: "fooyork.com", CertificateBody: "second", NotAfter: time.Now().Add(time.Hour * 2)}
+	store.CreateCertificate(req, first)
+
+	_, err := store.UpdateCertificate(req, second, first)
+	assert.Equal(t, certsman.ErrCertificateConflict, err, "Updating from a cert that isn't cached should conflict")
+
+	updated, err := store.UpdateCertificate(req, first, second)
+	assert.Nil(t, err, "Updating from the cached cert should succeed")
+	assert.Equal(t, "second", updated.CertificateBody)
+
+	cert, _ := store.RetrieveCertificate(req)
+	assert.Equal(t, "second", cert.CertificateBody, "The update should be cached")
 }
 
 func TestDeleteCertificate(t *testing.T) {
-	assert.Nil(t, nil, "This should be nil")
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", NotAfter: time.Now().Add(time.Hour)})
+
+	ok, err := store.DeleteCertificate(req)
+	assert.True(t, ok)
+	assert.Nil(t, err, "Deleting a cached cert shouldn't fail")
+
+	_, err = store.RetrieveCertificate(req)
+	assert.Equal(t, certsman.ErrCertificateNotFound, err, "The cert should be gone")
+
+	ok, err = store.DeleteCertificate(req)
+	assert.False(t, ok)
+	assert.Equal(t, certsman.ErrCertificateNotFound, err, "Deleting a missing cert should say so")
+}
+
+func TestRetrieveCertificateContextCancelled(t *testing.T) {
+	store := newTestInMemStorage()
+	req := certsman.CertificateRequest{RequestID: "blah", Hostname: "fooyork.com"}
+	store.CreateCertificate(req, certsman.Certificate{Hostname: "fooyork.com", NotAfter: time.Now().Add(time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := store.RetrieveCertificateContext(ctx, req)
+	assert.Equal(t, context.Canceled, err, "A cancelled context should stop the lookup")
 }